@@ -0,0 +1,84 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuditEntry records an administrative action which bypassed the normal
+// rules, such as a forced overwrite of published contents.
+type AuditEntry struct {
+	Id        int       `json:"audit_id"`
+	Action    string    `json:"action"`
+	NameSpace string    `json:"ns"`
+	Object    string    `json:"object"`
+	Actor     string    `json:"actor"`
+	Detail    string    `json:"detail"`
+	Created   time.Time `json:"created"`
+}
+
+type AuditEntries []AuditEntry
+
+func (e AuditEntry) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(e)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (e AuditEntry) ToString() string {
+	return fmt.Sprintf("%s %s %s/%s by %s: %s",
+		e.Created.Format(time.RFC3339), e.Action, e.NameSpace, e.Object, e.Actor, e.Detail)
+}
+
+func (e AuditEntries) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(e)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (e AuditEntries) ToString() string {
+	lines := make([]string, len(e))
+	for i, entry := range e {
+		lines[i] = entry.ToString()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// audit records an action taken on behalf of request r. Failing to write
+// the audit trail is logged but does not undo the action.
+func (c *DepMan) audit(r *http.Request, action string, ns string, object string, detail string) {
+	c.auditAs(actor(r), action, ns, object, detail)
+}
+
+// auditAs records an action taken by the server itself, such as garbage
+// collection, on behalf of who
+func (c *DepMan) auditAs(who string, action string, ns string, object string, detail string) {
+	entry := &AuditEntry{
+		Action:    action,
+		NameSpace: ns,
+		Object:    object,
+		Actor:     who,
+		Detail:    detail,
+	}
+
+	log.WithFields(log.Fields{
+		"action": action,
+		"ns":     ns,
+		"object": object,
+		"actor":  entry.Actor,
+	}).Warn(detail)
+
+	if err := c.Store.StoreAuditEntry(entry); err != nil {
+		log.Errorf("Cannot write audit entry for %s %s/%s: %s", action, ns, object, err)
+	}
+}
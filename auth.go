@@ -0,0 +1,127 @@
+package depman
+
+import (
+	"crypto/subtle"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// Identity is who a request acts on behalf of, and what it may do
+type Identity struct {
+	Name      string
+	Grants    []Grant
+	Anonymous bool
+}
+
+// Allowed checks whether the identity has at least level want on ns.
+// Requests without a namespace need a grant on AllNamespaces.
+func (i Identity) Allowed(ns string, want Permission) bool {
+	if want == PermNone {
+		return true
+	}
+	for _, g := range i.Grants {
+		if g.NameSpace != AllNamespaces && g.NameSpace != ns {
+			continue
+		}
+		if level, err := ParsePermission(g.Level); err == nil && level >= want {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate works out the identity of r from its bearer token or,
+// failing that, its client certificate. Other requests are anonymous and
+// get Auth.Anonymous on every namespace; unknown tokens are rejected.
+func (c *DepMan) authenticate(r *http.Request) (Identity, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		if id, ok := c.certIdentity(r); ok {
+			return id, nil
+		}
+		return Identity{
+			Name:      "anonymous",
+			Grants:    []Grant{{AllNamespaces, c.Config.Auth.Anonymous}},
+			Anonymous: true,
+		}, nil
+	}
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Identity{}, ErrUnauthorized
+	}
+	secret := strings.TrimPrefix(auth, "Bearer ")
+
+	if c.Config.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(c.Config.AdminToken)) == 1 {
+		return Identity{
+			Name:   "admin",
+			Grants: []Grant{{AllNamespaces, PermAdmin.String()}},
+		}, nil
+	}
+
+	token, err := c.Store.GetToken(HashToken(secret))
+	switch {
+	case err == ErrNotFound:
+		return Identity{}, ErrUnauthorized
+	case err != nil:
+		return Identity{}, err
+	}
+
+	return Identity{Name: token.Name, Grants: token.Grants}, nil
+}
+
+// authorize wraps next so it only runs for requests having at least
+// level want on the namespace of the route.
+func (c *DepMan) authorize(want Permission, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := c.authenticate(r)
+		if err != nil {
+			sendAuthError(w, r, err)
+			return
+		}
+
+		ns := mux.Vars(r)["ns"]
+		if !id.Allowed(ns, want) {
+			log.WithFields(log.Fields{
+				"identity": id.Name,
+				"ns":       ns,
+				"need":     want.String(),
+				"uri":      r.RequestURI,
+			}).Warn("Permission denied")
+
+			if id.Anonymous {
+				sendAuthError(w, r, ErrUnauthorized)
+			} else {
+				sendAuthError(w, r, ErrForbidden)
+			}
+			return
+		}
+
+		context.Set(r, RequestIdentity, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sendAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="depman"`)
+	}
+	SendErrorResponse(w, r, err)
+}
+
+// requestIdentity returns the identity authorize stored for r
+func requestIdentity(r *http.Request) Identity {
+	if id, ok := context.Get(r, RequestIdentity).(Identity); ok {
+		return id
+	}
+	return Identity{Name: "unknown", Anonymous: true}
+}
+
+// actor describes who made request r for logs and the audit trail
+func actor(r *http.Request) string {
+	return fmt.Sprintf("%s (%s)", requestIdentity(r).Name, r.RemoteAddr)
+}
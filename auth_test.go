@@ -0,0 +1,184 @@
+package depman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		grants []Grant
+		ns     string
+		want   Permission
+		ok     bool
+	}{
+		{nil, "team", PermNone, true},
+		{nil, "team", PermRead, false},
+		{[]Grant{{"team", "read"}}, "team", PermRead, true},
+		{[]Grant{{"team", "read"}}, "team", PermWrite, false},
+		{[]Grant{{"team", "read"}}, "other", PermRead, false},
+		{[]Grant{{"team", "write"}}, "team", PermRead, true},
+		{[]Grant{{"team", "write"}}, "team", PermWrite, true},
+		{[]Grant{{"team", "write"}}, "team", PermAdmin, false},
+		{[]Grant{{"team", "admin"}}, "team", PermAdmin, true},
+		// Requests without a namespace need a grant on all of them
+		{[]Grant{{"team", "admin"}}, "", PermAdmin, false},
+		{[]Grant{{AllNamespaces, "read"}}, "other", PermRead, true},
+		{[]Grant{{AllNamespaces, "read"}}, "", PermRead, true},
+		{[]Grant{{AllNamespaces, "read"}}, "", PermAdmin, false},
+		{[]Grant{{AllNamespaces, "read"}, {"team", "admin"}}, "team", PermAdmin, true},
+		{[]Grant{{"team", "bogus"}}, "team", PermRead, false},
+		{[]Grant{{"team", "none"}}, "team", PermRead, false},
+	}
+	for _, test := range tests {
+		id := Identity{Name: "test", Grants: test.grants}
+		if got := id.Allowed(test.ns, test.want); got != test.ok {
+			t.Errorf("%v Allowed(%q, %s) = %t, want %t", test.grants, test.ns, test.want, got, test.ok)
+		}
+	}
+}
+
+// storeTestToken creates a token with grants and returns its secret
+func storeTestToken(t *testing.T, c *DepMan, grants ...Grant) string {
+	issued, err := NewToken("test", grants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Store.StoreToken(&issued.Token); err != nil {
+		t.Fatal(err)
+	}
+	return issued.Secret
+}
+
+func TestAuthorize(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	c.Config.Auth.Anonymous = "none"
+	c.Config.AdminToken = "admin-secret"
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	// Every route is tried in the namespace team
+	identities := []struct {
+		desc   string
+		secret string
+		grants []Grant
+	}{
+		{"anonymous", "", nil},
+		{"reader", storeTestToken(t, c, Grant{"team", "read"}), []Grant{{"team", "read"}}},
+		{"writer", storeTestToken(t, c, Grant{"team", "write"}), []Grant{{"team", "write"}}},
+		{"admin of team", storeTestToken(t, c, Grant{"team", "admin"}), []Grant{{"team", "admin"}}},
+		{"admin of other", storeTestToken(t, c, Grant{"other", "admin"}), []Grant{{"other", "admin"}}},
+		{"global reader", storeTestToken(t, c, Grant{AllNamespaces, "read"}), []Grant{{AllNamespaces, "read"}}},
+		{"admin token", "admin-secret", []Grant{{AllNamespaces, "admin"}}},
+	}
+
+	vars := regexp.MustCompile(`\{[a-z_]+\}`)
+	forbidden := map[Permission]bool{}
+	for _, route := range c.RouteDefinitions() {
+		path := vars.ReplaceAllStringFunc(route.Pattern, func(v string) string {
+			switch v {
+			case "{ns}":
+				return "team"
+			case "{token_id}":
+				return "1000"
+			}
+			return "x"
+		})
+		ns := ""
+		if strings.Contains(route.Pattern, "{ns}") {
+			ns = "team"
+		}
+
+		for _, id := range identities {
+			headers := map[string]string{}
+			if id.secret != "" {
+				headers["Authorization"] = "Bearer " + id.secret
+			}
+			code, body := testRequestHeaders(t, route.Method, server.URL+path, "", headers)
+
+			allowed := Identity{Grants: id.grants}.Allowed(ns, route.Permission)
+			switch {
+			case allowed && (code == http.StatusUnauthorized || code == http.StatusForbidden):
+				t.Errorf("%s %s as %s: %d %s, want it allowed", route.Method, path, id.desc, code, body)
+			case !allowed && id.secret == "" && code != http.StatusUnauthorized:
+				t.Errorf("%s %s as %s: %d, want 401", route.Method, path, id.desc, code)
+			case !allowed && id.secret != "" && code != http.StatusForbidden:
+				t.Errorf("%s %s as %s: %d, want 403", route.Method, path, id.desc, code)
+			case !allowed && id.secret != "":
+				forbidden[route.Permission] = true
+			}
+		}
+	}
+	for _, perm := range []Permission{PermRead, PermWrite, PermAdmin} {
+		if !forbidden[perm] {
+			t.Errorf("No route needing %s was refused", perm)
+		}
+	}
+
+	for _, auth := range []string{"Bearer unknown", "Basic dXNlcjpwYXNz"} {
+		code, _ := testRequestHeaders(t, "GET", server.URL+"/v1/team/lib", "", map[string]string{"Authorization": auth})
+		if code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: %d, want 401", auth, code)
+		}
+	}
+}
+
+func TestLookupChainPermissions(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	c.Config.Auth.Anonymous = "none"
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	// app inherits from team, every namespace has a library of its own
+	if err := c.Store.StoreNamespace(&Namespace{Name: "app", Parent: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range []string{"app", "team", "default"} {
+		f := newTestFile("lib" + ns + ".so")
+		f.NameSpace, f.Library = ns, ns+"lib"
+		if err := c.Store.StoreFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		grants []Grant
+		want   []string
+	}{
+		// Parents the requester may not read are skipped, the default
+		// namespace is open to every lookup
+		{[]Grant{{"app", "read"}}, []string{"applib", "defaultlib"}},
+		{[]Grant{{"app", "read"}, {"team", "read"}}, []string{"applib", "defaultlib", "teamlib"}},
+		{[]Grant{{AllNamespaces, "read"}}, []string{"applib", "defaultlib", "teamlib"}},
+		{[]Grant{{"app", "write"}, {"team", "admin"}}, []string{"applib", "defaultlib", "teamlib"}},
+	}
+	for _, test := range tests {
+		secret := storeTestToken(t, c, test.grants...)
+		code, body := testRequestHeaders(t, "GET", server.URL+"/v1/app/lib", "",
+			map[string]string{"Authorization": "Bearer " + secret})
+		if code != http.StatusOK {
+			t.Errorf("%v: %d %s", test.grants, code, body)
+			continue
+		}
+		libraries := SimpleEntries{}
+		if err := json.Unmarshal([]byte(body), &libraries); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, lib := range libraries {
+			got = append(got, lib.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: found %v, want %v", test.grants, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package depman
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// BlobInfo describes a single object in a BlobStore
+type BlobInfo struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// BlobStore holds the actual file contents. Keys are slash separated
+// relative paths such as "ns/library/version/platform/arch/type/name".
+//
+// Get, GetRange, Stat and Delete return ErrNotFound for keys which do
+// not exist. GetRange reads from offset on, so resumed downloads do not
+// read what the client already has.
+type BlobStore interface {
+	Put(key string, r io.Reader) (int64, error)
+	Get(key string) (io.ReadCloser, error)
+	GetRange(key string, offset int64) (io.ReadCloser, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]BlobInfo, error)
+}
+
+// NewBlobStore opens the blob store selected by cfg.Blob.Driver
+func NewBlobStore(cfg *Config) (BlobStore, error) {
+	switch cfg.Blob.Driver {
+	case "", "fs":
+		return NewFSBlobStore(cfg.StoreDir)
+	case "s3":
+		return NewS3BlobStore(cfg.Blob.S3, cfg.TempDir)
+	default:
+		return nil, fmt.Errorf("Unknown blob store driver: %s", cfg.Blob.Driver)
+	}
+}
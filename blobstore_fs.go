@@ -0,0 +1,148 @@
+package depman
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FSBlobStore keeps blobs as plain files below a local directory
+type FSBlobStore struct {
+	root string
+}
+
+func NewFSBlobStore(root string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("Cannot create storage directory %s: %s", root, err)
+	}
+	return &FSBlobStore{root: root}, nil
+}
+
+func (s *FSBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "\x00") {
+		return "", fmt.Errorf("Invalid blob key: %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temporary file next to the destination and renames it
+// into place so readers never see a partially written blob.
+func (s *FSBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return written, err
+	}
+	log.Debugf("Wrote %d bytes to %s", written, path)
+
+	return written, nil
+}
+
+func (s *FSBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return fh, err
+}
+
+func (s *FSBlobStore) GetRange(key string, offset int64) (io.ReadCloser, error) {
+	fh, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fh.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return fh, nil
+}
+
+func (s *FSBlobStore) Stat(key string) (BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return BlobInfo{}, ErrNotFound
+	case err != nil:
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Key: key, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (s *FSBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// List walks the directory tree and returns all blobs whose key starts
+// with prefix. Temporary files of in-flight Puts are skipped.
+func (s *FSBlobStore) List(prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		}
+		return nil
+	})
+
+	return blobs, err
+}
@@ -0,0 +1,405 @@
+package depman
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3BlobStore talks to any S3-compatible object store (AWS S3, MinIO,
+// Ceph RGW, ...) using signature version 4.
+type S3BlobStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	tempDir  string
+}
+
+// NewS3BlobStore connects to the bucket of cfg. Uploads are spooled in
+// tempDir, or the system temp dir if it is empty.
+func NewS3BlobStore(cfg S3Config, tempDir string) (*S3BlobStore, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 blob store requires a bucket")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3.amazonaws.com"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint %s: %s", cfg.Endpoint, err)
+	}
+
+	log.WithFields(log.Fields{
+		"endpoint":   cfg.Endpoint,
+		"bucket":     cfg.Bucket,
+		"prefix":     cfg.Prefix,
+		"path_style": cfg.PathStyle,
+	}).Debug("S3 blob store configured")
+
+	return &S3BlobStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{},
+		tempDir:  tempDir,
+	}, nil
+}
+
+func (s *S3BlobStore) objectKey(key string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(s.cfg.Prefix, "/")+"/"+strings.TrimPrefix(key, "/"), "/")
+}
+
+func (s *S3BlobStore) blobKey(objectKey string) string {
+	if s.cfg.Prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, strings.TrimSuffix(s.cfg.Prefix, "/")+"/")
+}
+
+// objectURL returns the URL of an object (or of the bucket if key is
+// empty) using either path-style or virtual-hosted-style addressing.
+func (s *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + key
+	if s.cfg.PathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3EscapePath(path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request. body may be nil; payloadHash is the hex
+// SHA-256 of the body.
+func (s *S3BlobStore) do(method string, key string, query url.Values, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	return s.doWithHeader(method, key, query, body, length, payloadHash, nil)
+}
+
+// doWithHeader is do with additional, unsigned request headers
+func (s *S3BlobStore) doWithHeader(method string, key string, query url.Values, body io.Reader, length int64, payloadHash string,
+	header http.Header) (*http.Response, error) {
+
+	u := s.objectURL(key, query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	return s.client.Do(req)
+}
+
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if s.cfg.AccessKey == "" {
+		// Anonymous access
+		return
+	}
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, s.cfg.Region)
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, s.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved
+// characters, as required by signature version 4.
+func s3Escape(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && keepSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error turns a non-2xx response into an error, mapping 404 to ErrNotFound
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	errResp := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	if xml.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+		return fmt.Errorf("S3 error %d: %s: %s", resp.StatusCode, errResp.Code, errResp.Message)
+	}
+	return fmt.Errorf("S3 error %d", resp.StatusCode)
+}
+
+// Put spools the body to a temporary file first: S3 needs the content
+// length and payload hash up front.
+func (s *S3BlobStore) Put(key string, r io.Reader) (int64, error) {
+	tmp, err := ioutil.TempFile(s.tempDir, "depman-s3-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return written, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return written, err
+	}
+
+	resp, err := s.do("PUT", s.objectKey(key), nil, tmp, written, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return written, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return written, s3Error(resp)
+	}
+	log.Debugf("Wrote %d bytes to s3://%s/%s", written, s.cfg.Bucket, s.objectKey(key))
+
+	return written, nil
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.objectKey(key), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// GetRange asks for the object from offset on. Stores ignoring the Range
+// header send all of it, which is then skipped up to offset.
+func (s *S3BlobStore) GetRange(key string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.Get(key)
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s.doWithHeader("GET", s.objectKey(key), nil, nil, 0, emptyPayloadHash, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	if err = skipContent(resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	resp, err := s.do("HEAD", s.objectKey(key), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return BlobInfo{}, s3Error(resp)
+	}
+
+	info := BlobInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.Modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return info, nil
+}
+
+// Delete removes an object. S3 does not report whether the object
+// existed, so Stat first to keep the ErrNotFound contract.
+func (s *S3BlobStore) Delete(key string) error {
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+
+	resp, err := s.do("DELETE", s.objectKey(key), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.objectKey(prefix))
+
+	for {
+		resp, err := s.do("GET", "", query, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return blobs, err
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return blobs, err
+		}
+
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return blobs, err
+		}
+
+		for _, obj := range result.Contents {
+			blobs = append(blobs, BlobInfo{
+				Key:      s.blobKey(obj.Key),
+				Size:     obj.Size,
+				Modified: obj.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	return blobs, nil
+}
@@ -0,0 +1,351 @@
+package depman
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal path-style S3 stand-in holding one bucket. It lists
+// two keys per page so continuation tokens are exercised and answers
+// "bytes=N-" ranges unless noRanges is set.
+type fakeS3 struct {
+	sync.Mutex
+	t        *testing.T
+	bucket   string
+	objects  map[string][]byte
+	noRanges bool
+	// sent counts the object bytes sent by GET requests
+	sent int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+
+	switch {
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			f.t.Errorf("PUT %s: payload hash does not match the body", key)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case r.Method == "GET" && key == "":
+		f.list(w, r)
+	case r.Method == "GET", r.Method == "HEAD":
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		code := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" && !f.noRanges {
+			offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if err != nil || offset >= len(body) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(body)-1, len(body)))
+			body, code = body[offset:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(code)
+		if r.Method == "GET" {
+			f.sent += len(body)
+			w.Write(body)
+		}
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	result := s3ListResult{}
+	for idx := start; idx < len(keys) && idx < start+2; idx++ {
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{keys[idx], int64(len(f.objects[keys[idx]])), time.Now().UTC()})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// testBlobStore checks the BlobStore contract on an empty store
+func testBlobStore(t *testing.T, store BlobStore) {
+	contents := map[string]string{
+		"blobs/sha256/ab/abc": "first",
+		"blobs/sha256/ab/abd": "second",
+		"blobs/sha256/cd/cde": "third",
+		"legacy/ns/foo/1.0":   "fourth",
+	}
+	for key, body := range contents {
+		written, err := store.Put(key, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Put %s: %s", key, err)
+		}
+		if written != int64(len(body)) {
+			t.Errorf("Put %s wrote %d bytes, want %d", key, written, len(body))
+		}
+	}
+
+	fh, err := store.Get("blobs/sha256/ab/abc")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	body, _ := ioutil.ReadAll(fh)
+	fh.Close()
+	if string(body) != "first" {
+		t.Errorf("Get returned %q, want %q", body, "first")
+	}
+
+	fh, err = store.GetRange("blobs/sha256/ab/abd", 2)
+	if err != nil {
+		t.Fatalf("GetRange: %s", err)
+	}
+	body, _ = ioutil.ReadAll(fh)
+	fh.Close()
+	if string(body) != "cond" {
+		t.Errorf("GetRange returned %q, want %q", body, "cond")
+	}
+
+	info, err := store.Stat("blobs/sha256/ab/abd")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Size != 6 {
+		t.Errorf("Stat reports %d bytes, want 6", info.Size)
+	}
+
+	listed, err := store.List("blobs/")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	keys := []string{}
+	for _, b := range listed {
+		keys = append(keys, b.Key)
+	}
+	sort.Strings(keys)
+	if want := "blobs/sha256/ab/abc blobs/sha256/ab/abd blobs/sha256/cd/cde"; strings.Join(keys, " ") != want {
+		t.Errorf("List returned %v, want %s", keys, want)
+	}
+
+	if err = store.Delete("blobs/sha256/ab/abc"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+
+	for name, err := range map[string]error{
+		"Get":      func() error { _, err := store.Get("blobs/sha256/ab/abc"); return err }(),
+		"GetRange": func() error { _, err := store.GetRange("blobs/sha256/ab/abc", 1); return err }(),
+		"Stat":     func() error { _, err := store.Stat("blobs/sha256/ab/abc"); return err }(),
+		"Delete":   store.Delete("blobs/sha256/ab/abc"),
+	} {
+		if err != ErrNotFound {
+			t.Errorf("%s of a deleted blob returned %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestFSBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFSBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestS3BlobStore(t *testing.T) {
+	for _, prefix := range []string{"", "depman/"} {
+		fake := &fakeS3{t: t, bucket: "depman-test", objects: make(map[string][]byte)}
+		server := httptest.NewServer(fake)
+
+		store, err := NewS3BlobStore(S3Config{
+			Endpoint:  server.URL,
+			Bucket:    "depman-test",
+			Prefix:    prefix,
+			AccessKey: "key",
+			SecretKey: "secret",
+			PathStyle: true,
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBlobStore(t, store)
+
+		for key := range fake.objects {
+			if !strings.HasPrefix(key, prefix) {
+				t.Errorf("Object %s stored outside of prefix %q", key, prefix)
+			}
+		}
+		server.Close()
+	}
+}
+
+// spoolWatcher is a body which looks for spooled uploads in dir while it
+// is read
+type spoolWatcher struct {
+	io.Reader
+	dir     string
+	spooled []string
+}
+
+func (w *spoolWatcher) Read(p []byte) (int, error) {
+	if entries, err := ioutil.ReadDir(w.dir); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "depman-s3-") {
+				w.spooled = append(w.spooled, entry.Name())
+			}
+		}
+	}
+	return w.Reader.Read(p)
+}
+
+func TestS3BlobStoreTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := &fakeS3{t: t, bucket: "depman-test", objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := NewS3BlobStore(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "depman-test",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &spoolWatcher{Reader: strings.NewReader("contents"), dir: dir}
+	if _, err = store.Put("blob", body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.spooled) == 0 {
+		t.Errorf("Upload was not spooled in %s", dir)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Upload left %d files in %s", len(entries), dir)
+	}
+}
+
+func TestS3BlobStoreRange(t *testing.T) {
+	for _, noRanges := range []bool{false, true} {
+		fake := &fakeS3{t: t, bucket: "depman-test", objects: make(map[string][]byte), noRanges: noRanges}
+		fake.objects["blob"] = []byte("0123456789")
+		server := httptest.NewServer(fake)
+
+		store, err := NewS3BlobStore(S3Config{
+			Endpoint:  server.URL,
+			Bucket:    "depman-test",
+			AccessKey: "key",
+			SecretKey: "secret",
+			PathStyle: true,
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh, err := store.GetRange("blob", 7)
+		if err != nil {
+			t.Fatalf("GetRange without ranges %t: %s", noRanges, err)
+		}
+		body, _ := ioutil.ReadAll(fh)
+		fh.Close()
+		if string(body) != "789" {
+			t.Errorf("GetRange without ranges %t returned %q, want %q", noRanges, body, "789")
+		}
+
+		// Only stores ignoring the Range header send the whole object
+		want := 3
+		if noRanges {
+			want = 10
+		}
+		if fake.sent != want {
+			t.Errorf("GetRange without ranges %t transferred %d bytes, want %d", noRanges, fake.sent, want)
+		}
+		server.Close()
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	tests := []struct {
+		in        string
+		keepSlash bool
+		want      string
+	}{
+		{"blobs/sha256/ab/abc", true, "blobs/sha256/ab/abc"},
+		{"blobs/sha256/ab/abc", false, "blobs%2Fsha256%2Fab%2Fabc"},
+		{"lib foo+1.0~rc", true, "lib%20foo%2B1.0~rc"},
+		{"a=b&c", false, "a%3Db%26c"},
+	}
+	for _, test := range tests {
+		if got := s3Escape(test.in, test.keepSlash); got != test.want {
+			t.Errorf("s3Escape(%q, %t) = %q, want %q", test.in, test.keepSlash, got, test.want)
+		}
+	}
+}
+
+func TestS3ErrorMapsNotFound(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(&bytes.Buffer{})}
+	if err := s3Error(resp); err != ErrNotFound {
+		t.Errorf("404 mapped to %v, want ErrNotFound", err)
+	}
+
+	body := `<Error><Code>AccessDenied</Code><Message>Nope</Message></Error>`
+	resp = &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader(body))}
+	if err := s3Error(resp); err == nil || !strings.Contains(err.Error(), "AccessDenied: Nope") {
+		t.Errorf("403 mapped to %v, want the S3 error code and message", err)
+	}
+}
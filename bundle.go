@@ -0,0 +1,224 @@
+package depman
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// BundleFormats are the archive formats of library bundles
+var BundleFormats = map[string]string{
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// bundleWriter adds files and symlinks to an archive
+type bundleWriter interface {
+	AddFile(f *File, name string, r io.Reader) error
+	AddSymlink(f *File, name string, target string) error
+	Close() error
+}
+
+// BundlePath is where a file and its links go inside a bundle: a
+// directory per file type, e.g. "header/foo.h" or "shared/libfoo.so"
+func BundlePath(fileType string, name string) string {
+	return fileType + "/" + name
+}
+
+// bundleMode is the mode files of a type get when unpacked
+func bundleMode(fileType string) os.FileMode {
+	if fileType == "shared" {
+		return 0755
+	}
+	return 0644
+}
+
+// HandleBundleDownload streams all files of a library version for one
+// platform and architecture as a single archive, symlinks recreated from
+// their file links. The wanted query parameter limits the file types
+// (e.g. "header,shared"), format picks tar.gz (default) or zip.
+func (c *DepMan) HandleBundleDownload(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Bundle Download")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	contentType, ok := BundleFormats[format]
+	if !ok {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Unknown bundle format %s (want tar.gz or zip)", format)))
+		return
+	}
+
+	files, err := c.chainFiles(w, r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if wanted := r.URL.Query().Get("wanted"); wanted != "" {
+		types := make(map[string]bool)
+		for _, t := range strings.Split(wanted, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+		selected := make(Files, 0, len(files))
+		for _, f := range files {
+			if types[f.Type] {
+				selected = append(selected, f)
+			}
+		}
+		files = selected
+	}
+
+	if len(files) == 0 {
+		SendErrorResponse(w, r, ErrNotFound)
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return BundlePath(files[i].Type, files[i].Name) < BundlePath(files[j].Type, files[j].Name)
+	})
+
+	// The archive is streamed, so errors from here on can only cut it
+	// short. Clients notice the truncated archive.
+	f := files[0]
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s-%s-%s.%s"`,
+		f.Library, f.Version, f.Platform, f.Arch, format))
+	w.WriteHeader(http.StatusOK)
+
+	var bw bundleWriter
+	if format == "zip" {
+		bw = &zipBundle{zip.NewWriter(w)}
+	} else {
+		bw = newTarBundle(w)
+	}
+
+	if err = c.writeBundle(bw, files); err != nil {
+		log.Errorf("Bundle of %s/%s:%s aborted: %s", f.NameSpace, f.Library, f.Version, err)
+		return
+	}
+	if err = bw.Close(); err != nil {
+		log.Errorf("Bundle of %s/%s:%s aborted: %s", f.NameSpace, f.Library, f.Version, err)
+		return
+	}
+	log.Debugf("Bundled %d files", len(files))
+}
+
+func (c *DepMan) writeBundle(bw bundleWriter, files Files) error {
+	for idx := range files {
+		f := &files[idx]
+
+		fh, err := c.getContent(f.BlobKey(), f.LegacyBlobKey())
+		if err != nil {
+			return fmt.Errorf("Cannot open %s: %s", f.ToString(), err)
+		}
+		err = bw.AddFile(f, BundlePath(f.Type, f.Name), fh)
+		fh.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, link := range f.Links {
+			if err = bw.AddSymlink(f, BundlePath(f.Type, link.Name), f.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type tarBundle struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarBundle(w io.Writer) *tarBundle {
+	gz := gzip.NewWriter(w)
+	return &tarBundle{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (b *tarBundle) AddFile(f *File, name string, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(bundleMode(f.Type)),
+		Size:     f.Size,
+		ModTime:  f.LastModified(),
+	}
+	if f.Checksum == "" {
+		// No size recorded for legacy files: the contents have to be
+		// read before the header can be written
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr.Size = int64(len(buf))
+		r = bytes.NewReader(buf)
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(b.tw, r)
+	return err
+}
+
+func (b *tarBundle) AddSymlink(f *File, name string, target string) error {
+	return b.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  f.LastModified(),
+	})
+}
+
+func (b *tarBundle) Close() error {
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+type zipBundle struct {
+	zw *zip.Writer
+}
+
+func (b *zipBundle) AddFile(f *File, name string, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: f.LastModified()}
+	hdr.SetMode(bundleMode(f.Type))
+	fw, err := b.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// AddSymlink stores the link target as contents, the way zip and unzip
+// do on Unix
+func (b *zipBundle) AddSymlink(f *File, name string, target string) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Store, Modified: f.LastModified()}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	fw, err := b.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, target)
+	return err
+}
+
+func (b *zipBundle) Close() error {
+	return b.zw.Close()
+}
@@ -0,0 +1,161 @@
+package depman
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bundleEntries describes the entries of a bundle as "name mode
+// contents", symlinks as "name -> target"
+func bundleEntries(t *testing.T, format string, body []byte) []string {
+	entries := []string{}
+	describe := func(name string, mode os.FileMode, r io.Reader) {
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode&os.ModeSymlink != 0 {
+			entries = append(entries, fmt.Sprintf("%s -> %s", name, contents))
+			return
+		}
+		entries = append(entries, fmt.Sprintf("%s %o %s", name, mode.Perm(), contents))
+	}
+
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			fh, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			describe(f.Name, f.Mode(), fh)
+			fh.Close()
+		}
+		return entries
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			describe(hdr.Name, os.ModeSymlink, strings.NewReader(hdr.Linkname))
+			continue
+		}
+		describe(hdr.Name, hdr.FileInfo().Mode(), tr)
+	}
+	return entries
+}
+
+func TestBundleDownload(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	c.Config.Publish.GracePeriod = Duration{time.Hour}
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	files := server.URL + "/v1/default/lib/foo/versions/1.0/files/"
+	for _, step := range []struct{ url, body string }{
+		{files + "el7/x86_64/header/foo.h/upload", "header"},
+		{files + "el7/x86_64/archive/libfoo.a/upload", "archive"},
+		{files + "el7/x86_64/shared/libfoo.so.1/upload", "shared"},
+		{files + "el7/x86_64/shared/libfoo.so.1/links/libfoo.so", ""},
+		{files + "el6/x86_64/header/foo.h/upload", "other platform"},
+	} {
+		if code, body := testRequest(t, "PUT", step.url, step.body); code != http.StatusOK {
+			t.Fatalf("PUT %s: %d %s", step.url, code, body)
+		}
+	}
+	// Stored before checksums and sizes were recorded
+	legacy := newTestFile("libold.a")
+	legacy.Checksum, legacy.Size = "", 0
+	if err := c.Store.StoreFile(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Blobs.Put(legacy.LegacyBlobKey(), strings.NewReader("legacy")); err != nil {
+		t.Fatal(err)
+	}
+
+	all := []string{
+		"archive/libfoo.a 644 archive",
+		"header/foo.h 644 header",
+		"lib/libold.a 644 legacy",
+		"shared/libfoo.so.1 755 shared",
+		"shared/libfoo.so -> libfoo.so.1",
+	}
+	bundle := server.URL + "/v1/default/lib/foo/versions/1.0/bundle/el7/x86_64"
+	tests := []struct {
+		query  string
+		format string
+		want   []string
+	}{
+		{"", "tar.gz", all},
+		{"?format=zip", "zip", all},
+		{"?format=tar.gz&wanted=header,shared", "tar.gz", []string{all[1], all[3], all[4]}},
+		{"?format=zip&wanted=header", "zip", []string{all[1]}},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(bundle + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Bundle%s: %d %s", test.query, resp.StatusCode, body)
+			continue
+		}
+
+		if got := resp.Header.Get("Content-Type"); got != BundleFormats[test.format] {
+			t.Errorf("Bundle%s: content type %s, want %s", test.query, got, BundleFormats[test.format])
+		}
+		disposition := `attachment; filename="foo-1.0-el7-x86_64.` + test.format + `"`
+		if got := resp.Header.Get("Content-Disposition"); got != disposition {
+			t.Errorf("Bundle%s: disposition %s, want %s", test.query, got, disposition)
+		}
+		if got := bundleEntries(t, test.format, body); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Bundle%s has\n%s\nwant\n%s", test.query, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+
+	for _, test := range []struct {
+		url  string
+		code int
+	}{
+		{bundle + "?format=rar", http.StatusBadRequest},
+		{bundle + "?wanted=object", http.StatusNotFound},
+		{server.URL + "/v1/default/lib/foo/versions/2.0/bundle/el7/x86_64", http.StatusNotFound},
+		{server.URL + "/v1/default/lib/foo/versions/1.0/bundle/el7/ppc64", http.StatusNotFound},
+	} {
+		if code, body := testRequest(t, "GET", test.url, ""); code != test.code {
+			t.Errorf("GET %s: %d %s, want %d", test.url, code, body, test.code)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package depman
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// hashingReader computes the SHA-256 and size of everything read through it
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Checksum returns the hex encoded SHA-256 of the data read so far
+func (h *hashingReader) Checksum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+func (h *hashingReader) Size() int64 {
+	return h.size
+}
+
+// setContentHeaders advertises size and checksum of a download. Rows
+// stored before checksums were recorded have no checksum.
+func setContentHeaders(w http.ResponseWriter, checksum string, size int64) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if checksum != "" {
+		w.Header().Set(ChecksumHeader, checksum)
+	}
+}
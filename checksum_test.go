@@ -0,0 +1,78 @@
+package depman
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashingReader(t *testing.T) {
+	h := newHashingReader(strings.NewReader("contents"))
+	body, err := ioutil.ReadAll(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "contents" {
+		t.Errorf("Read %q through the hashing reader, want %q", body, "contents")
+	}
+	if h.Checksum() != testChecksum("contents") || h.Size() != 8 {
+		t.Errorf("Hashed %s and %d bytes, want %s and 8", h.Checksum(), h.Size(), testChecksum("contents"))
+	}
+}
+
+func TestChecksumHeaders(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	checksum := testChecksum("contents")
+	for _, base := range []string{
+		"/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a",
+		"/v1/default/extra/tool/2.0",
+	} {
+		resp := do("PUT", base+"/upload", "contents")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(ChecksumHeader) != checksum {
+			t.Errorf("Upload of %s: %d with checksum %q, want %s", base, resp.StatusCode, resp.Header.Get(ChecksumHeader), checksum)
+		}
+
+		for _, method := range []string{"GET", "HEAD"} {
+			resp = do(method, base+"/download", "")
+			if got := resp.Header.Get(ChecksumHeader); got != checksum {
+				t.Errorf("%s %s: checksum %q, want %s", method, base, got, checksum)
+			}
+			if resp.ContentLength != 8 {
+				t.Errorf("%s %s: length %d, want 8", method, base, resp.ContentLength)
+			}
+		}
+	}
+
+	// Listings carry them too, so clients can verify without asking again
+	code, body := testRequest(t, "GET", server.URL+"/v1/default/lib/foo/versions/1.0/files", "")
+	if code != http.StatusOK {
+		t.Fatalf("Listing files: %d %s", code, body)
+	}
+	files := Files{}
+	if err := json.Unmarshal([]byte(body), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Checksum != checksum || files[0].Size != 8 {
+		t.Errorf("Listed %v, want libfoo.a with checksum %s and 8 bytes", files, checksum)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/depman"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// libBundle is a resolved library fetched as one archive, with the files
+// wanted from it
+type libBundle struct {
+	lib  depman.ResolvedLib
+	jobs []fileJob
+}
+
+// newLibBundles groups jobs by library, in the order libraries first
+// appear
+func newLibBundles(jobs []fileJob) []*libBundle {
+	bundles := make([]*libBundle, 0)
+	byLib := make(map[string]*libBundle)
+	for _, j := range jobs {
+		key := j.lib.NameSpace + "/" + j.lib.Library + "/" + j.lib.Version
+		b, ok := byLib[key]
+		if !ok {
+			b = &libBundle{lib: j.lib}
+			byLib[key] = b
+			bundles = append(bundles, b)
+		}
+		b.jobs = append(b.jobs, j)
+	}
+	return bundles
+}
+
+// path asks for the wanted file types only
+func (b *libBundle) path() string {
+	seen := make(map[string]bool)
+	types := make([]string, 0)
+	for _, j := range b.jobs {
+		if !seen[j.file.Type] {
+			seen[j.file.Type] = true
+			types = append(types, j.file.Type)
+		}
+	}
+	sort.Strings(types)
+
+	f := b.jobs[0].file
+	return fmt.Sprintf("/v1/%s/lib/%s/versions/%s/bundle/%s/%s?wanted=%s",
+		b.lib.NameSpace, b.lib.Library, url.PathEscape(b.lib.Version), f.Platform, f.Arch,
+		url.QueryEscape(strings.Join(types, ",")))
+}
+
+// run downloads the bundle and unpacks the wanted files and their
+// symlinks. Libraries which are in the cache completely are installed
+// from there instead; unpacked files are added to it.
+func (b *libBundle) run() error {
+	if cache != nil {
+		cached := true
+		for _, j := range b.jobs {
+			if !cache.has(j.file) {
+				cached = false
+				break
+			}
+		}
+		if cached {
+			log.Debugf("All of %s:%s is cached", b.lib.Library, b.lib.Version)
+			for _, j := range b.jobs {
+				if err := j.run(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	log.Infof("  Downloading bundle: %s:%s (%d files)", b.lib.Library, b.lib.Version, len(b.jobs))
+	fh, err := ioutil.TempFile("", "depman-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	d := &download{
+		url:  strings.Join([]string{depmanUrl, b.path()}, ""),
+		fh:   fh,
+		hash: sha256.New(),
+		size: -1,
+	}
+	if err = d.run(); err != nil {
+		return err
+	}
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return b.unpack(fh)
+}
+
+// unpack installs the files of a tar.gz bundle, verifying each against
+// its checksum, and the symlinks pointing to them
+func (b *libBundle) unpack(r io.Reader) error {
+	files := make(map[string][]fileJob)
+	links := make(map[string][]fileJob)
+	for _, j := range b.jobs {
+		name := depman.BundlePath(j.file.Type, j.file.Name)
+		files[name] = append(files[name], j)
+		for _, link := range j.file.Links {
+			name = depman.BundlePath(j.file.Type, link.Name)
+			links[name] = append(links[name], j)
+		}
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Cannot read bundle: %s", err)
+	}
+	tr := tar.NewReader(gz)
+
+	done := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read bundle: %s", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			jobs, ok := files[hdr.Name]
+			if !ok {
+				log.Debugf("Skipping unwanted %s in bundle", hdr.Name)
+				continue
+			}
+			// Every copy but the first comes from the first
+			first := ""
+			for _, j := range jobs {
+				localfile := j.localfile()
+				if first == "" {
+					log.Infof("  Unpacking file: %s %s", j.file.Type, j.file.Name)
+					err = writeVerified(tr, localfile, j.mode, j.file.Checksum)
+					first = localfile
+				} else {
+					err = copyFile(first, localfile, j.mode)
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %s", hdr.Name, err)
+				}
+				j.installed(localfile)
+			}
+			if cache != nil {
+				if err = cache.add(first, jobs[0].file, jobs[0].mode); err != nil {
+					log.Warnf("Cannot add %s to the cache: %s", first, err)
+				}
+			}
+			done[hdr.Name] = true
+		case tar.TypeSymlink:
+			jobs, ok := links[hdr.Name]
+			if !ok {
+				continue
+			}
+			if filepath.Base(hdr.Linkname) != hdr.Linkname {
+				return fmt.Errorf("%s: symlink points outside its directory (%s)", hdr.Name, hdr.Linkname)
+			}
+			for _, j := range jobs {
+				if err = j.symlink(filepath.Base(hdr.Name), hdr.Linkname); err != nil {
+					return err
+				}
+			}
+			done[hdr.Name] = true
+		}
+	}
+
+	for _, want := range []map[string][]fileJob{files, links} {
+		for name := range want {
+			if !done[name] {
+				return fmt.Errorf("Bundle lacks %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// writeVerified writes r to localfile via a temporary file, if not empty
+// checking the contents against checksum first
+func writeVerified(r io.Reader, localfile string, mode os.FileMode, checksum string) error {
+	if err := os.MkdirAll(filepath.Dir(localfile), 0755); err != nil {
+		return err
+	}
+	tmpfile := fmt.Sprintf("%s/.%s.dwn", filepath.Dir(localfile), filepath.Base(localfile))
+	os.Remove(tmpfile)
+	fh, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fh, hash), r)
+	fh.Close()
+	if err == nil && checksum != "" {
+		if got := hex.EncodeToString(hash.Sum(nil)); got != checksum {
+			err = fmt.Errorf("Checksum mismatch: expected sha256 %s, got %s", checksum, got)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, localfile)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return writeVerified(fh, dst, mode, "")
+}
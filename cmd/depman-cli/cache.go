@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/depman"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usedMarker is touched every time a cache entry is used. The entry's
+// own files may be hard linked into projects, so their times must not
+// change.
+const usedMarker = ".used"
+
+// fileCache keeps downloaded library files per user, keyed by name
+// space, library, version, platform, architecture, type, name and
+// checksum. Files without a checksum are never cached.
+type fileCache struct {
+	dir      string
+	limit    int64
+	hardlink bool
+	// offline fails on misses instead of downloading
+	offline bool
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// cacheEntry is one cached file
+type cacheEntry struct {
+	Key  string
+	Path string
+	Size int64
+	Used time.Time
+}
+
+// cache is nil when caching is disabled
+var cache *fileCache
+
+func defaultCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "depman")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".cache", "depman")
+	}
+	return ""
+}
+
+func newFileCache(dir string, size string, link string) (*fileCache, error) {
+	limit, err := parseSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCache{dir: dir, limit: limit, locks: make(map[string]*sync.Mutex)}
+	switch link {
+	case "", "copy":
+	case "hardlink":
+		c.hardlink = true
+	default:
+		return nil, fmt.Errorf("Unknown cache link mode %s (want copy or hardlink)", link)
+	}
+
+	return c, nil
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	for idx, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			mult = int64(1) << (10 * uint(idx+1))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %s", s)
+	}
+	return n * mult, nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func (c *fileCache) entryDir(f depman.File) string {
+	parts := []string{c.dir, "files"}
+	for _, p := range []string{f.NameSpace, f.Library, f.Version, f.Platform, f.Arch, f.Type, f.Checksum} {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return filepath.Join(parts...)
+}
+
+// lock serializes work on one entry between download workers
+func (c *fileCache) lock(dir string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[dir] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// fetch installs f at localfile, downloading it from uri_path into the
+// cache first unless a valid copy is there already
+func (c *fileCache) fetch(uri_path string, f depman.File, localfile string, mode os.FileMode) error {
+	dir := c.entryDir(f)
+	cached := filepath.Join(dir, f.Name)
+	defer c.lock(dir)()
+
+	if c.valid(cached, f) {
+		log.Debugf("Cache hit: %s", cached)
+	} else if c.offline {
+		return fmt.Errorf("Offline: not in the cache (%s)", cached)
+	} else {
+		log.Debugf("Cache miss: %s", cached)
+		if err := c.store(uri_path, f, dir, cached, mode); err != nil {
+			return err
+		}
+	}
+
+	c.markUsed(dir)
+	return c.install(cached, localfile, mode)
+}
+
+func (c *fileCache) markUsed(dir string) {
+	now := time.Now()
+	marker := filepath.Join(dir, usedMarker)
+	if err := ioutil.WriteFile(marker, nil, 0644); err == nil {
+		os.Chtimes(marker, now, now)
+	}
+}
+
+// has reports whether a valid copy of f is cached
+func (c *fileCache) has(f depman.File) bool {
+	if f.Checksum == "" {
+		return false
+	}
+	dir := c.entryDir(f)
+	defer c.lock(dir)()
+	return c.valid(filepath.Join(dir, f.Name), f)
+}
+
+// add copies f, installed at localfile without going through the cache
+// (e.g. from a bundle), into the cache
+func (c *fileCache) add(localfile string, f depman.File, mode os.FileMode) error {
+	if f.Checksum == "" {
+		return nil
+	}
+	dir := c.entryDir(f)
+	cached := filepath.Join(dir, f.Name)
+	defer c.lock(dir)()
+
+	if !c.valid(cached, f) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		src, err := os.Open(localfile)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		fh, err := ioutil.TempFile(dir, ".dwn")
+		if err != nil {
+			return err
+		}
+		tmpfile := fh.Name()
+		_, err = io.Copy(fh, src)
+		fh.Close()
+		if err == nil {
+			err = os.Chmod(tmpfile, mode)
+		}
+		if err == nil {
+			err = os.Rename(tmpfile, cached)
+		}
+		if err != nil {
+			os.Remove(tmpfile)
+			return err
+		}
+	}
+
+	c.markUsed(dir)
+	return nil
+}
+
+// valid checks a cached file against the size and checksum of f, so
+// entries changed through a hard link are not handed out again
+func (c *fileCache) valid(path string, f depman.File) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if f.Size > 0 && info.Size() != f.Size {
+		log.Warnf("Cached %s has the wrong size - downloading again", path)
+		return false
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, fh); err != nil {
+		return false
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != f.Checksum {
+		log.Warnf("Cached %s has the wrong checksum - downloading again", path)
+		return false
+	}
+	return true
+}
+
+func (c *fileCache) store(uri_path string, f depman.File, dir string, cached string, mode os.FileMode) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Unique temporary file, other depman-cli processes may be filling
+	// the same entry
+	fh, err := ioutil.TempFile(dir, ".dwn")
+	if err != nil {
+		return err
+	}
+	tmpfile := fh.Name()
+
+	err = downloadToFh(uri_path, fh, f.Checksum)
+	fh.Close()
+	if err == nil {
+		err = os.Chmod(tmpfile, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, cached)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+// install hard links or copies a cached file to localfile
+func (c *fileCache) install(cached string, localfile string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(localfile), 0755); err != nil {
+		return err
+	}
+	os.Remove(localfile)
+
+	if c.hardlink {
+		err := os.Link(cached, localfile)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Cannot hard link %s, copying: %s", cached, err)
+	}
+
+	src, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpfile := fmt.Sprintf("%s/.%s.dwn", filepath.Dir(localfile), filepath.Base(localfile))
+	dst, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, localfile)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+// entries lists the cache, least recently used first
+func (c *fileCache) entries() ([]cacheEntry, error) {
+	entries := make([]cacheEntry, 0)
+	root := filepath.Join(c.dir, "files")
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != usedMarker {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		entry := cacheEntry{Path: dir, Used: info.ModTime()}
+		entry.Key, _ = filepath.Rel(root, dir)
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			entry.Size += f.Size()
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Used.Before(entries[j].Used) })
+	return entries, err
+}
+
+// prune evicts the least recently used entries until the cache is no
+// larger than limit
+func (c *fileCache) prune(limit int64) (int, int64, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	removed := 0
+	var freed int64
+	for _, e := range entries {
+		if total <= limit {
+			break
+		}
+		log.Infof("Evicting %s (%s, last used %s)", e.Key, formatSize(e.Size), e.Used.Format(time.RFC3339))
+		if err = os.RemoveAll(e.Path); err != nil {
+			return removed, freed, err
+		}
+		total -= e.Size
+		freed += e.Size
+		removed++
+	}
+
+	return removed, freed, nil
+}
+
+// cacheCommand implements `depman-cli cache [info|list|prune [size]|clear]`
+func cacheCommand(args []string) error {
+	if cache == nil {
+		return fmt.Errorf("The cache is disabled")
+	}
+
+	sub := "info"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+
+	switch sub {
+	case "info", "list":
+		entries, err := cache.entries()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+			if sub == "list" {
+				fmt.Printf("%s  %8s  %s\n", e.Used.Format("2006-01-02 15:04"), formatSize(e.Size), e.Key)
+			}
+		}
+		if sub == "info" {
+			fmt.Printf("Directory: %s\n", cache.dir)
+			fmt.Printf("Files    : %d\n", len(entries))
+			fmt.Printf("Size     : %s of %s\n", formatSize(total), formatSize(cache.limit))
+		}
+	case "prune", "clear":
+		limit := cache.limit
+		if sub == "clear" {
+			limit = 0
+		} else if len(args) > 1 {
+			var err error
+			if limit, err = parseSize(args[1]); err != nil {
+				return err
+			}
+		}
+		removed, freed, err := cache.prune(limit)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d files (%s)\n", removed, formatSize(freed))
+	default:
+		return fmt.Errorf("Unknown cache operation %s", sub)
+	}
+
+	return nil
+}
+
+// pruneCache keeps the cache within its limit after downloads
+func pruneCache() {
+	if cache == nil {
+		return
+	}
+	if _, _, err := cache.prune(cache.limit); err != nil {
+		log.Warnf("Cannot prune cache %s: %s", cache.dir, err)
+	}
+}
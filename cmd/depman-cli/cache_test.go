@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/moensch/depman"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"10K", 10 << 10, true},
+		{"10kb", 10 << 10, true},
+		{" 2G ", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"10X", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d and ok %t", test.s, got, err, test.want, test.ok)
+		}
+	}
+
+	for n, want := range map[int64]string{0: "0B", 1023: "1023B", 1536: "1.5K", 5 << 20: "5.0M", 3 << 30: "3.0G"} {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
+
+// newTestCache returns a cache in a new directory and a function
+// writing a header of library name next to it
+func newTestCache(t *testing.T) (*fileCache, func(name string, body string) (depman.File, string), func()) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newFileCache(filepath.Join(dir, "cache"), "1G", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := func(name string, body string) (depman.File, string) {
+		f := depman.File{NameSpace: "default", Library: name, Version: "1.0", Platform: "el7", Arch: "x86_64",
+			Type: "header", Name: name + ".h", Checksum: testChecksum(body), Size: int64(len(body))}
+		localfile := filepath.Join(dir, "include", f.Name)
+		if err := os.MkdirAll(filepath.Dir(localfile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(localfile, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return f, localfile
+	}
+	return c, newFile, func() { os.RemoveAll(dir) }
+}
+
+func TestCachePrune(t *testing.T) {
+	c, newFile, cleanup := newTestCache(t)
+	defer cleanup()
+	c.offline = true
+
+	files := map[string]depman.File{}
+	for idx, name := range []string{"a", "b", "c", "d"} {
+		f, localfile := newFile(name, "0123456789")
+		if err := c.add(localfile, f, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// a was used first, d last
+		used := time.Now().Add(time.Duration(idx-10) * time.Minute)
+		if err := os.Chtimes(filepath.Join(c.entryDir(f), usedMarker), used, used); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = f
+	}
+
+	// Using b again makes it the most recently used
+	if err := c.fetch("/unused", files["b"], filepath.Join(c.dir, "b.h"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, freed, err := c.prune(25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || freed != 20 {
+		t.Errorf("Pruned %d entries and %d bytes, want 2 and 20", removed, freed)
+	}
+	kept := []string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if c.has(files[name]) {
+			kept = append(kept, name)
+		}
+	}
+	if !reflect.DeepEqual(kept, []string{"b", "d"}) {
+		t.Errorf("Kept %v, want b and d", kept)
+	}
+
+	if removed, _, _ = c.prune(20); removed != 0 {
+		t.Errorf("Pruned %d entries of a cache within its limit", removed)
+	}
+	if removed, _, _ = c.prune(0); removed != 2 {
+		t.Errorf("Cleared %d entries, want 2", removed)
+	}
+}
+
+func TestCacheFetch(t *testing.T) {
+	requests := 0
+	body := "contents"
+	defer useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(body))
+	}))()
+
+	c, newFile, cleanup := newTestCache(t)
+	defer cleanup()
+	f, localfile := newFile("foo", body)
+	os.Remove(localfile)
+
+	for i := 0; i < 2; i++ {
+		if err := c.fetch("/download", f, localfile, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(localfile); string(got) != body {
+			t.Errorf("Installed %q, want %q", got, body)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Downloaded %d times, want once", requests)
+	}
+
+	// A cached file changed behind the cache's back is not handed out
+	cached := filepath.Join(c.entryDir(f), f.Name)
+	for _, changed := range []string{"Contents", "contents and more"} {
+		if err := ioutil.WriteFile(cached, []byte(changed), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if c.valid(cached, f) {
+			t.Errorf("Cached %q passed as %q", changed, body)
+		}
+		if err := c.fetch("/download", f, localfile, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(localfile); string(got) != body {
+			t.Errorf("Installed %q after the cache was changed, want %q", got, body)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("Downloaded %d times, want again for every change", requests)
+	}
+
+	c.offline = true
+	other, otherfile := newFile("bar", "other")
+	if err := c.fetch("/download", other, otherfile, 0644); err == nil {
+		t.Errorf("Offline cache miss succeeded")
+	}
+	if requests != 3 {
+		t.Errorf("Offline cache miss downloaded")
+	}
+}
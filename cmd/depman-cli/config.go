@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CliConfig is the optional depman-cli config file, by default
+// ~/.depman.json. Flags and environment variables take precedence.
+type CliConfig struct {
+	URL        string `json:"url"`
+	Token      string `json:"token"`
+	CACert     string `json:"ca_cert"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	CacheDir   string `json:"cache_dir"`
+	CacheSize  string `json:"cache_size"`
+	CacheLink  string `json:"cache_link"`
+}
+
+var cliConfig = CliConfig{
+	CacheDir:  defaultCacheDir(),
+	CacheSize: "2G",
+	CacheLink: "copy",
+}
+
+func defaultConfigFile() string {
+	if path := os.Getenv("DEPMAN_CONFIG"); path != "" {
+		return path
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".depman.json")
+}
+
+// loadCliConfig reads the config file at path and applies DEPMAN_TOKEN,
+// DEPMAN_CA_CERT, DEPMAN_CLIENT_CERT, DEPMAN_CLIENT_KEY and the
+// DEPMAN_CACHE_* variables. A missing file is fine unless it was asked
+// for explicitly.
+func loadCliConfig(path string, explicit bool) error {
+	if err := readCliConfig(path, explicit); err != nil {
+		return err
+	}
+
+	for env, dst := range map[string]*string{
+		"DEPMAN_TOKEN":       &cliConfig.Token,
+		"DEPMAN_CA_CERT":     &cliConfig.CACert,
+		"DEPMAN_CLIENT_CERT": &cliConfig.ClientCert,
+		"DEPMAN_CLIENT_KEY":  &cliConfig.ClientKey,
+		"DEPMAN_CACHE_DIR":   &cliConfig.CacheDir,
+		"DEPMAN_CACHE_SIZE":  &cliConfig.CacheSize,
+		"DEPMAN_CACHE_LINK":  &cliConfig.CacheLink,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*dst = v
+		}
+	}
+
+	return nil
+}
+
+func readCliConfig(path string, explicit bool) error {
+	if path == "" {
+		return nil
+	}
+
+	fh, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+		return nil
+	case err != nil:
+		return fmt.Errorf("Cannot open config file %s: %s", path, err)
+	}
+	defer fh.Close()
+
+	if err = json.NewDecoder(fh).Decode(&cliConfig); err != nil {
+		return fmt.Errorf("Cannot parse config file %s: %s", path, err)
+	}
+	log.Debugf("Loaded config file %s", path)
+
+	return nil
+}
+
+// newHTTPClient returns a client trusting CACert in addition to the
+// system roots and presenting the client certificate, if configured.
+// Connecting and waiting for response headers time out after
+// httpTimeout.
+func newHTTPClient() (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   httpTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   httpTimeout,
+		ResponseHeaderTimeout: httpTimeout,
+		MaxIdleConnsPerHost:   parallelDownloads,
+	}
+
+	if cliConfig.CACert == "" && cliConfig.ClientCert == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cliConfig.CACert != "" {
+		pem, err := ioutil.ReadFile(cliConfig.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA file %s: %s", cliConfig.CACert, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cliConfig.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cliConfig.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cliConfig.ClientCert, cliConfig.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate %s: %s", cliConfig.ClientCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// newRequest is http.NewRequest plus the API token, if there is one. In
+// offline mode it refuses to build requests at all.
+func newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	if offlineMode {
+		return nil, fmt.Errorf("Offline: not contacting %s", url)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if cliConfig.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cliConfig.Token)
+	}
+	return req, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Depfiles come in two formats. The legacy one has a line per library:
+//
+//	name[:version] [| include subdir [| wanted types]]
+//
+// Files ending in .toml use a subset of TOML with a [[dependency]] table
+// per library:
+//
+//	[[dependency]]
+//	name = "libfoo"
+//	version = "^2.1"
+//	include = "foo"
+//	wanted = ["header", "shared"]
+//	ns = "team"                # where to resolve it
+//	platform = "el7"           # which build to fetch
+//	arch = "x86_64"
+//	optional = true            # skip it if nothing matches
+//	if_platform = ["el6", "el7"]
+//	if_arch = "x86_64"         # only on these targets
+//
+// Both formats allow # comments. Errors name the file and line.
+
+type depfileError struct {
+	file string
+	line int
+	msg  string
+}
+
+func (e depfileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+}
+
+var libNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+func ParseDepfile(depfile string) (*RequiredLibs, error) {
+	deps := &RequiredLibs{}
+
+	fh, err := os.Open(depfile)
+	if err != nil {
+		return deps, fmt.Errorf("Cannot open dependency file %s: %s", depfile, err)
+	}
+	defer fh.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return deps, fmt.Errorf("Cannot read dependency file %s: %s", depfile, err)
+	}
+
+	var libs []*RequiredLib
+	if strings.HasSuffix(depfile, ".toml") {
+		libs, err = parseTomlDepfile(depfile, lines)
+	} else {
+		libs, err = parseLegacyDepfile(depfile, lines)
+	}
+	if err != nil {
+		return deps, err
+	}
+
+	for _, lib := range libs {
+		deps.Add(lib)
+		log.Infof("Want lib: %s", lib.String())
+	}
+
+	return deps, nil
+}
+
+func parseLegacyDepfile(depfile string, lines []string) ([]*RequiredLib, error) {
+	libs := make([]*RequiredLib, 0)
+
+	for idx, line := range lines {
+		log.Debugf("Read line: '%s'", line)
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		lib, err := parseDepLine(strings.TrimSpace(line))
+		if err != nil {
+			return libs, depfileError{depfile, idx + 1, err.Error()}
+		}
+		libs = append(libs, lib)
+	}
+
+	return libs, nil
+}
+
+func parseDepLine(line string) (*RequiredLib, error) {
+	// split by pipe, surrounded by optional white space
+	white := regexp.MustCompile("\\s*\\|\\s*")
+	fields := white.Split(line, -1)
+	if len(fields) > 3 {
+		return nil, fmt.Errorf("Expected at most 3 fields (name:version | include dir | types), got %d", len(fields))
+	}
+
+	lib := &RequiredLib{}
+	lib.Wanted = "header,archive,shared"
+
+	for idx, field := range fields {
+		switch {
+		case idx == 0:
+			// The version is a constraint such as 1.2, >=1.2,<2 or ^3
+			parts := strings.SplitN(field, ":", 2)
+			lib.Name = parts[0]
+			if !libNameRe.MatchString(lib.Name) {
+				return nil, fmt.Errorf("Invalid library name '%s'", lib.Name)
+			}
+			if len(parts) > 1 && parts[1] != "" {
+				lib.Version = parts[1]
+			} else {
+				lib.Version = "latest"
+			}
+		case idx == 1:
+			lib.IncDir = includeSubdir(field)
+		case idx == 2:
+			wanted, err := parseWanted(field)
+			if err != nil {
+				return nil, err
+			}
+			lib.Wanted = wanted
+		}
+	}
+
+	log.Debugf("Dependency: %s", lib.String())
+
+	return lib, nil
+}
+
+func includeSubdir(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return ""
+	}
+	if !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir
+	}
+	return dir
+}
+
+var fileTypes = map[string]bool{
+	"header":  true,
+	"archive": true,
+	"shared":  true,
+	"object":  true,
+}
+
+// parseWanted checks a comma separated list of file types
+func parseWanted(s string) (string, error) {
+	types := make([]string, 0)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !fileTypes[t] {
+			return "", fmt.Errorf("Unknown file type '%s' (want header, archive, shared or object)", t)
+		}
+		types = append(types, t)
+	}
+	if len(types) == 0 {
+		return "", fmt.Errorf("No file types given")
+	}
+	return strings.Join(types, ","), nil
+}
+
+// tomlEntry is one [[dependency]] table and the line it starts on
+type tomlEntry struct {
+	line   int
+	values map[string]interface{}
+	lines  map[string]int
+}
+
+func parseTomlDepfile(depfile string, lines []string) ([]*RequiredLib, error) {
+	entries := make([]*tomlEntry, 0)
+	var current *tomlEntry
+
+	for idx := 0; idx < len(lines); idx++ {
+		lineno := idx + 1
+		line := strings.TrimSpace(stripTomlComment(lines[idx]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if line != "[[dependency]]" {
+				return nil, depfileError{depfile, lineno, fmt.Sprintf("Unknown table %s (only [[dependency]] is supported)", line)}
+			}
+			current = &tomlEntry{lineno, make(map[string]interface{}), make(map[string]int)}
+			entries = append(entries, current)
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, depfileError{depfile, lineno, fmt.Sprintf("Expected key = value, got '%s'", line)}
+		}
+		key := strings.TrimSpace(line[:eq])
+		raw := strings.TrimSpace(line[eq+1:])
+		if current == nil {
+			return nil, depfileError{depfile, lineno, fmt.Sprintf("Key %s outside of a [[dependency]] table", key)}
+		}
+		if _, ok := current.values[key]; ok {
+			return nil, depfileError{depfile, lineno, fmt.Sprintf("Key %s given twice (first on line %d)", key, current.lines[key])}
+		}
+
+		// Arrays may span lines
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && idx+1 < len(lines) {
+			idx++
+			raw = raw + " " + strings.TrimSpace(stripTomlComment(lines[idx]))
+		}
+
+		value, err := parseTomlValue(raw)
+		if err != nil {
+			return nil, depfileError{depfile, lineno, fmt.Sprintf("Key %s: %s", key, err)}
+		}
+		current.values[key] = value
+		current.lines[key] = lineno
+	}
+
+	libs := make([]*RequiredLib, 0, len(entries))
+	for _, entry := range entries {
+		lib, applies, err := entry.requiredLib()
+		if err != nil {
+			return nil, depfileError{depfile, err.line, err.msg}
+		}
+		if !applies {
+			log.Debugf("Skipping %s on %s/%s", lib.Name, depmanPlatform, depmanArch)
+			continue
+		}
+		libs = append(libs, lib)
+	}
+
+	return libs, nil
+}
+
+// stripTomlComment removes a # comment which is not inside a string
+func stripTomlComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+// parseTomlValue understands strings, booleans and arrays of strings
+func parseTomlValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("Unterminated array")
+		}
+		items := make([]string, 0)
+		rest := strings.TrimSpace(raw[1 : len(raw)-1])
+		for rest != "" {
+			s, n, err := parseTomlString(rest)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+			rest = strings.TrimSpace(rest[n:])
+			if rest == "" {
+				break
+			}
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("Expected , between array items")
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+		return items, nil
+	}
+
+	s, n, err := parseTomlString(raw)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(raw) {
+		return nil, fmt.Errorf("Unexpected '%s' after string", raw[n:])
+	}
+	return s, nil
+}
+
+// parseTomlString parses the string at the start of raw and returns it
+// and the number of bytes it took up
+func parseTomlString(raw string) (string, int, error) {
+	if raw == "" || (raw[0] != '"' && raw[0] != '\'') {
+		return "", 0, fmt.Errorf("Expected a string, true, false or an array, got '%s'", raw)
+	}
+
+	if raw[0] == '\'' {
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", 0, fmt.Errorf("Unterminated string")
+		}
+		return raw[1 : end+1], end + 2, nil
+	}
+
+	var b bytes.Buffer
+	for i := 1; i < len(raw); i++ {
+		switch c := raw[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(raw) {
+				return "", 0, fmt.Errorf("Unterminated string")
+			}
+			switch raw[i] {
+			case '"', '\\':
+				b.WriteByte(raw[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", 0, fmt.Errorf("Unknown escape \\%c", raw[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("Unterminated string")
+}
+
+type entryError struct {
+	line int
+	msg  string
+}
+
+// requiredLib turns the entry into a RequiredLib and reports whether it
+// applies to the platform and architecture of this run
+func (e *tomlEntry) requiredLib() (*RequiredLib, bool, *entryError) {
+	lib := &RequiredLib{Version: "latest", Wanted: "header,archive,shared"}
+
+	fail := func(key string, format string, args ...interface{}) (*RequiredLib, bool, *entryError) {
+		return nil, false, &entryError{e.lines[key], fmt.Sprintf(format, args...)}
+	}
+
+	// In file order, so the first mistake is reported
+	keys := make([]string, 0, len(e.values))
+	for key := range e.values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return e.lines[keys[i]] < e.lines[keys[j]] })
+
+	for _, key := range keys {
+		value := e.values[key]
+		switch key {
+		case "name", "version", "include", "ns", "platform", "arch":
+			s, ok := value.(string)
+			if !ok {
+				return fail(key, "Key %s must be a string", key)
+			}
+			switch key {
+			case "name":
+				if !libNameRe.MatchString(s) {
+					return fail(key, "Invalid library name '%s'", s)
+				}
+				lib.Name = s
+			case "version":
+				lib.Version = s
+			case "include":
+				lib.IncDir = includeSubdir(s)
+			case "ns":
+				lib.NameSpace = s
+			case "platform":
+				lib.Platform = s
+			case "arch":
+				lib.Arch = s
+			}
+		case "optional":
+			b, ok := value.(bool)
+			if !ok {
+				return fail(key, "Key %s must be true or false", key)
+			}
+			lib.Optional = b
+		case "wanted", "if_platform", "if_arch":
+			var list []string
+			switch v := value.(type) {
+			case string:
+				list = strings.Split(v, ",")
+			case []string:
+				list = v
+			default:
+				return fail(key, "Key %s must be a string or an array of strings", key)
+			}
+			if key == "wanted" {
+				wanted, err := parseWanted(strings.Join(list, ","))
+				if err != nil {
+					return fail(key, "%s", err)
+				}
+				lib.Wanted = wanted
+			}
+		default:
+			return fail(key, "Unknown key %s", key)
+		}
+	}
+
+	if lib.Name == "" {
+		return nil, false, &entryError{e.line, "Dependency without name"}
+	}
+
+	applies := matchesAny(e.values["if_platform"], depmanPlatform) && matchesAny(e.values["if_arch"], depmanArch)
+	return lib, applies, nil
+}
+
+// matchesAny checks want against a condition; no condition matches
+// everything
+func matchesAny(cond interface{}, want string) bool {
+	var list []string
+	switch v := cond.(type) {
+	case nil:
+		return true
+	case string:
+		list = strings.Split(v, ",")
+	case []string:
+		list = v
+	}
+	for _, item := range list {
+		if strings.TrimSpace(item) == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// describeLibs shows the fields a depfile sets
+func describeLibs(libs []*RequiredLib) []string {
+	desc := []string{}
+	for _, l := range libs {
+		desc = append(desc, fmt.Sprintf("%s:%s inc=%s wanted=%s ns=%s target=%s/%s optional=%t",
+			l.Name, l.Version, l.IncDir, l.Wanted, l.NameSpace, l.Platform, l.Arch, l.Optional))
+	}
+	return desc
+}
+
+func parseTestDepfile(t *testing.T, name string, contents string) (*RequiredLibs, error) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deps, err := ParseDepfile(path)
+	if err != nil {
+		// Keep the messages independent of the temporary directory
+		return deps, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), dir+"/"))
+	}
+	return deps, nil
+}
+
+func TestParseLegacyDepfile(t *testing.T) {
+	depmanPlatform, depmanArch = "el7", "x86_64"
+
+	deps, err := parseTestDepfile(t, "depman_deps.txt", `
+# comment
+zlib
+curl:^7.1 | curl
+openssl:1.0.2k|ssl/|header, shared   # trailing comment
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"zlib:latest inc= wanted=header,archive,shared ns= target=/ optional=false",
+		"curl:^7.1 inc=/curl wanted=header,archive,shared ns= target=/ optional=false",
+		"openssl:1.0.2k inc=/ssl wanted=header,shared ns= target=/ optional=false",
+	}
+	if got := describeLibs(deps.Libs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parsed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	errors := []struct {
+		contents string
+		want     string
+	}{
+		{"zlib\n-bad\n", "depman_deps.txt:2: Invalid library name '-bad'"},
+		{"zlib | inc | header | extra\n", "depman_deps.txt:1: Expected at most 3 fields (name:version | include dir | types), got 4"},
+		{"\n\nzlib | inc | header,docs\n", "depman_deps.txt:3: Unknown file type 'docs' (want header, archive, shared or object)"},
+		{"zlib | inc | ,\n", "depman_deps.txt:1: No file types given"},
+	}
+	for _, test := range errors {
+		_, err := parseTestDepfile(t, "depman_deps.txt", test.contents)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("Parsing %q: got error %v, want %s", test.contents, err, test.want)
+		}
+	}
+}
+
+func TestParseTomlDepfile(t *testing.T) {
+	depmanPlatform, depmanArch = "el7", "x86_64"
+
+	deps, err := parseTestDepfile(t, "depman.toml", `
+# Libraries for the build
+[[dependency]]
+name = "zlib"
+
+[[dependency]]
+name = "curl"            # the # in a comment is fine
+version = ">=7.1,<8"
+include = 'curl'
+wanted = [
+  "header",  # headers
+  "shared",
+]
+ns = "team"
+platform = "el6"
+arch = "i686"
+optional = true
+
+[[dependency]]
+name = "winlib"
+if_platform = ["win64"]
+
+[[dependency]]
+name = "odd"
+include = "a \"quoted\" #dir"
+wanted = "header,object"
+if_platform = "el6,el7"
+if_arch = ["x86_64"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"zlib:latest inc= wanted=header,archive,shared ns= target=/ optional=false",
+		"curl:>=7.1,<8 inc=/curl wanted=header,shared ns=team target=el6/i686 optional=true",
+		`odd:latest inc=/a "quoted" #dir wanted=header,object ns= target=/ optional=false`,
+	}
+	if got := describeLibs(deps.Libs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parsed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	errors := []struct {
+		contents string
+		want     string
+	}{
+		{"[dependencies]\n", "depman.toml:1: Unknown table [dependencies] (only [[dependency]] is supported)"},
+		{"name = \"zlib\"\n", "depman.toml:1: Key name outside of a [[dependency]] table"},
+		{"[[dependency]]\nname \"zlib\"\n", "depman.toml:2: Expected key = value, got 'name \"zlib\"'"},
+		{"[[dependency]]\nname = \"zlib\"\n\nname = \"curl\"\n", "depman.toml:4: Key name given twice (first on line 2)"},
+		{"[[dependency]]\nname = \"zlib\n", "depman.toml:2: Key name: Unterminated string"},
+		{"[[dependency]]\nname = zlib\n", "depman.toml:2: Key name: Expected a string, true, false or an array, got 'zlib'"},
+		{"[[dependency]]\nname = \"zlib\" x\n", "depman.toml:2: Key name: Unexpected ' x' after string"},
+		{"[[dependency]]\nname = \"a\\qb\"\n", "depman.toml:2: Key name: Unknown escape \\q"},
+		{"[[dependency]]\nwanted = [\"header\" \"shared\"]\n", "depman.toml:2: Key wanted: Expected , between array items"},
+		{"[[dependency]]\nwanted = [\"header\",\n", "depman.toml:2: Key wanted: Unterminated array"},
+		{"[[dependency]]\nname = \"zlib\"\nversion = true\n", "depman.toml:3: Key version must be a string"},
+		{"[[dependency]]\nname = \"zlib\"\noptional = \"yes\"\n", "depman.toml:3: Key optional must be true or false"},
+		{"[[dependency]]\nname = \"zlib\"\nwanted = [\"docs\"]\n", "depman.toml:3: Unknown file type 'docs' (want header, archive, shared or object)"},
+		{"[[dependency]]\nname = \"zlib\"\ncolour = \"blue\"\n", "depman.toml:3: Unknown key colour"},
+		{"[[dependency]]\nname = \"zlib\"\n[[dependency]]\nversion = \"1.0\"\n", "depman.toml:3: Dependency without name"},
+		{"[[dependency]]\nname = \"-zlib\"\n", "depman.toml:2: Invalid library name '-zlib'"},
+	}
+	for _, test := range errors {
+		_, err := parseTestDepfile(t, "depman.toml", test.contents)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("Parsing %q: got error %v, want %s", test.contents, err, test.want)
+		}
+	}
+}
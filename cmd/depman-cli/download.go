@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/depman"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fileJob is one file of a resolved library to download into dir
+type fileJob struct {
+	lib  depman.ResolvedLib
+	file depman.File
+	dir  string
+	mode os.FileMode
+}
+
+func (j fileJob) localfile() string {
+	return fmt.Sprintf("%s/%s", j.dir, j.file.Name)
+}
+
+// newHeaderFilesMu guards new_header_files while downloads run
+var newHeaderFilesMu sync.Mutex
+
+func (j fileJob) run() error {
+	log.Infof("  Downloading file: %s %s", j.file.Type, j.file.Name)
+
+	localfile, err := downloadLibFile(j.file, j.dir, j.mode)
+	if err != nil {
+		return err
+	}
+	j.installed(localfile)
+
+	for _, link := range j.file.Links {
+		if err = j.symlink(link.Name, j.file.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installed remembers a new header file
+func (j fileJob) installed(localfile string) {
+	if j.file.Type == "header" {
+		newHeaderFilesMu.Lock()
+		new_header_files[localfile] = 1
+		newHeaderFilesMu.Unlock()
+	}
+}
+
+func (j fileJob) symlink(name string, target string) error {
+	symlink := j.dir + "/" + name
+	log.Infof("    Symlink: %s => %s", symlink, target)
+
+	os.Remove(symlink)
+	return os.Symlink(target, symlink)
+}
+
+// runParallel calls fn for 0..n-1 with up to parallel at a time and
+// returns the errors by index
+func runParallel(n int, parallel int, fn func(idx int) error) []error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	errs := make([]error, n)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				errs[idx] = fn(idx)
+			}
+		}()
+	}
+	for idx := 0; idx < n; idx++ {
+		queue <- idx
+	}
+	close(queue)
+	wg.Wait()
+
+	return errs
+}
+
+// runFileJobs downloads with up to parallel workers, file by file or
+// as a bundle per library with -bundle. All jobs run even if some fail;
+// the error lists every failure in job order.
+func runFileJobs(jobs []fileJob, parallel int, locked bool) error {
+	// Two depfile entries may want the same file in the same place
+	unique := make([]fileJob, 0, len(jobs))
+	seen := make(map[string]bool)
+	for _, j := range jobs {
+		if !seen[j.localfile()] {
+			seen[j.localfile()] = true
+			unique = append(unique, j)
+		}
+	}
+
+	prefix := ""
+	if locked {
+		prefix = "locked "
+	}
+	failed := make([]string, 0)
+
+	if bundleDownloads && !offlineMode {
+		bundles := newLibBundles(unique)
+		log.Debugf("Downloading %d libraries as bundles, %d at a time", len(bundles), parallel)
+
+		errs := runParallel(len(bundles), parallel, func(idx int) error { return bundles[idx].run() })
+		for idx, err := range errs {
+			if err != nil {
+				lib := bundles[idx].lib
+				failed = append(failed, fmt.Sprintf("%s%s/%s:%s bundle: %s", prefix, lib.NameSpace, lib.Library, lib.Version, err))
+			}
+		}
+	} else {
+		log.Debugf("Downloading %d files, %d at a time", len(unique), parallel)
+
+		errs := runParallel(len(unique), parallel, func(idx int) error { return unique[idx].run() })
+		for idx, err := range errs {
+			if err != nil {
+				j := unique[idx]
+				failed = append(failed, fmt.Sprintf("%s%s/%s:%s %s %s: %s",
+					prefix, j.lib.NameSpace, j.lib.Library, j.lib.Version, j.file.Type, j.file.Name, err))
+			}
+		}
+	}
+
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("Cannot download %s", failed[0])
+	}
+	return fmt.Errorf("%d downloads failed:\n  %s", len(failed), strings.Join(failed, "\n  "))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"github.com/moensch/depman"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	tests := []struct{ parallel, bound int }{{-1, 1}, {0, 1}, {1, 1}, {3, 3}, {20, 10}}
+	for _, test := range tests {
+		var mu sync.Mutex
+		running, most := 0, 0
+		ran := make([]int, 10)
+		errs := runParallel(len(ran), test.parallel, func(idx int) error {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			ran[idx]++
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if idx%2 == 1 {
+				return errors.New("odd")
+			}
+			return nil
+		})
+
+		if most > test.bound || (test.bound > 1 && most < 2) {
+			t.Errorf("parallel %d: %d ran at once, want up to %d", test.parallel, most, test.bound)
+		}
+		for idx := range ran {
+			if ran[idx] != 1 {
+				t.Errorf("parallel %d: job %d ran %d times", test.parallel, idx, ran[idx])
+			}
+			if (errs[idx] != nil) != (idx%2 == 1) {
+				t.Errorf("parallel %d: job %d returned %v", test.parallel, idx, errs[idx])
+			}
+		}
+	}
+}
+
+func TestRunFileJobs(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	defer useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(path.Dir(r.URL.Path))
+		mu.Lock()
+		requests[name]++
+		mu.Unlock()
+		if strings.HasPrefix(name, "missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(name))
+	}))()
+	cache, bundleDownloads, offlineMode = nil, false, false
+	new_header_files = make(map[string]int)
+
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lib := depman.ResolvedLib{Library: "foo", Version: "1.0", NameSpace: "default"}
+	job := func(name string) fileJob {
+		f := depman.File{NameSpace: "default", Library: "foo", Version: "1.0", Platform: "el7", Arch: "x86_64",
+			Type: "header", Name: name}
+		return fileJob{lib: lib, file: f, dir: dir, mode: 0644}
+	}
+
+	// The same file wanted twice is fetched once
+	if err = runFileJobs([]fileJob{job("a.h"), job("b.h"), job("a.h")}, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	if requests["a.h"] != 1 || requests["b.h"] != 1 {
+		t.Errorf("Requested %v, want a.h and b.h once", requests)
+	}
+	for _, name := range []string{"a.h", "b.h"} {
+		if got, _ := ioutil.ReadFile(path.Join(dir, name)); string(got) != name {
+			t.Errorf("Downloaded %q to %s", got, name)
+		}
+	}
+
+	tests := []struct {
+		jobs   []fileJob
+		locked bool
+		want   []string
+	}{
+		{[]fileJob{job("a.h"), job("missing1.h")}, false,
+			[]string{"Cannot download default/foo:1.0 header missing1.h: "}},
+		{[]fileJob{job("missing1.h"), job("a.h"), job("missing2.h")}, true,
+			[]string{"2 downloads failed:\n", "  locked default/foo:1.0 header missing1.h: ", "  locked default/foo:1.0 header missing2.h: "}},
+	}
+	for _, test := range tests {
+		err := runFileJobs(test.jobs, 2, test.locked)
+		if err == nil {
+			t.Errorf("%d jobs with failures succeeded", len(test.jobs))
+			continue
+		}
+		// In job order, whichever failed first
+		lines := strings.SplitAfter(err.Error(), "\n")
+		if len(lines) != len(test.want) {
+			t.Errorf("Got %q, want %d lines", err, len(test.want))
+			continue
+		}
+		for idx, line := range lines {
+			if !strings.HasPrefix(line, test.want[idx]) {
+				t.Errorf("Got %q, want line %d to start with %q", err, idx+1, test.want[idx])
+			}
+		}
+	}
+}
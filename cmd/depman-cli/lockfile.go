@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/depman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Lockfile records exactly what a `get` installed: per target the
+// resolved version of every library, the name space it was served from
+// and its files with their checksums. With -locked it is installed again
+// as is.
+type Lockfile struct {
+	Targets []LockedTarget `json:"targets"`
+}
+
+// LockedTarget is the resolution of the requirements of one target
+type LockedTarget struct {
+	Target
+	Requirements []depman.Requirement `json:"requirements"`
+	Libraries    depman.Resolution    `json:"libraries"`
+}
+
+// canonicalRequirements sorts and de-duplicates reqs so lockfiles can be
+// compared against the depfile
+func canonicalRequirements(reqs []depman.Requirement) []depman.Requirement {
+	seen := make(map[depman.Requirement]bool)
+	out := make([]depman.Requirement, 0, len(reqs))
+	for _, req := range reqs {
+		if !seen[req] {
+			seen[req] = true
+			out = append(out, req)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Library != b.Library {
+			return a.Library < b.Library
+		}
+		if a.Constraint != b.Constraint {
+			return a.Constraint < b.Constraint
+		}
+		return a.Wanted < b.Wanted
+	})
+	return out
+}
+
+func newLockfile(deps *RequiredLibs) *Lockfile {
+	lock := &Lockfile{Targets: make([]LockedTarget, 0)}
+	for _, t := range deps.Targets() {
+		lock.Targets = append(lock.Targets, LockedTarget{
+			Target:       t,
+			Requirements: canonicalRequirements(deps.Requirements(t)),
+			Libraries:    deps.Resolutions[t],
+		})
+	}
+	return lock
+}
+
+func readLockfile(path string) (*Lockfile, error) {
+	lock := &Lockfile{}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lock, fmt.Errorf("Cannot read lockfile %s: %s", path, err)
+	}
+	if err = json.Unmarshal(blob, lock); err != nil {
+		return lock, fmt.Errorf("Cannot parse lockfile %s: %s", path, err)
+	}
+
+	return lock, nil
+}
+
+// writeLockfile replaces path via a temporary file so an interrupted
+// write does not leave a truncated lockfile behind
+func writeLockfile(path string, lock *Lockfile) error {
+	blob, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpfile := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err = ioutil.WriteFile(tmpfile, append(blob, '\n'), 0644); err != nil {
+		return fmt.Errorf("Cannot write lockfile %s: %s", path, err)
+	}
+	if err = os.Rename(tmpfile, path); err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("Cannot write lockfile %s: %s", path, err)
+	}
+
+	log.Infof("Wrote lockfile %s (%d targets)", path, len(lock.Targets))
+	return nil
+}
+
+// target returns the locked resolution of t
+func (l *Lockfile) target(t Target) (*LockedTarget, error) {
+	for idx := range l.Targets {
+		if l.Targets[idx].Target == t {
+			return &l.Targets[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("Lockfile has nothing for %s - run get without -locked to update it", t)
+}
+
+// check makes sure the target was locked for the same requirements the
+// depfile has now
+func (l *LockedTarget) check(reqs []depman.Requirement) error {
+	want := canonicalRequirements(reqs)
+	have := canonicalRequirements(l.Requirements)
+	if len(want) != len(have) {
+		return fmt.Errorf("Depfile and lockfile differ for %s (%d vs %d requirements) - run get without -locked to update it",
+			l.Target, len(want), len(have))
+	}
+	for idx := range want {
+		if want[idx] != have[idx] {
+			return fmt.Errorf("Depfile requires %s, lockfile has %s - run get without -locked to update it",
+				requirementString(want[idx]), requirementString(have[idx]))
+		}
+	}
+
+	return nil
+}
+
+func requirementString(req depman.Requirement) string {
+	return strings.Join([]string{req.Library + ":" + req.Constraint, req.Wanted}, " | ")
+}
+
+// resolveOffline resolves libs from the locked libraries alone: each has
+// to be locked at a version matching its constraint and brings along
+// the locked libraries it depends on. Missing optional libraries are
+// skipped.
+func (l *LockedTarget) resolveOffline(libs []*RequiredLib) (depman.Resolution, error) {
+	byName := make(map[string]int)
+	for idx, locked := range l.Libraries {
+		byName[locked.Library] = idx
+	}
+
+	include := make(map[int]bool)
+	queue := make([]int, 0)
+	for _, lib := range libs {
+		idx, ok := byName[lib.Name]
+		if !ok {
+			if lib.Optional {
+				log.Warnf("Skipping optional %s:%s: not in the lockfile", lib.Name, lib.Version)
+				lib.Skipped = true
+				continue
+			}
+			return nil, fmt.Errorf("Offline: %s:%s is not in the lockfile for %s", lib.Name, lib.Version, l.Target)
+		}
+
+		cons, err := depman.ParseConstraint(lib.Version)
+		if err != nil {
+			return nil, err
+		}
+		if locked := l.Libraries[idx]; !cons.Match(locked.Version) {
+			return nil, fmt.Errorf("Offline: %s:%s wanted, but the lockfile has %s for %s",
+				lib.Name, lib.Version, locked.Version, l.Target)
+		}
+
+		if !include[idx] {
+			include[idx] = true
+			queue = append(queue, idx)
+		}
+	}
+
+	// Add whatever the included libraries were locked as depending on
+	for len(queue) > 0 {
+		from := fmt.Sprintf("%s:%s", l.Libraries[queue[0]].Library, l.Libraries[queue[0]].Version)
+		queue = queue[1:]
+		for idx, locked := range l.Libraries {
+			if include[idx] {
+				continue
+			}
+			for _, by := range locked.RequiredBy {
+				if by == from {
+					include[idx] = true
+					queue = append(queue, idx)
+					break
+				}
+			}
+		}
+	}
+
+	resolution := depman.Resolution{}
+	for idx, locked := range l.Libraries {
+		if include[idx] {
+			resolution = append(resolution, locked)
+		}
+	}
+	return resolution, nil
+}
+
+// findLibFromFile finds the locked library providing a header file
+func (l *Lockfile) findLibFromFile(t Target, filename string) (string, string, error) {
+	locked, err := l.target(t)
+	if err != nil {
+		return "", "", err
+	}
+
+	found := make([]depman.ResolvedLib, 0)
+	for _, lib := range locked.Libraries {
+		for _, f := range lib.Files {
+			if f.Type == "header" && f.Name == filename {
+				found = append(found, lib)
+				break
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", "", fmt.Errorf("Offline: no locked library provides %s", filename)
+	case 1:
+		return found[0].Library, found[0].Version, nil
+	}
+	return "", "", fmt.Errorf("Found more than one locked library providing %s (have %d)", filename, len(found))
+}
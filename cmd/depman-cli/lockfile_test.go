@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/moensch/depman"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockedInstall(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	srv.upload("zlib", "1.0", "header", "zlib.h", "zlib 1.0")
+	srv.upload("zlib", "1.1", "header", "zlib.h", "zlib 1.1")
+	srv.upload("curl", "7.1", "header", "curl.h", "curl 7.1")
+	if err := srv.SetDependencies("default", "curl", "7.1", depman.Dependencies{{Requires: "zlib", Constraint: "^1.0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	install := func(depfile string, lock *Lockfile) (*RequiredLibs, error) {
+		deps, err := parseTestDepfile(t, "depman_deps.txt", depfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deps.Locked = lock
+		os.RemoveAll(includeDir)
+		_, err = deps.Download()
+		return deps, err
+	}
+
+	deps, err := install("curl:^7\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.installed("zlib.h"); got != "zlib 1.1" {
+		t.Fatalf("Installed %q, want zlib 1.1", got)
+	}
+
+	path := filepath.Join(srv.dir, "depman.lock")
+	if err = writeLockfile(path, newLockfile(deps)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(srv.dir, ".depman.lock.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Temporary lockfile left behind")
+	}
+	lock, err := readLockfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Targets) != 1 || lock.Targets[0].Target != (Target{"default", "el7", "x86_64"}) {
+		t.Fatalf("Locked targets %v, want default el7/x86_64", lock.Targets)
+	}
+	locked := []string{}
+	for _, lib := range lock.Targets[0].Libraries {
+		for _, f := range lib.Files {
+			if f.Checksum == "" {
+				t.Errorf("Locked %s of %s without checksum", f.Name, lib.Library)
+			}
+		}
+		locked = append(locked, lib.Library+":"+lib.Version)
+	}
+	if strings.Join(locked, " ") != "curl:7.1 zlib:1.1" {
+		t.Errorf("Locked %v, want curl:7.1 zlib:1.1", locked)
+	}
+
+	// The lockfile wins over newer versions on the server
+	srv.upload("zlib", "1.2", "header", "zlib.h", "zlib 1.2")
+	if _, err = install("curl:^7\n", lock); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.installed("zlib.h"); got != "zlib 1.1" {
+		t.Errorf("Installed %q with the lockfile, want zlib 1.1", got)
+	}
+	if _, err = install("curl:^7\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.installed("zlib.h"); got != "zlib 1.2" {
+		t.Errorf("Installed %q without the lockfile, want zlib 1.2", got)
+	}
+
+	// It is only installed for what it was written for
+	if _, err = install("curl:^7\nzlib:^1.0\n", lock); err == nil || !strings.Contains(err.Error(), "lockfile") {
+		t.Errorf("Installing a changed depfile: %v, want an error", err)
+	}
+	depmanPlatform = "el6"
+	if _, err = install("curl:^7\n", lock); err == nil || !strings.Contains(err.Error(), "nothing for") {
+		t.Errorf("Installing for another platform: %v, want an error", err)
+	}
+	depmanPlatform = "el7"
+
+	// Nor does it take contents other than the locked ones
+	srv.upload("zlib", "1.1", "header", "zlib.h", "zlib 1.1 rebuilt")
+	if _, err = install("curl:^7\n", lock); err == nil {
+		t.Errorf("Installed changed contents of a locked file")
+	}
+}
+
+func testLockedTarget() *LockedTarget {
+	return &LockedTarget{
+		Target: Target{"default", "el7", "x86_64"},
+		Libraries: depman.Resolution{
+			{Library: "app", Version: "1.0"},
+			{Library: "curl", Version: "7.1", RequiredBy: []string{"app:1.0"}},
+			{Library: "zlib", Version: "1.1", RequiredBy: []string{"curl:7.1"},
+				Files: depman.Files{{Type: "header", Name: "zlib.h"}, {Type: "archive", Name: "libz.a"}}},
+			{Library: "ssl", Version: "1.0.2k", Files: depman.Files{{Type: "header", Name: "ssl.h"}}},
+			{Library: "crypto", Version: "1.0.2k", Files: depman.Files{{Type: "header", Name: "ssl.h"}}},
+		},
+	}
+}
+
+func TestResolveOffline(t *testing.T) {
+	tests := []struct {
+		libs    []*RequiredLib
+		want    string
+		skipped string
+		ok      bool
+	}{
+		// Libraries come with what they were locked as depending on,
+		// in the locked order
+		{[]*RequiredLib{{Name: "app", Version: "latest"}}, "app:1.0 curl:7.1 zlib:1.1", "", true},
+		{[]*RequiredLib{{Name: "curl", Version: "^7"}}, "curl:7.1 zlib:1.1", "", true},
+		{[]*RequiredLib{{Name: "ssl", Version: "~1.0.2"}, {Name: "zlib", Version: "1.1"}}, "zlib:1.1 ssl:1.0.2k", "", true},
+		{[]*RequiredLib{{Name: "zlib", Version: "1.1"}, {Name: "curl", Version: "^7"}}, "curl:7.1 zlib:1.1", "", true},
+		{[]*RequiredLib{{Name: "zlib", Version: "^1"}, {Name: "pcre", Version: "latest", Optional: true}}, "zlib:1.1", "pcre", true},
+		{[]*RequiredLib{{Name: "pcre", Version: "latest"}}, "", "", false},
+		{[]*RequiredLib{{Name: "zlib", Version: "^2"}}, "", "", false},
+		{[]*RequiredLib{{Name: "zlib", Version: "^1"}, {Name: "curl", Version: "7.0"}}, "", "", false},
+		{[]*RequiredLib{{Name: "zlib", Version: "not a constraint"}}, "", "", false},
+	}
+	for _, test := range tests {
+		desc := []string{}
+		for _, lib := range test.libs {
+			desc = append(desc, lib.Name+":"+lib.Version)
+		}
+
+		resolution, err := testLockedTarget().resolveOffline(test.libs)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: error %v, want ok %t", desc, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		got := []string{}
+		for _, lib := range resolution {
+			got = append(got, lib.Library+":"+lib.Version)
+		}
+		skipped := []string{}
+		for _, lib := range test.libs {
+			if lib.Skipped {
+				skipped = append(skipped, lib.Name)
+			}
+		}
+		if strings.Join(got, " ") != test.want || strings.Join(skipped, " ") != test.skipped {
+			t.Errorf("%v: resolved %v skipping %v, want %s skipping %q", desc, got, skipped, test.want, test.skipped)
+		}
+	}
+}
+
+func TestLockedFindLibFromFile(t *testing.T) {
+	lock := &Lockfile{Targets: []LockedTarget{*testLockedTarget()}}
+	el7 := Target{"default", "el7", "x86_64"}
+
+	library, version, err := lock.findLibFromFile(el7, "zlib.h")
+	if err != nil || library != "zlib" || version != "1.1" {
+		t.Errorf("zlib.h found in %s:%s (%v), want zlib:1.1", library, version, err)
+	}
+	for _, test := range []struct {
+		target Target
+		file   string
+	}{
+		{el7, "libz.a"},
+		{el7, "missing.h"},
+		// Provided by both ssl and crypto
+		{el7, "ssl.h"},
+		{Target{"default", "el6", "x86_64"}, "zlib.h"},
+	} {
+		if library, version, err = lock.findLibFromFile(test.target, test.file); err == nil {
+			t.Errorf("%s found in %s:%s for %s, want an error", test.file, library, version, test.target)
+		}
+	}
+}
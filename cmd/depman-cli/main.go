@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,11 +14,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
@@ -27,6 +33,20 @@ var (
 	includeDir          string
 	libDir              string
 	depFile             string
+	forceUpload         bool
+	lockFile            string
+	parallelDownloads   int
+	bundleDownloads     bool
+	installLocked       bool
+	offlineMode         bool
+	offlineLock         *Lockfile
+	configFile          string
+	caCert              string
+	clientCert          string
+	clientKey           string
+	cacheDir            string
+	cacheSize           string
+	noCache             bool
 	httpClient          *http.Client
 	found_hash_includes map[string]string
 	new_header_files    map[string]int
@@ -41,22 +61,61 @@ func init() {
 	flag.StringVar(&libDir, "l", "depman-lib/", "Lib dir")
 	flag.StringVar(&logLevel, "d", "warn", "Log level (debug|info|warn|error|fatal)")
 	flag.StringVar(&depFile, "f", "depman_deps.txt", "Dependency file")
+	flag.IntVar(&parallelDownloads, "j", 4, "Number of parallel downloads")
+	flag.BoolVar(&bundleDownloads, "bundle", false, "Download each library as one archive instead of file by file")
+	flag.DurationVar(&httpTimeout, "timeout", 30*time.Second, "Give up on connections without progress after this long (0: never)")
+	flag.IntVar(&httpRetries, "retries", 3, "Retries for failed transfers, with exponential backoff")
+	flag.StringVar(&lockFile, "lock", "depman.lock", "Lockfile written by get (empty: none)")
+	flag.BoolVar(&installLocked, "locked", false, "Install exactly what the lockfile says")
+	flag.BoolVar(&offlineMode, "offline", false, "Install from the lockfile and download cache without contacting the server")
+	flag.BoolVar(&forceUpload, "force", false, "Overwrite published files, delete name spaces with contents (needs a token with admin permission)")
+	flag.StringVar(&configFile, "c", defaultConfigFile(), "Config file (JSON with url, token and TLS settings)")
+	flag.StringVar(&caCert, "ca-cert", "", "CA bundle to verify the server certificate against")
+	flag.StringVar(&clientCert, "client-cert", "", "Client certificate for mutual TLS")
+	flag.StringVar(&clientKey, "client-key", "", "Key of the client certificate")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Download cache (default: ~/.cache/depman)")
+	flag.StringVar(&cacheSize, "cache-size", "", "Cache size limit, e.g. 500M (default: 2G)")
+	flag.BoolVar(&noCache, "no-cache", false, "Do not use the download cache")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage for %s:\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\n\nOperation:\n")
 		fmt.Fprintf(os.Stderr, "  get:\n")
-		fmt.Fprintf(os.Stderr, "    Pull dependencies from depfile (-f)\n")
+		fmt.Fprintf(os.Stderr, "    Pull dependencies from depfile (-f), including what they depend on\n")
+		fmt.Fprintf(os.Stderr, "    Records the result in the lockfile (-lock); -locked installs from it\n")
+		fmt.Fprintf(os.Stderr, "    -offline installs from the lockfile and the cache only (get and scan)\n")
+		fmt.Fprintf(os.Stderr, "    -bundle fetches each library in one request\n")
 		fmt.Fprintf(os.Stderr, "  scan:\n")
 		fmt.Fprintf(os.Stderr, "    Recursively scan directory for #includes and pull them\n")
 		fmt.Fprintf(os.Stderr, "  search <headerfile>:\n")
 		fmt.Fprintf(os.Stderr, "    Find out which library provides a given header file\n")
 		fmt.Fprintf(os.Stderr, "  upload <libname> <libver> [list of files...]:\n")
 		fmt.Fprintf(os.Stderr, "    Store new binaries and headers (guesses file types from extensions)\n")
+		fmt.Fprintf(os.Stderr, "    Published files cannot be changed; identical files are skipped\n")
 		fmt.Fprintf(os.Stderr, "  uploadextra <name> <version> <filepath>:\n")
 		fmt.Fprintf(os.Stderr, "    Store an arbitrary file\n")
 		fmt.Fprintf(os.Stderr, "  getextra <name> [<version>]:\n")
 		fmt.Fprintf(os.Stderr, "    Download extra (non-lib-related) file\n")
+		fmt.Fprintf(os.Stderr, "  cache [info|list|prune [<size>]|clear]:\n")
+		fmt.Fprintf(os.Stderr, "    Show or shrink the download cache\n")
+		fmt.Fprintf(os.Stderr, "  ns [list|show [<ns>]|create <ns> [<parent>]|lock <ns>|unlock <ns>|delete <ns>]:\n")
+		fmt.Fprintf(os.Stderr, "    Manage name spaces (list needs admin on all of them; delete -force removes contents)\n")
+		fmt.Fprintf(os.Stderr, "  deps <libname> <libver>:\n")
+		fmt.Fprintf(os.Stderr, "    Show the dependencies declared for a library version\n")
+		fmt.Fprintf(os.Stderr, "  setdeps <libname> <libver> [name[:constraint[:types]]...]:\n")
+		fmt.Fprintf(os.Stderr, "    Replace the dependencies of a library version (none clears them)\n")
+		fmt.Fprintf(os.Stderr, "  promote <libname> <libver> <target ns>:\n")
+		fmt.Fprintf(os.Stderr, "    Copy a library version from the name space (-n) to another, only -p/-a if given\n")
+		fmt.Fprintf(os.Stderr, "  delete lib <libname>:\n")
+		fmt.Fprintf(os.Stderr, "    Delete all versions of a library in the name space\n")
+		fmt.Fprintf(os.Stderr, "  delete version <libname> <libver>:\n")
+		fmt.Fprintf(os.Stderr, "    Delete a library version (all platforms and architectures)\n")
+		fmt.Fprintf(os.Stderr, "  delete file <libname> <libver> <type> <filename>:\n")
+		fmt.Fprintf(os.Stderr, "    Delete a single file for the current platform and architecture\n")
+		fmt.Fprintf(os.Stderr, "  delete link <libname> <libver> <type> <filename> <linkname>:\n")
+		fmt.Fprintf(os.Stderr, "    Delete a symlink to a file\n")
+		fmt.Fprintf(os.Stderr, "  delete extra <name> <version>:\n")
+		fmt.Fprintf(os.Stderr, "    Delete an extra file version\n")
 		fmt.Fprintf(os.Stderr, "\n\nConfig:\n")
 		flag.PrintDefaults()
 	}
@@ -68,6 +127,30 @@ func main() {
 	lvl, _ := log.ParseLevel(logLevel)
 	log.SetLevel(lvl)
 	var err error
+
+	configExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			configExplicit = true
+		}
+	})
+	if err = loadCliConfig(configFile, configExplicit); err != nil {
+		log.Fatal(err)
+	}
+	if depmanUrl == "" {
+		depmanUrl = cliConfig.URL
+	}
+	for _, o := range []struct{ flag, dst *string }{
+		{&caCert, &cliConfig.CACert},
+		{&clientCert, &cliConfig.ClientCert},
+		{&clientKey, &cliConfig.ClientKey},
+		{&cacheDir, &cliConfig.CacheDir},
+		{&cacheSize, &cliConfig.CacheSize},
+	} {
+		if *o.flag != "" {
+			*o.dst = *o.flag
+		}
+	}
 	if depmanArch == "" {
 		if depmanArch, err = getArch(); err != nil {
 			log.Fatal(err)
@@ -101,6 +184,7 @@ func main() {
 	log.Infof("Include Dir : %s", includeDir)
 	log.Infof("Library Dir : %s", libDir)
 	log.Infof("Dependencies: %s", depFile)
+	log.Infof("Lockfile    : %s (locked: %t)", lockFile, installLocked)
 
 	if operation == "get" {
 		for _, dir := range []string{includeDir, libDir} {
@@ -113,7 +197,26 @@ func main() {
 		}
 	}
 
-	httpClient = &http.Client{}
+	httpClient, err = newHTTPClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !noCache && cliConfig.CacheDir != "" {
+		if cache, err = newFileCache(cliConfig.CacheDir, cliConfig.CacheSize, cliConfig.CacheLink); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if offlineMode {
+		if cache == nil {
+			log.Fatalf("ERROR: Offline mode needs the download cache")
+		}
+		cache.offline = true
+		if offlineLock, err = readLockfile(lockFile); err != nil {
+			log.Fatalf("ERROR: Offline mode needs a lockfile: %s", err)
+		}
+	}
 
 	new_header_files = make(map[string]int)
 	switch operation {
@@ -137,7 +240,7 @@ func main() {
 			ScanWantedTypes = flag.Arg(1)
 		}
 		log.Warnf("Want: %s", ScanWantedTypes)
-		deps := RequiredLibs{}
+		deps := RequiredLibs{Locked: offlineLock}
 
 		// Enter scan loop at current directory
 		new_header_files["."] = 1
@@ -153,9 +256,13 @@ func main() {
 
 			// Re-assign locally and clear because ParseSourceFiles
 			//  appends to new_header_files global again
-			files_to_scan := new_header_files
+			files_to_scan := make([]string, 0, len(new_header_files))
+			for scanfile := range new_header_files {
+				files_to_scan = append(files_to_scan, scanfile)
+			}
+			sort.Strings(files_to_scan)
 			new_header_files = make(map[string]int)
-			for scanfile, _ := range files_to_scan {
+			for _, scanfile := range files_to_scan {
 				log.Infof("Scanning recursively: %s", scanfile)
 				// populates new_header_files and adds to deps
 				err := ParseSourceFiles(scanfile, ScanWantedTypes, &deps)
@@ -173,6 +280,12 @@ func main() {
 				}
 			}
 		}
+		if !offlineMode && lockFile != "" {
+			if err = writeLockfile(lockFile, newLockfile(&deps)); err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
+		pruneCache()
 
 		makeFlags(libnames)
 	case "getextra":
@@ -184,7 +297,7 @@ func main() {
 
 		extrafiles := flag.Args()[1:]
 		for _, extrafile := range extrafiles {
-			split := strings.Split(extrafile, ":")
+			split := strings.SplitN(extrafile, ":", 2)
 			localfile := split[0]
 			version := "latest"
 			if len(split) == 2 {
@@ -193,9 +306,9 @@ func main() {
 
 			log.Infof("Downloading extrafile: %s (%s)", localfile, version)
 
-			uri_path := fmt.Sprintf("/v1/%s/extra/%s/%s/download", depmanNs, localfile, version)
+			uri_path := fmt.Sprintf("/v1/%s/extra/%s/%s/download", depmanNs, localfile, url.PathEscape(version))
 
-			err = doDownload(uri_path, localfile, 0664)
+			err = doDownload(uri_path, localfile, 0664, "")
 			if err != nil {
 				log.Fatalf("Cannot download extra file: %s", err)
 			}
@@ -206,10 +319,22 @@ func main() {
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
+		deps.Locked = offlineLock
+		if installLocked && !offlineMode {
+			if deps.Locked, err = readLockfile(lockFile); err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
 		libnames, err := deps.Download()
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
+		if !installLocked && !offlineMode && lockFile != "" {
+			if err = writeLockfile(lockFile, newLockfile(deps)); err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
+		pruneCache()
 
 		makeFlags(libnames)
 	case "uploadextra":
@@ -244,6 +369,100 @@ func main() {
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
+	case "cache":
+		if err := cacheCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	case "ns":
+		if err := nsCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	case "deps":
+		if flag.NArg() < 3 {
+			log.Warnf("Not enough parameters")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		body, err := GETRequest(dependenciesPath(flag.Arg(1), flag.Arg(2)), "text/plain")
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", strings.TrimSpace(string(body)))
+	case "setdeps":
+		if flag.NArg() < 3 {
+			log.Warnf("Not enough parameters")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		deps := depman.Dependencies{}
+		for _, arg := range flag.Args()[3:] {
+			parts := strings.SplitN(arg, ":", 3)
+			dep := depman.Dependency{Requires: parts[0]}
+			if len(parts) > 1 {
+				dep.Constraint = parts[1]
+			}
+			if len(parts) > 2 {
+				dep.Wanted = parts[2]
+			}
+			deps = append(deps, dep)
+		}
+
+		if _, err := SendRequestJSON("PUT", dependenciesPath(flag.Arg(1), flag.Arg(2)), deps); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		fmt.Fprintf(os.Stdout, "Dependencies of %s:%s set (%d)\n", flag.Arg(1), flag.Arg(2), len(deps))
+	case "promote":
+		if flag.NArg() < 4 {
+			log.Warnf("Not enough parameters")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		// Only an explicit -p or -a restricts what is promoted
+		req := depman.PromoteRequest{From: depmanNs}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "p":
+				req.Platform = depmanPlatform
+			case "a":
+				req.Arch = depmanArch
+			}
+		})
+		path := fmt.Sprintf("/v1/%s/lib/%s/versions/%s/promote", flag.Arg(3), flag.Arg(1), url.PathEscape(flag.Arg(2)))
+		if forceUpload {
+			path = path + "?force=true"
+		}
+
+		body, err := SendRequestJSON("POST", path, req)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		files := depman.Files{}
+		if err = json.Unmarshal(body, &files); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		fmt.Fprintf(os.Stdout, "Promoted %s:%s from %s to %s (%d files)\n",
+			flag.Arg(1), flag.Arg(2), req.ToString(), flag.Arg(3), len(files))
+	case "delete":
+		if flag.NArg() < 3 {
+			log.Warnf("Not enough parameters")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		path, err := deletePath(flag.Arg(1), flag.Args()[2:])
+		if err != nil {
+			log.Warn(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		if err = DELETERequest(path); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		fmt.Fprintf(os.Stdout, "Deleted: %s\n", strings.Join(flag.Args()[1:], " "))
 	default:
 		log.Warnf("Unknown operation: %s", operation)
 		flag.Usage()
@@ -251,6 +470,53 @@ func main() {
 	}
 }
 
+func dependenciesPath(libname string, libver string) string {
+	path := fmt.Sprintf("/v1/%s/lib/%s/versions/%s/dependencies", depmanNs, libname, url.PathEscape(libver))
+	if forceUpload {
+		path = path + "?force=true"
+	}
+	return path
+}
+
+// deletePath maps the arguments of the delete operation to the URL of
+// the object to delete
+func deletePath(what string, args []string) (string, error) {
+	want := map[string]int{
+		"lib":     1,
+		"version": 2,
+		"file":    4,
+		"link":    5,
+		"extra":   2,
+	}
+	n, ok := want[what]
+	if !ok {
+		return "", fmt.Errorf("Unknown object type to delete: %s", what)
+	}
+	if len(args) != n {
+		return "", fmt.Errorf("delete %s needs %d parameters, got %d", what, n, len(args))
+	}
+	escaped := make([]string, len(args))
+	for idx, arg := range args {
+		escaped[idx] = url.PathEscape(arg)
+	}
+	args = escaped
+
+	switch what {
+	case "lib":
+		return fmt.Sprintf("/v1/%s/lib/%s", depmanNs, args[0]), nil
+	case "version":
+		return fmt.Sprintf("/v1/%s/lib/%s/versions/%s", depmanNs, args[0], args[1]), nil
+	case "file":
+		return fmt.Sprintf("/v1/%s/lib/%s/versions/%s/files/%s/%s/%s/%s",
+			depmanNs, args[0], args[1], depmanPlatform, depmanArch, args[2], args[3]), nil
+	case "link":
+		return fmt.Sprintf("/v1/%s/lib/%s/versions/%s/files/%s/%s/%s/%s/links/%s",
+			depmanNs, args[0], args[1], depmanPlatform, depmanArch, args[2], args[3], args[4]), nil
+	default:
+		return fmt.Sprintf("/v1/%s/extra/%s/%s", depmanNs, args[0], args[1]), nil
+	}
+}
+
 func getArch() (string, error) {
 	for _, uname := range []string{"/usr/bin/uname", "/bin/uname"} {
 		_, err := os.Stat(uname)
@@ -343,8 +609,54 @@ func getFileType(path string) (string, error) {
 	}
 }
 
+// uploadFiles publishes files as one library version: they are staged in
+// a publish session and only become visible together when it is
+// committed. If anything fails, nothing is published.
 func uploadFiles(libname string, libver string, files []string) error {
-	url_tpl := fmt.Sprintf("/v1/%s/lib/%s/versions/%s/files/%s/%s/%%s/%%s/%%s", depmanNs, libname, libver, depmanPlatform, depmanArch)
+	body, err := SendRequestJSON("POST", fmt.Sprintf("/v1/%s/lib/%s/versions/%s/publish/%s/%s",
+		depmanNs, libname, url.PathEscape(libver), depmanPlatform, depmanArch), nil)
+	if err != nil {
+		return err
+	}
+	session := depman.PublishSession{}
+	if err = json.Unmarshal(body, &session); err != nil {
+		return err
+	}
+	log.Infof("Publish session: %s", session.Id)
+	session_path := fmt.Sprintf("/v1/%s/publish/%s", depmanNs, session.Id)
+
+	abort := func() {
+		log.Warnf("Aborting publish session %s", session.Id)
+		if err := DELETERequest(session_path); err != nil {
+			log.Warnf("Cannot abort publish session %s: %s", session.Id, err)
+		}
+	}
+
+	if err = stageFiles(session_path, files); err != nil {
+		abort()
+		return err
+	}
+
+	commit_path := session_path + "/commit"
+	if forceUpload {
+		commit_path += "?force=true"
+	}
+	if body, err = SendRequestJSON("POST", commit_path, nil); err != nil {
+		abort()
+		return err
+	}
+	published := depman.Files{}
+	if err = json.Unmarshal(body, &published); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Published %s:%s for %s/%s (%d files)\n", libname, libver, depmanPlatform, depmanArch, len(published))
+
+	return nil
+}
+
+// stageFiles uploads files and their symlinks into a publish session
+func stageFiles(session_path string, files []string) error {
+	url_tpl := session_path + "/files/%s/%s"
 	log.Debugf("URL: %s", url_tpl)
 
 	//links := make([]string, 0)
@@ -368,7 +680,7 @@ func uploadFiles(libname string, libver string, files []string) error {
 				log.Warn(err)
 				continue
 			}
-			err = uploadFile(f, fmt.Sprintf(url_tpl, filetype, filename, "upload"))
+			err = uploadFile(f, fmt.Sprintf(url_tpl, filetype, filename))
 			if err != nil {
 				return err
 			}
@@ -396,18 +708,19 @@ func uploadFiles(libname string, libver string, files []string) error {
 			log.Infof("Processing symlinks for: %s", f[0])
 			for _, linkname := range links[f[0]] {
 				log.Infof("  Linkname: %s", linkname)
-				path := fmt.Sprintf(url_tpl+"/%s", f[1], f[0], "links", linkname)
+				path := fmt.Sprintf(url_tpl+"/links/%s", f[1], f[0], linkname)
+				if forceUpload {
+					path += "?force=true"
+				}
 				log.Debugf("  Linkpath: %s", path)
 
-				req, err := http.NewRequest("PUT", strings.Join([]string{depmanUrl, path}, ""), nil)
-				if err != nil {
-					return err
-				}
-				resp, err := httpClient.Do(req)
-				defer resp.Body.Close()
+				resp, err := doRequest(func() (*http.Request, error) {
+					return newRequest("PUT", strings.Join([]string{depmanUrl, path}, ""), nil)
+				})
 				if err != nil {
 					return err
 				}
+				resp.Body.Close()
 				if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 					return errors.New(fmt.Sprintf("Http error: %d", resp.StatusCode))
 				}
@@ -431,16 +744,55 @@ func uploadFile(localfile string, path string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("PUT", req_url, fh)
-	req.Header.Set("Content-Type", "application/octet-stream")
+	defer fh.Close()
 
-	resp, err := httpClient.Do(req)
+	// The server skips identical contents and only needs the checksum
+	// to tell
+	hash := sha256.New()
+	if _, err = io.Copy(hash, fh); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	if forceUpload {
+		req_url += "?force=true"
+	}
+	// Rewound for every attempt; retrying is safe as the server skips
+	// contents it already has
+	resp, err := doRequest(func() (*http.Request, error) {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req, err := newRequest("PUT", req_url, ioutil.NopCloser(fh))
+		if err == nil {
+			req.ContentLength = stat.Size()
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set(depman.ChecksumHeader, checksum)
+		}
+		return req, err
+	})
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	errResp := struct {
+		Error string `json:"error"`
+	}{}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		json.NewDecoder(resp.Body).Decode(&errResp)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusConflict && errResp.Error == depman.ErrImmutable.Error():
+		return fmt.Errorf("%s is already published and cannot be changed (see -force)", localfile)
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("Cannot upload %s: %s", localfile, errResp.Error)
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("Not allowed to upload %s - check the token permissions", localfile)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("Uploading %s needs a token (DEPMAN_TOKEN or config file)", localfile)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
 		return errors.New(fmt.Sprintf("Http error: %d", resp.StatusCode))
 	}
 
@@ -454,34 +806,58 @@ type RequiredLib struct {
 	Wanted     string
 	Downloaded bool
 	HasLib     bool
+	// Override the name space, platform and architecture of the run
+	NameSpace string
+	Platform  string
+	Arch      string
+	// Optional libraries are skipped if they cannot be resolved
+	Optional bool
+	Skipped  bool
+	// Resolved is the version downloaded, Transitive is set for
+	// libraries only pulled in as a dependency of another
+	Resolved   string
+	Transitive bool
 }
 
 func (r *RequiredLib) String() string {
-	return fmt.Sprintf("name => %s, version => %s, dir => %s, wanted => %s",
-		r.Name, r.Version, r.IncDir, r.Wanted)
+	return fmt.Sprintf("name => %s, version => %s, dir => %s, wanted => %s, target => %s",
+		r.Name, r.Version, r.IncDir, r.Wanted, r.Target())
 }
 
-func (r *RequiredLib) Download() error {
-	log.Infof("Downloading: %s", r.String())
+// Target is where a library is resolved from
+type Target struct {
+	NameSpace string `json:"ns"`
+	Platform  string `json:"platform"`
+	Arch      string `json:"arch"`
+}
 
-	body, err := GETRequestJSON(fmt.Sprintf("/v1/%s/lib/%s/versions/%s/files/%s/%s", depmanNs, r.Name, r.Version, depmanPlatform, depmanArch))
+func (t Target) String() string {
+	return fmt.Sprintf("%s %s/%s", t.NameSpace, t.Platform, t.Arch)
+}
 
-	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+func (r *RequiredLib) Target() Target {
+	t := Target{r.NameSpace, r.Platform, r.Arch}
+	if t.NameSpace == "" {
+		t.NameSpace = depmanNs
 	}
-
-	files := depman.Files{}
-
-	if err = json.Unmarshal(body, &files); err != nil {
-		log.Fatalf("ERROR: %s", err)
+	if t.Platform == "" {
+		t.Platform = depmanPlatform
+	}
+	if t.Arch == "" {
+		t.Arch = depmanArch
 	}
+	return t
+}
+
+// plan works out which files of a resolved library are wanted and
+// where they go
+func (r *RequiredLib) plan(lib depman.ResolvedLib) []fileJob {
+	jobs := make([]fileJob, 0, len(lib.Files))
 
 	// headers: 0644
 	// SO: 0755
 	// Archives: 0644
-	for _, file := range files {
-		log.Infof("  Downloading file: %s %s", file.Type, file.Name)
-
+	for _, file := range lib.Files {
 		var mode os.FileMode
 		var dir string
 		switch {
@@ -508,41 +884,24 @@ func (r *RequiredLib) Download() error {
 			continue
 		}
 
-		localfile, err := downloadLibFile(r.Name, r.Version, file, dir, mode)
-
-		if err != nil {
-			return err
-		}
-
-		// We downloaded a new header file - remember it
-		if file.Type == "header" {
-			new_header_files[localfile] = 1
-		}
-
-		for _, link := range file.Links {
-			symlink := dir + "/" + link.Name
-			log.Infof("    Symlink: %s => %s", symlink, localfile)
-
-			os.Remove(symlink)
-			err = os.Symlink(file.Name, symlink)
-			if err != nil {
-				return err
-			}
-		}
+		jobs = append(jobs, fileJob{lib: lib, file: file, dir: dir, mode: mode})
 	}
 
-	r.Downloaded = true
-
-	return nil
+	return jobs
 }
 
 type RequiredLibs struct {
 	Libs []*RequiredLib
+	// Locked, if set, is installed instead of asking the server to
+	// resolve; Resolutions is what was installed per target
+	Locked      *Lockfile
+	Resolutions map[Target]depman.Resolution
 }
 
 func (r *RequiredLibs) Has(l *RequiredLib) bool {
 	for _, entry := range r.Libs {
-		if entry.Name == l.Name && entry.Version == l.Version && entry.IncDir == l.IncDir && entry.Wanted == l.Wanted {
+		if entry.Name == l.Name && entry.Version == l.Version && entry.IncDir == l.IncDir && entry.Wanted == l.Wanted &&
+			entry.Target() == l.Target() {
 			return true
 		}
 	}
@@ -555,90 +914,224 @@ func (r *RequiredLibs) Add(l *RequiredLib) {
 	}
 }
 
+// named returns all entries for a library in a target
+func (r *RequiredLibs) named(t Target, name string) []*RequiredLib {
+	entries := make([]*RequiredLib, 0)
+	for _, entry := range r.Libs {
+		if entry.Name == name && entry.Target() == t {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Targets returns the targets of the requested libraries, in the order
+// they first appear
+func (r *RequiredLibs) Targets() []Target {
+	targets := make([]Target, 0)
+	seen := make(map[Target]bool)
+	for _, lib := range r.Libs {
+		if t := lib.Target(); !lib.Transitive && !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Download has the server resolve the requested libraries of every
+// target together with their dependencies and fetches whatever has not
+// been downloaded yet. Libraries downloaded earlier are part of the
+// resolution too, so a later requirement cannot silently pull in a
+// different version of one.
 func (r *RequiredLibs) Download() ([]string, error) {
 	libnames := make([]string, 0)
-	for _, lib := range r.Libs {
-		if !lib.Downloaded {
-			err := lib.Download()
-			if err != nil {
-				return libnames, err
-			}
-			if lib.HasLib {
-				libnames = append(libnames, strings.TrimPrefix(lib.Name, "lib"))
-			}
-		} else {
-			log.Debugf(" Already downloaded: %s", lib.String())
+	if r.Resolutions == nil {
+		r.Resolutions = make(map[Target]depman.Resolution)
+	}
+
+	for _, t := range r.Targets() {
+		names, err := r.downloadTarget(t)
+		if err != nil {
+			return libnames, err
 		}
+		libnames = append(libnames, names...)
 	}
 
 	return libnames, nil
 }
 
-func parseDepLine(line string) (*RequiredLib, error) {
-	// split by pipe, surrounded by optional white space
-	white := regexp.MustCompile("\\s*\\|\\s*")
-	fields := white.Split(line, -1)
+func (r *RequiredLibs) downloadTarget(t Target) ([]string, error) {
+	libnames := make([]string, 0)
 
-	lib := &RequiredLib{}
-	lib.Wanted = "header,archive,shared"
+	pending := false
+	for _, lib := range r.Libs {
+		if lib.Target() == t && !lib.Transitive && !lib.Downloaded && !lib.Skipped {
+			pending = true
+		}
+	}
+	if !pending {
+		log.Debugf("Nothing new to download for %s", t)
+		return libnames, nil
+	}
 
-	for idx, field := range fields {
-		switch {
-		case idx == 0:
-			parts := strings.Split(field, ":")
-			lib.Name = parts[0]
-			if len(parts) > 1 {
-				lib.Version = parts[1]
-			} else {
-				lib.Version = "latest"
+	var resolution depman.Resolution
+	if r.Locked != nil {
+		locked, err := r.Locked.target(t)
+		if err != nil {
+			return libnames, err
+		}
+		if offlineMode {
+			resolution, err = locked.resolveOffline(r.libsIn(t))
+		} else if err = locked.check(r.Requirements(t)); err == nil {
+			resolution = locked.Libraries
+		}
+		if err != nil {
+			return libnames, err
+		}
+	} else {
+		var err error
+		if resolution, err = r.resolve(t); err != nil {
+			return libnames, err
+		}
+	}
+	r.Resolutions[t] = resolution
+
+	jobs := make([]fileJob, 0)
+	fetched := make([]*RequiredLib, 0)
+	versions := make([]string, 0)
+	for _, resolved := range resolution {
+		entries := r.named(t, resolved.Library)
+		if len(entries) == 0 {
+			dep := &RequiredLib{
+				Name:       resolved.Library,
+				Version:    resolved.Version,
+				Wanted:     resolved.Wanted,
+				NameSpace:  t.NameSpace,
+				Platform:   t.Platform,
+				Arch:       t.Arch,
+				Transitive: true,
 			}
-		case idx == 1:
-			lib.IncDir = strings.TrimSuffix(field, "/")
-			if !strings.HasPrefix(lib.IncDir, "/") {
-				lib.IncDir = "/" + lib.IncDir
+			log.Infof("Dependency of %s: %s", strings.Join(resolved.RequiredBy, ", "), dep.String())
+			r.Libs = append(r.Libs, dep)
+			entries = []*RequiredLib{dep}
+		}
+
+		for _, lib := range entries {
+			if lib.Downloaded {
+				if lib.Resolved != resolved.Version {
+					return libnames, fmt.Errorf("Version conflict: %s %s was downloaded, but now resolves to %s (required by %s)",
+						lib.Name, lib.Resolved, resolved.Version, strings.Join(resolved.RequiredBy, ", "))
+				}
+				log.Debugf(" Already downloaded: %s", lib.String())
+				continue
 			}
-		case idx == 2:
-			lib.Wanted = field
+			if lib.Transitive {
+				lib.Wanted = resolved.Wanted
+			}
+			log.Infof("Downloading: %s (%s/%s:%s)", lib.String(), resolved.NameSpace, resolved.Library, resolved.Version)
+			jobs = append(jobs, lib.plan(resolved)...)
+			fetched = append(fetched, lib)
+			versions = append(versions, resolved.Version)
 		}
 	}
 
-	log.Debugf("Dependency: %s", lib.String())
+	if err := runFileJobs(jobs, parallelDownloads, r.Locked != nil); err != nil {
+		return libnames, err
+	}
+
+	// In resolution order, however the downloads finished
+	for idx, lib := range fetched {
+		lib.Resolved = versions[idx]
+		lib.Downloaded = true
+		if lib.HasLib {
+			libnames = append(libnames, strings.TrimPrefix(lib.Name, "lib"))
+		}
+	}
 
-	return lib, nil
+	return libnames, nil
 }
 
-func ParseDepfile(depfile string) (*RequiredLibs, error) {
-	deps := &RequiredLibs{}
+// resolve resolves the requested libraries of a target. If that fails
+// and some of them are optional, the optional ones are added one at a
+// time and those which break the resolution are skipped.
+func (r *RequiredLibs) resolve(t Target) (depman.Resolution, error) {
+	required := make([]depman.Requirement, 0)
+	optional := make([]*RequiredLib, 0)
+	for _, lib := range r.Libs {
+		if lib.Target() != t || lib.Transitive || lib.Skipped {
+			continue
+		}
+		if lib.Optional && !lib.Downloaded {
+			optional = append(optional, lib)
+			continue
+		}
+		required = append(required, lib.requirement())
+	}
 
-	fh, err := os.Open(depfile)
-	if err != nil {
-		return deps, errors.New(fmt.Sprintf("Cannot open dependency file %s: %s", depfile, err))
+	all := append([]depman.Requirement{}, required...)
+	for _, lib := range optional {
+		all = append(all, lib.requirement())
+	}
+	resolution, err := resolveRequirements(t, all)
+	if err == nil || len(optional) == 0 {
+		return resolution, err
 	}
 
-	defer fh.Close()
+	for _, lib := range optional {
+		if _, err := resolveRequirements(t, append(required, lib.requirement())); err != nil {
+			log.Warnf("Skipping optional %s:%s for %s: %s", lib.Name, lib.Version, t, err)
+			lib.Skipped = true
+			continue
+		}
+		required = append(required, lib.requirement())
+	}
+	if len(required) == 0 {
+		return depman.Resolution{}, nil
+	}
+	return resolveRequirements(t, required)
+}
 
-	r := bufio.NewReader(fh)
+func (r *RequiredLib) requirement() depman.Requirement {
+	return depman.Requirement{Library: r.Name, Constraint: r.Version, Wanted: r.Wanted}
+}
 
-	for err == nil {
-		line, _, err := r.ReadLine()
-		if err != nil && err != io.EOF {
-			return deps, err
-		} else if err == io.EOF {
-			break
+// libsIn returns the requested libraries of a target
+func (r *RequiredLibs) libsIn(t Target) []*RequiredLib {
+	libs := make([]*RequiredLib, 0)
+	for _, lib := range r.Libs {
+		if lib.Target() == t && !lib.Transitive {
+			libs = append(libs, lib)
 		}
-		s_line := string(line)
-		log.Debugf("Read line: '%s'", s_line)
-		if s_line == "" {
-			// empty line
-			continue
+	}
+	return libs
+}
+
+// Requirements returns what was asked for in a target, without the
+// libraries only pulled in as dependencies
+func (r *RequiredLibs) Requirements(t Target) []depman.Requirement {
+	reqs := make([]depman.Requirement, 0, len(r.Libs))
+	for _, lib := range r.Libs {
+		if lib.Target() == t && !lib.Transitive {
+			reqs = append(reqs, lib.requirement())
 		}
-		dep, err := parseDepLine(s_line)
-		deps.Add(dep)
+	}
+	return reqs
+}
 
-		log.Infof("Want lib: %s", dep.String())
+// resolveRequirements asks the server for the transitive closure of reqs
+func resolveRequirements(t Target, reqs []depman.Requirement) (depman.Resolution, error) {
+	resolution := depman.Resolution{}
+
+	body, err := SendRequestJSON("POST", fmt.Sprintf("/v1/%s/resolve/%s/%s", t.NameSpace, t.Platform, t.Arch), reqs)
+	if err != nil {
+		return resolution, err
 	}
 
-	return deps, nil
+	if err = json.Unmarshal(body, &resolution); err != nil {
+		return resolution, err
+	}
+	return resolution, nil
 }
 
 func ParseSourceFiles(walkpath string, wanted string, deps *RequiredLibs) error {
@@ -650,7 +1143,15 @@ func ParseSourceFiles(walkpath string, wanted string, deps *RequiredLibs) error
 	}
 
 	// Now, see if they exist and add them to deps
-	for include, sourcefile := range found_hash_includes {
+	// Sorted, so libraries are requested in the same order every run
+	includes := make([]string, 0, len(found_hash_includes))
+	for include := range found_hash_includes {
+		includes = append(includes, include)
+	}
+	sort.Strings(includes)
+
+	for _, include := range includes {
+		sourcefile := found_hash_includes[include]
 		log.Infof("Found #include: %s in file %s", include, sourcefile)
 
 		_, err := os.Stat(include)
@@ -791,6 +1292,10 @@ func dedupeStringSlice(slice []string) []string {
 }
 
 func findLibFromFile(filename string) (string, string, error) {
+	if offlineMode {
+		return offlineLock.findLibFromFile(Target{depmanNs, depmanPlatform, depmanArch}, filename)
+	}
+
 	body, err := GETRequestJSON(fmt.Sprintf("/v1/%s/search/%s/%s/%s", depmanNs, depmanPlatform, depmanArch, filename))
 
 	if err != nil {
@@ -805,21 +1310,35 @@ func findLibFromFile(filename string) (string, string, error) {
 	if len(files) > 1 {
 		return "", "", fmt.Errorf("Found more than one file returned when searching for %s (have %d)", filename, len(files))
 	}
+	if files[0].NameSpace != depmanNs {
+		log.Infof("Found %s in name space %s", filename, files[0].NameSpace)
+	}
 
 	return files[0].Library, files[0].Version, nil
 }
 
-func downloadLibFile(libname string, libver string, f depman.File, dir string, mode os.FileMode) (string, error) {
+// downloadLibFile fetches f from the name space and version it was
+// resolved in
+func downloadLibFile(f depman.File, dir string, mode os.FileMode) (string, error) {
 	localfile := fmt.Sprintf("%s/%s", dir, f.Name)
-	log.Debugf("Downloading %s/%s/%s to %s", libname, libver, f.Name, localfile)
+	log.Debugf("Downloading %s/%s/%s to %s", f.Library, f.Version, f.Name, localfile)
 
 	uri_path := fmt.Sprintf("/v1/%s/lib/%s/versions/%s/files/%s/%s/%s/%s/download",
-		depmanNs, libname, libver, depmanPlatform, depmanArch, f.Type, f.Name)
+		f.NameSpace, f.Library, url.PathEscape(f.Version), f.Platform, f.Arch, f.Type, f.Name)
 
-	return localfile, doDownload(uri_path, localfile, mode)
+	if cache != nil && f.Checksum != "" {
+		return localfile, cache.fetch(uri_path, f, localfile, mode)
+	}
+	if offlineMode {
+		return localfile, fmt.Errorf("Offline: no checksum recorded, so it cannot come from the cache")
+	}
+	return localfile, doDownload(uri_path, localfile, mode, f.Checksum)
 }
 
-func doDownload(url string, localfile string, mode os.FileMode) error {
+// doDownload fetches url into localfile via a temporary file. The
+// contents are verified against the checksum the server sends and, if
+// not empty, against expected (e.g. from a file listing).
+func doDownload(url string, localfile string, mode os.FileMode, expected string) error {
 	log.Debugf("Downloading from %s to %s", url, localfile)
 	filedir := filepath.Dir(localfile)
 	filename := filepath.Base(localfile)
@@ -846,7 +1365,7 @@ func doDownload(url string, localfile string, mode os.FileMode) error {
 		return err
 	}
 
-	err = downloadToFh(url, fh)
+	err = downloadToFh(url, fh, expected)
 	if err != nil {
 		fh.Close()
 		os.Remove(tmpfile)
@@ -860,33 +1379,32 @@ func doDownload(url string, localfile string, mode os.FileMode) error {
 	return err
 }
 
-func downloadToFh(url string, fh io.Writer) error {
+// downloadToFh fetches url into fh, resuming where it broke off when the
+// transfer fails midway
+func downloadToFh(url string, fh *os.File, expected string) error {
 	log.Debugf("Download URL: %s", url)
 
-	req_url := strings.Join([]string{depmanUrl, url}, "")
-
-	req, err := http.NewRequest("GET", req_url, nil)
-	if err != nil {
-		return err
+	d := &download{
+		url:  strings.Join([]string{depmanUrl, url}, ""),
+		fh:   fh,
+		hash: sha256.New(),
+		size: -1,
 	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	if err := d.run(); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(fmt.Sprintf("Http error: %d", resp.StatusCode))
+	checksum := hex.EncodeToString(d.hash.Sum(nil))
+	for _, want := range []string{d.checksum, expected} {
+		if want != "" && want != checksum {
+			return fmt.Errorf("Checksum mismatch for %s: expected sha256 %s, got %s", url, want, checksum)
+		}
 	}
-
-	written, err := io.Copy(fh, resp.Body)
-	if err != nil {
-		return err
+	if d.checksum == "" && expected == "" {
+		log.Warnf("Server sent no checksum for %s - cannot verify", url)
 	}
-	log.Debugf("Wrote %d bytes", written)
 
-	return err
+	return nil
 }
 
 func GETRequestJSON(path string) ([]byte, error) {
@@ -896,25 +1414,90 @@ func GETRequestJSON(path string) ([]byte, error) {
 func GETRequest(path string, accept string) ([]byte, error) {
 	req_url := strings.Join([]string{depmanUrl, path}, "")
 
-	req, err := http.NewRequest("GET", req_url, nil)
+	resp, err := doRequest(func() (*http.Request, error) {
+		req, err := newRequest("GET", req_url, nil)
+		if err == nil {
+			req.Header.Set("Accept", accept)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	l := log.WithFields(log.Fields{"url": req_url, "httpcode": resp.StatusCode, "method": "GET"})
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		l.Warn("HTTP error")
+		return nil, errors.New(fmt.Sprintf("HTTP Error %d", resp.StatusCode))
+	}
+	l.Debug("HTTP log")
+
+	return ioutil.ReadAll(resp.Body)
+
+}
+
+// SendRequestJSON sends body as JSON and returns the response. Errors
+// include the message the server sent along.
+func SendRequestJSON(method string, path string, body interface{}) ([]byte, error) {
+	req_url := strings.Join([]string{depmanUrl, path}, "")
+
+	jsonblob, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", accept)
 
-	resp, err := httpClient.Do(req)
+	resp, err := doRequest(func() (*http.Request, error) {
+		req, err := newRequest(method, req_url, bytes.NewReader(jsonblob))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/json")
+		}
+		return req, err
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	l := log.WithFields(log.Fields{"url": req_url, "httpcode": resp.StatusCode, "method": "GET"})
+	respbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.WithFields(log.Fields{"url": req_url, "httpcode": resp.StatusCode, "method": method})
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		l.Warn("HTTP error")
+		errResp := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(respbody, &errResp) == nil && errResp.Error != "" {
+			return nil, fmt.Errorf("HTTP Error %d: %s", resp.StatusCode, errResp.Error)
+		}
 		return nil, errors.New(fmt.Sprintf("HTTP Error %d", resp.StatusCode))
 	}
 	l.Debug("HTTP log")
 
-	return ioutil.ReadAll(resp.Body)
+	return respbody, nil
+}
+
+func DELETERequest(path string) error {
+	req_url := strings.Join([]string{depmanUrl, path}, "")
+
+	resp, err := doRequest(func() (*http.Request, error) {
+		return newRequest("DELETE", req_url, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
+	l := log.WithFields(log.Fields{"url": req_url, "httpcode": resp.StatusCode, "method": "DELETE"})
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		l.Warn("HTTP error")
+		return errors.New(fmt.Sprintf("HTTP Error %d", resp.StatusCode))
+	}
+	l.Debug("HTTP log")
+
+	return nil
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/moensch/depman"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// useTestServer points depman-cli at handler, without retries
+func useTestServer(t *testing.T, handler http.Handler) func() {
+	server := httptest.NewServer(handler)
+	oldUrl, oldClient, oldRetries := depmanUrl, httpClient, httpRetries
+	depmanUrl, httpClient, httpRetries = server.URL, server.Client(), 0
+	return func() {
+		server.Close()
+		depmanUrl, httpClient, httpRetries = oldUrl, oldClient, oldRetries
+	}
+}
+
+// testServer is a depman server with a memory store which depman-cli
+// installs from into dir
+type testServer struct {
+	*depman.DepMan
+	t   *testing.T
+	dir string
+}
+
+func newTestServer(t *testing.T) (*testServer, func()) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := depman.DefaultConfig()
+	cfg.DB.Driver = "memory"
+	cfg.StoreDir = filepath.Join(dir, "store")
+	cfg.TempDir = dir
+	cfg.Auth.Anonymous = "admin"
+	srv, err := depman.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := useTestServer(t, srv.Router)
+	depmanNs, depmanPlatform, depmanArch = "default", "el7", "x86_64"
+	includeDir, libDir = filepath.Join(dir, "include"), filepath.Join(dir, "lib")
+	new_header_files = make(map[string]int)
+	cache, offlineMode, bundleDownloads = nil, false, false
+	return &testServer{srv, t, dir}, func() {
+		restore()
+		os.RemoveAll(dir)
+	}
+}
+
+// upload stores a file of library:version, replacing published ones
+func (s *testServer) upload(library string, version string, fileType string, name string, body string) {
+	url := fmt.Sprintf("%s/v1/default/lib/%s/versions/%s/files/el7/x86_64/%s/%s/upload?force=true",
+		depmanUrl, library, version, fileType, name)
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("Uploading %s of %s:%s: %s", name, library, version, resp.Status)
+	}
+}
+
+// installed returns the contents of an installed header
+func (s *testServer) installed(name string) string {
+	body, err := ioutil.ReadFile(filepath.Join(includeDir, name))
+	if err != nil {
+		return err.Error()
+	}
+	return string(body)
+}
+
+func TestDeletePath(t *testing.T) {
+	depmanNs, depmanPlatform, depmanArch = "default", "el7", "x86_64"
+
+	tests := []struct {
+		what string
+		args []string
+		want string
+	}{
+		{"lib", []string{"foo"}, "/v1/default/lib/foo"},
+		{"version", []string{"foo", "1.0+b1"}, "/v1/default/lib/foo/versions/1.0+b1"},
+		{"version", []string{"foo", "1.0/rc?1"}, "/v1/default/lib/foo/versions/1.0%2Frc%3F1"},
+		{"file", []string{"foo", "1.0", "header", "foo #1.h"},
+			"/v1/default/lib/foo/versions/1.0/files/el7/x86_64/header/foo%20%231.h"},
+		{"link", []string{"foo", "1.0", "lib", "libfoo.so.1", "libfoo%.so"},
+			"/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.so.1/links/libfoo%25.so"},
+		{"extra", []string{"tool", "2.0"}, "/v1/default/extra/tool/2.0"},
+	}
+	for _, test := range tests {
+		got, err := deletePath(test.what, test.args)
+		if err != nil {
+			t.Errorf("deletePath(%s, %v): %s", test.what, test.args, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("deletePath(%s, %v) = %s, want %s", test.what, test.args, got, test.want)
+		}
+	}
+
+	for _, args := range [][]string{{"foo"}, {"foo", "1.0", "lib"}} {
+		if _, err := deletePath("version", args); err == nil {
+			t.Errorf("deletePath(version, %v) accepted the wrong number of parameters", args)
+		}
+	}
+	if _, err := deletePath("namespace", []string{"foo"}); err == nil {
+		t.Error("deletePath accepted an unknown object type")
+	}
+}
+
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	body := "contents"
+	sent := ""
+	defer useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sent != "" {
+			w.Header().Set(depman.ChecksumHeader, sent)
+		}
+		w.Write([]byte(body))
+	}))()
+
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localfile := filepath.Join(dir, "libfoo.a")
+
+	right, wrong := testChecksum(body), testChecksum("other")
+	tests := []struct {
+		// Sent by the server and expected from the file listing
+		sent, expected string
+		ok             bool
+	}{
+		{right, "", true},
+		{right, right, true},
+		{wrong, "", false},
+		{right, wrong, false},
+		{"", right, true},
+		{"", wrong, false},
+		// Nothing to verify against, only warned about
+		{"", "", true},
+	}
+	for _, test := range tests {
+		sent = test.sent
+		err := doDownload("/download", localfile, 0644, test.expected)
+		if (err == nil) != test.ok {
+			t.Errorf("Sent %q, expected %q: error %v, want ok %t", test.sent, test.expected, err, test.ok)
+		}
+
+		got, rerr := ioutil.ReadFile(localfile)
+		switch {
+		case test.ok && string(got) != body:
+			t.Errorf("Sent %q, expected %q: downloaded %q, want %q", test.sent, test.expected, got, body)
+		case !test.ok && !os.IsNotExist(rerr):
+			t.Errorf("Sent %q, expected %q: contents failing verification were kept", test.sent, test.expected)
+		}
+		if _, err = os.Stat(filepath.Join(dir, ".libfoo.a.dwn")); !os.IsNotExist(err) {
+			t.Errorf("Sent %q, expected %q: temporary file left behind", test.sent, test.expected)
+		}
+	}
+}
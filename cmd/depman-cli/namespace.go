@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/depman"
+	"strings"
+)
+
+// nsCommand manages name spaces: list, show, create, lock, unlock and
+// delete. show and the others default to the current name space.
+func nsCommand(args []string) error {
+	sub := "show"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	ns := depmanNs
+	if len(args) > 1 {
+		ns = args[1]
+	}
+	path := fmt.Sprintf("/v1/%s/namespace", ns)
+
+	switch sub {
+	case "list":
+		body, err := GETRequestJSON("/v1/_admin/namespaces")
+		if err != nil {
+			return err
+		}
+		namespaces := depman.Namespaces{}
+		if err = json.Unmarshal(body, &namespaces); err != nil {
+			return err
+		}
+		fmt.Printf("%-24s %-24s %-6s %9s %9s %8s  %s\n", "NAME", "PARENT", "LOCKED", "LIBRARIES", "VERSIONS", "SIZE", "LAST ACTIVITY")
+		for _, n := range namespaces {
+			u := depman.NamespaceUsage{}
+			if n.Usage != nil {
+				u = *n.Usage
+			}
+			fmt.Printf("%-24s %-24s %-6t %9d %9d %8s  %s\n",
+				n.Name, n.Parent, n.Locked, u.Libraries, u.Versions, formatSize(u.Size), formatActivity(u))
+		}
+	case "show":
+		body, err := GETRequestJSON(path)
+		if err != nil {
+			return err
+		}
+		n := depman.Namespace{}
+		if err = json.Unmarshal(body, &n); err != nil {
+			return err
+		}
+		printNamespace(n)
+	case "create":
+		req := map[string]string{}
+		if len(args) > 2 {
+			req["parent"] = args[2]
+		}
+		body, err := SendRequestJSON("PUT", path, req)
+		if err != nil {
+			return err
+		}
+		n := depman.Namespace{}
+		if err = json.Unmarshal(body, &n); err != nil {
+			return err
+		}
+		fmt.Printf("Name space %s: %s\n", n.Name, strings.Join(n.Chain, " -> "))
+	case "lock", "unlock":
+		method := "PUT"
+		if sub == "unlock" {
+			method = "DELETE"
+		}
+		if _, err := SendRequestJSON(method, path+"/lock", nil); err != nil {
+			return err
+		}
+		fmt.Printf("Name space %s %sed\n", ns, sub)
+	case "delete":
+		if len(args) < 2 {
+			return fmt.Errorf("ns delete needs the name space to delete")
+		}
+		if forceUpload {
+			path += "?force=true"
+		}
+		body, err := SendRequestJSON("DELETE", path, nil)
+		if err != nil {
+			return err
+		}
+		n := depman.Namespace{}
+		if err = json.Unmarshal(body, &n); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted name space %s", ns)
+		if n.Usage != nil {
+			fmt.Printf(" (%d files, %d extra files, %s)", n.Usage.Files, n.Usage.ExtraFiles, formatSize(n.Usage.Size))
+		}
+		fmt.Printf("\n")
+	default:
+		return fmt.Errorf("Unknown ns operation %s", sub)
+	}
+
+	return nil
+}
+
+func printNamespace(n depman.Namespace) {
+	u := depman.NamespaceUsage{}
+	if n.Usage != nil {
+		u = *n.Usage
+	}
+	fmt.Printf("Name space   : %s\n", n.Name)
+	fmt.Printf("Lookup chain : %s\n", strings.Join(n.Chain, " -> "))
+	fmt.Printf("Locked       : %t\n", n.Locked)
+	fmt.Printf("Libraries    : %d (%d versions)\n", u.Libraries, u.Versions)
+	fmt.Printf("Files        : %d (%d extra files)\n", u.Files, u.ExtraFiles)
+	fmt.Printf("Size         : %s\n", formatSize(u.Size))
+	fmt.Printf("Last activity: %s\n", formatActivity(u))
+}
+
+func formatActivity(u depman.NamespaceUsage) string {
+	if u.LastActivity.IsZero() {
+		return "-"
+	}
+	return u.LastActivity.Local().Format("2006-01-02 15:04")
+}
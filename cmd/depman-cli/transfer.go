@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/depman"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	httpTimeout time.Duration
+	httpRetries int
+)
+
+// maxBackoff caps the delay between retries
+const maxBackoff = 30 * time.Second
+
+func backoff(attempt int) time.Duration {
+	d := 500 * time.Millisecond << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// retryableStatus is true for answers which may well be different when
+// asked again
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout, http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// doRequest sends the request built by build. Idempotent requests are
+// retried up to httpRetries times with exponential backoff when the
+// connection fails or the server answers with a temporary error; build
+// runs for every attempt so request bodies can be rewound. The response
+// body is closed after httpTimeout without data.
+func doRequest(build func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		resp, err := httpClient.Do(req.WithContext(ctx))
+
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case retryableStatus(resp.StatusCode):
+			reason = fmt.Sprintf("HTTP Error %d", resp.StatusCode)
+		default:
+			resp.Body = newIdleTimeoutBody(resp.Body, cancel)
+			return resp, nil
+		}
+
+		if attempt >= httpRetries || !idempotent(req.Method) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = newIdleTimeoutBody(resp.Body, cancel)
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+
+		delay := backoff(attempt)
+		log.Warnf("%s %s failed (%s) - retrying in %s", req.Method, req.URL, reason, delay)
+		time.Sleep(delay)
+	}
+}
+
+// idleTimeoutBody cancels its request when no data arrived for
+// httpTimeout. Unlike a timeout on the whole request this lets large
+// downloads take as long as they need.
+type idleTimeoutBody struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	b := &idleTimeoutBody{body: body, cancel: cancel}
+	if httpTimeout > 0 {
+		b.timer = time.AfterFunc(httpTimeout, func() {
+			b.mu.Lock()
+			b.expired = true
+			b.mu.Unlock()
+			cancel()
+		})
+	}
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.timer != nil {
+		b.timer.Reset(httpTimeout)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && err != io.EOF && b.expired {
+		err = fmt.Errorf("No data received for %s", httpTimeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// download is a transfer into a local file which can be resumed where
+// it broke off
+type download struct {
+	url  string
+	fh   *os.File
+	hash hash.Hash
+
+	offset   int64
+	size     int64
+	checksum string
+}
+
+// reset starts the download over
+func (d *download) reset() error {
+	d.offset = 0
+	d.hash.Reset()
+	if err := d.fh.Truncate(0); err != nil {
+		return err
+	}
+	_, err := d.fh.Seek(0, io.SeekStart)
+	return err
+}
+
+// run fetches the file, resuming where an attempt broke off
+func (d *download) run() error {
+	for attempt := 0; ; attempt++ {
+		retry, err := d.attempt()
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= httpRetries {
+			return err
+		}
+		delay := backoff(attempt)
+		log.Warnf("Download of %s failed after %d bytes (%s) - retrying in %s", d.url, d.offset, err, delay)
+		time.Sleep(delay)
+	}
+
+	if d.size >= 0 && d.offset != d.size {
+		return fmt.Errorf("Size mismatch for %s: expected %d bytes, got %d", d.url, d.size, d.offset)
+	}
+	return nil
+}
+
+// attempt fetches the rest of the file. It reports whether a failure is
+// worth another attempt.
+func (d *download) attempt() (bool, error) {
+	resp, err := doRequest(func() (*http.Request, error) {
+		req, err := newRequest("GET", d.url, nil)
+		if err == nil && d.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+			// Changed contents come back in full instead
+			req.Header.Set("If-Range", `"`+d.checksum+`"`)
+		}
+		return req, err
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.offset > 0:
+		// Only continue with the same contents from the right place
+		start := int64(-1)
+		if cr := resp.Header.Get("Content-Range"); strings.HasPrefix(cr, "bytes ") {
+			if dash := strings.IndexByte(cr, '-'); dash > 0 {
+				start, _ = strconv.ParseInt(cr[len("bytes "):dash], 10, 64)
+			}
+		}
+		if start != d.offset || resp.Header.Get(depman.ChecksumHeader) != d.checksum {
+			if err = d.reset(); err != nil {
+				return false, err
+			}
+			return true, fmt.Errorf("Cannot resume %s - contents changed", d.url)
+		}
+		log.Infof("Resuming %s at %d bytes", d.url, d.offset)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if d.offset > 0 {
+			log.Warnf("Server did not resume %s - starting over", d.url)
+			if err = d.reset(); err != nil {
+				return false, err
+			}
+		}
+		d.size = resp.ContentLength
+		d.checksum = resp.Header.Get(depman.ChecksumHeader)
+	default:
+		return false, errors.New(fmt.Sprintf("Http error: %d", resp.StatusCode))
+	}
+
+	written, err := io.Copy(io.MultiWriter(d.fh, d.hash), resp.Body)
+	d.offset += written
+	log.Debugf("Wrote %d bytes", written)
+	if err != nil {
+		if d.checksum == "" {
+			// Nothing to make sure a resumed download fits together
+			if rerr := d.reset(); rerr != nil {
+				return false, rerr
+			}
+		}
+		return true, err
+	}
+
+	return false, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"github.com/moensch/depman"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:   500 * time.Millisecond,
+		1:   time.Second,
+		5:   16 * time.Second,
+		6:   maxBackoff,
+		100: maxBackoff,
+	}
+	for attempt, want := range tests {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+
+	for code, want := range map[int]bool{200: false, 404: false, 409: false, 429: true, 500: true, 502: true, 503: true, 504: true} {
+		if got := retryableStatus(code); got != want {
+			t.Errorf("retryableStatus(%d) = %t, want %t", code, got, want)
+		}
+	}
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	requests, failures := 0, 0
+	defer useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))()
+	httpRetries = 1
+
+	tests := []struct {
+		method   string
+		failures int
+		requests int
+		code     int
+	}{
+		{"GET", 1, 2, http.StatusOK},
+		{"PUT", 1, 2, http.StatusOK},
+		// Given up once the retries are used up
+		{"GET", 2, 2, http.StatusServiceUnavailable},
+		// Not safe to send twice
+		{"POST", 1, 1, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		requests, failures = 0, test.failures
+		resp, err := doRequest(func() (*http.Request, error) {
+			return newRequest(test.method, depmanUrl+"/v1/default/lib", nil)
+		})
+		if err != nil {
+			t.Errorf("%s failing %d times: %s", test.method, test.failures, err)
+			continue
+		}
+		resp.Body.Close()
+		if requests != test.requests || resp.StatusCode != test.code {
+			t.Errorf("%s failing %d times: %d after %d requests, want %d after %d",
+				test.method, test.failures, resp.StatusCode, requests, test.code, test.requests)
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	body, changed := "01234567", "abcdefgh"
+	var ranges []string
+	var answer func(w http.ResponseWriter)
+	defer useTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		if len(ranges) == 1 {
+			// Break off half way
+			w.Header().Set(depman.ChecksumHeader, testChecksum(body))
+			w.Header().Set("Content-Length", "8")
+			w.Write([]byte(body[:4]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		answer(w)
+	}))()
+	httpRetries = 2
+
+	partial := func(start int, checksum string, contents string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			w.Header().Set(depman.ChecksumHeader, checksum)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-7/8", start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(contents))
+		}
+	}
+	full := func(contents string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			w.Header().Set(depman.ChecksumHeader, testChecksum(contents))
+			w.Write([]byte(contents))
+		}
+	}
+	resumed := "bytes=4- \"" + testChecksum(body) + "\""
+
+	tests := []struct {
+		desc   string
+		answer func(w http.ResponseWriter)
+		want   string
+		ranges []string
+	}{
+		{"resumed", partial(4, testChecksum(body), body[4:]), body, []string{" ", resumed}},
+		{"ranges ignored", full(body), body, []string{" ", resumed}},
+		// Started over after the mismatched answer
+		{"wrong range", func(w http.ResponseWriter) {
+			if len(ranges) == 2 {
+				partial(0, testChecksum(body), body)(w)
+				return
+			}
+			full(body)(w)
+		}, body, []string{" ", resumed, " "}},
+		{"changed contents", func(w http.ResponseWriter) {
+			if len(ranges) == 2 {
+				partial(4, testChecksum(changed), changed[4:])(w)
+				return
+			}
+			full(changed)(w)
+		}, changed, []string{" ", resumed, " "}},
+	}
+
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		ranges, answer = nil, test.answer
+		fh, err := ioutil.TempFile(dir, "download")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = downloadToFh("/download", fh, "")
+		fh.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+
+		got, _ := ioutil.ReadFile(fh.Name())
+		if string(got) != test.want {
+			t.Errorf("%s: downloaded %q, want %q", test.desc, got, test.want)
+		}
+		if strings.Join(ranges, ", ") != strings.Join(test.ranges, ", ") {
+			t.Errorf("%s: asked for ranges %q, want %q", test.desc, ranges, test.ranges)
+		}
+	}
+}
@@ -2,38 +2,249 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/moensch/depman"
+	"os"
+	"time"
 )
 
 var (
-	logLevel   string
-	defaultNs  string
-	listenAddr string
-	storeDir   string
+	configFile        string
+	dryRun            bool
+	deleteMissing     bool
+	logLevel          string
+	defaultNs         string
+	listenAddr        string
+	storeDir          string
+	tempDir           string
+	dbDriver          string
+	dbPath            string
+	dbDSN             string
+	dbHost            string
+	dbPort            int
+	dbUser            string
+	dbPassword        string
+	dbName            string
+	dbSSLMode         string
+	dbMaxOpenConns    int
+	dbMaxIdleConns    int
+	dbConnMaxLifetime time.Duration
+	blobDriver        string
+	s3Endpoint        string
+	s3Region          string
+	s3Bucket          string
+	s3Prefix          string
+	s3AccessKey       string
+	s3SecretKey       string
+	s3PathStyle       bool
+	gcInterval        time.Duration
+	gcMinAge          time.Duration
+	adminToken        string
+	publishGrace      time.Duration
+	sessionTimeout    time.Duration
+	allowOverwrite    bool
+	authAnonymous     string
+	tlsCert           string
+	tlsKey            string
+	tlsClientCA       string
+	tlsClientAuth     string
 )
 
 func init() {
+	defaults := depman.DefaultConfig()
+
+	flag.StringVar(&configFile, "c", "", "Config file (JSON)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report what maintenance operations would do")
+	flag.BoolVar(&deleteMissing, "delete-missing", false, "Let gc delete files whose contents are missing instead of only reporting them")
 	flag.StringVar(&logLevel, "d", "info", "Log level (debug|info|warn|error|fatal)")
-	flag.StringVar(&listenAddr, "l", "0.0.0.0:8082", "Listen address and port")
-	flag.StringVar(&storeDir, "s", "/tmp/depman_files", "Data storage directory")
-	flag.StringVar(&defaultNs, "n", "default", "Default Name space")
+	flag.StringVar(&listenAddr, "l", defaults.ListenAddr, "Listen address and port")
+	flag.StringVar(&storeDir, "s", defaults.StoreDir, "Data storage directory")
+	flag.StringVar(&defaultNs, "n", defaults.DefaultNS, "Default Name space")
+	flag.StringVar(&tempDir, "t", "", "Directory for staging uploads (default: system temp dir)")
+	flag.StringVar(&dbDriver, "db-driver", defaults.DB.Driver, "Metadata store (postgres|memory)")
+	flag.StringVar(&dbPath, "db-path", "", "File the memory metadata store persists to (empty = not persisted)")
+	flag.StringVar(&dbDSN, "db-dsn", "", "Database connection string (overrides the other -db-* connection flags)")
+	flag.StringVar(&dbHost, "db-host", defaults.DB.Host, "Database host")
+	flag.IntVar(&dbPort, "db-port", defaults.DB.Port, "Database port")
+	flag.StringVar(&dbUser, "db-user", defaults.DB.User, "Database user")
+	flag.StringVar(&dbPassword, "db-password", defaults.DB.Password, "Database password")
+	flag.StringVar(&dbName, "db-name", defaults.DB.Name, "Database name")
+	flag.StringVar(&dbSSLMode, "db-sslmode", defaults.DB.SSLMode, "Database SSL mode (disable|require|verify-ca|verify-full)")
+	flag.IntVar(&dbMaxOpenConns, "db-max-open", defaults.DB.MaxOpenConns, "Maximum open database connections (0 = unlimited)")
+	flag.IntVar(&dbMaxIdleConns, "db-max-idle", defaults.DB.MaxIdleConns, "Maximum idle database connections")
+	flag.DurationVar(&dbConnMaxLifetime, "db-conn-lifetime", defaults.DB.ConnMaxLifetime.Duration, "Maximum database connection lifetime (0 = forever)")
+	flag.StringVar(&blobDriver, "blob-driver", defaults.Blob.Driver, "File content storage (fs|s3)")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3 endpoint URL (e.g. http://minio:9000)")
+	flag.StringVar(&s3Region, "s3-region", defaults.Blob.S3.Region, "S3 region")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "S3 bucket")
+	flag.StringVar(&s3Prefix, "s3-prefix", "", "Key prefix inside the S3 bucket")
+	flag.StringVar(&s3AccessKey, "s3-access-key", "", "S3 access key")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", "", "S3 secret key")
+	flag.BoolVar(&s3PathStyle, "s3-path-style", defaults.Blob.S3.PathStyle, "Use path-style S3 addressing")
+	flag.DurationVar(&gcInterval, "gc-interval", defaults.GC.Interval.Duration, "Collect garbage in the background this often (0 = never)")
+	flag.DurationVar(&gcMinAge, "gc-min-age", defaults.GC.MinAge.Duration, "Never collect blobs or files younger than this")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token with admin permission on all namespaces, e.g. to create the first tokens (empty = none)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file (enables HTTPS)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file to verify client certificates against")
+	flag.StringVar(&tlsClientAuth, "tls-client-auth", defaults.TLS.ClientAuth, "Client certificates (none|optional|require)")
+	flag.StringVar(&authAnonymous, "auth-anonymous", defaults.Auth.Anonymous, "Permission of requests without a token (none|read|write|admin)")
+	flag.DurationVar(&publishGrace, "publish-grace", defaults.Publish.GracePeriod.Duration, "Files may be overwritten for this long after they were created")
+	flag.DurationVar(&sessionTimeout, "publish-session-timeout", defaults.Publish.SessionTimeout.Duration, "Abort publish sessions not committed within this long (0 = never)")
+	flag.BoolVar(&allowOverwrite, "allow-overwrite", defaults.Publish.AllowOverwrite, "Allow overwriting published files (disables immutability)")
+}
+
+// loadConfig builds the server config from defaults, the config file,
+// the environment and finally any flags given on the command line.
+func loadConfig() (*depman.Config, error) {
+	cfg := depman.DefaultConfig()
+
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			cfg.ListenAddr = listenAddr
+		case "s":
+			cfg.StoreDir = storeDir
+		case "n":
+			cfg.DefaultNS = defaultNs
+		case "t":
+			cfg.TempDir = tempDir
+		case "db-driver":
+			cfg.DB.Driver = dbDriver
+		case "db-path":
+			cfg.DB.Path = dbPath
+		case "db-dsn":
+			cfg.DB.DSN = dbDSN
+		case "db-host":
+			cfg.DB.Host = dbHost
+		case "db-port":
+			cfg.DB.Port = dbPort
+		case "db-user":
+			cfg.DB.User = dbUser
+		case "db-password":
+			cfg.DB.Password = dbPassword
+		case "db-name":
+			cfg.DB.Name = dbName
+		case "db-sslmode":
+			cfg.DB.SSLMode = dbSSLMode
+		case "db-max-open":
+			cfg.DB.MaxOpenConns = dbMaxOpenConns
+		case "db-max-idle":
+			cfg.DB.MaxIdleConns = dbMaxIdleConns
+		case "db-conn-lifetime":
+			cfg.DB.ConnMaxLifetime.Duration = dbConnMaxLifetime
+		case "blob-driver":
+			cfg.Blob.Driver = blobDriver
+		case "s3-endpoint":
+			cfg.Blob.S3.Endpoint = s3Endpoint
+		case "s3-region":
+			cfg.Blob.S3.Region = s3Region
+		case "s3-bucket":
+			cfg.Blob.S3.Bucket = s3Bucket
+		case "s3-prefix":
+			cfg.Blob.S3.Prefix = s3Prefix
+		case "s3-access-key":
+			cfg.Blob.S3.AccessKey = s3AccessKey
+		case "s3-secret-key":
+			cfg.Blob.S3.SecretKey = s3SecretKey
+		case "s3-path-style":
+			cfg.Blob.S3.PathStyle = s3PathStyle
+		case "gc-interval":
+			cfg.GC.Interval.Duration = gcInterval
+		case "gc-min-age":
+			cfg.GC.MinAge.Duration = gcMinAge
+		case "admin-token":
+			cfg.AdminToken = adminToken
+		case "publish-grace":
+			cfg.Publish.GracePeriod.Duration = publishGrace
+		case "publish-session-timeout":
+			cfg.Publish.SessionTimeout.Duration = sessionTimeout
+		case "allow-overwrite":
+			cfg.Publish.AllowOverwrite = allowOverwrite
+		case "auth-anonymous":
+			cfg.Auth.Anonymous = authAnonymous
+		case "tls-cert":
+			cfg.TLS.CertFile = tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = tlsKey
+		case "tls-client-ca":
+			cfg.TLS.ClientCAFile = tlsClientCA
+		case "tls-client-auth":
+			cfg.TLS.ClientAuth = tlsClientAuth
+		}
+	})
+
+	return cfg, nil
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage for %s: [flags] [operation]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\n\nOperation:\n")
+		fmt.Fprintf(os.Stderr, "  serve:\n")
+		fmt.Fprintf(os.Stderr, "    Run the HTTP server (default)\n")
+		fmt.Fprintf(os.Stderr, "  migrate-blobs:\n")
+		fmt.Fprintf(os.Stderr, "    Move stored files into the deduplicated content addressed layout\n")
+		fmt.Fprintf(os.Stderr, "  gc:\n")
+		fmt.Fprintf(os.Stderr, "    Remove orphaned blobs and metadata (see -dry-run)\n")
+		fmt.Fprintf(os.Stderr, "\n\nConfig:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	lvl, _ := log.ParseLevel(logLevel)
 	log.SetLevel(lvl)
 
-	srv, err := depman.NewServer()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Cannot load config: %s", err)
+	}
+
+	srv, err := depman.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Cannot start server: %s", err)
 	}
-	depman.StoreDir = storeDir
-	depman.DefaultNS = defaultNs
 
-	log.Info("initialized")
+	operation := flag.Arg(0)
+	switch operation {
+	case "", "serve":
+		log.Info("initialized")
 
-	srv.Run(listenAddr)
+		srv.Run()
+	case "migrate-blobs":
+		report, err := srv.MigrateBlobs(dryRun)
+		if err != nil {
+			log.Fatalf("Migration failed: %s", err)
+		}
+		fmt.Printf("Migrated: %d (%d duplicates), missing: %d, failed: %d\n",
+			report.Migrated, report.Deduplicated, report.Missing, report.Failed)
+		fmt.Printf("Bytes: %d before, %d after\n", report.BytesBefore, report.BytesAfter)
+		if report.Failed > 0 {
+			os.Exit(1)
+		}
+	case "gc":
+		report, err := srv.CollectGarbage(dryRun, deleteMissing)
+		if err != nil {
+			log.Fatalf("Garbage collection failed: %s", err)
+		}
+		fmt.Println(report.ToString())
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+	default:
+		log.Warnf("Unknown operation: %s", operation)
+		flag.Usage()
+		os.Exit(1)
+	}
 }
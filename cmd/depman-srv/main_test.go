@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile = filepath.Join(dir, "depman.json")
+	defer func() { configFile = "" }()
+	file := `{
+		"listen": "file:1",
+		"default_ns": "file",
+		"temp_dir": "/file",
+		"gc": {"min_age": "10m"},
+		"publish": {"session_timeout": "1h", "grace_period": "1m"}
+	}`
+	if err = ioutil.WriteFile(configFile, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"DEPMAN_LISTEN":                  "env:2",
+		"DEPMAN_TEMP_DIR":                "/env",
+		"DEPMAN_GC_MIN_AGE":              "20m",
+		"DEPMAN_PUBLISH_SESSION_TIMEOUT": "2h",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	if err = flag.CommandLine.Parse([]string{"-t", "/flag", "-publish-session-timeout", "3h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting   string
+		got, want interface{}
+	}{
+		// Set nowhere
+		{"store dir", cfg.StoreDir, "/tmp/depman_files"},
+		// Set in the file only
+		{"default namespace", cfg.DefaultNS, "file"},
+		{"grace period", cfg.Publish.GracePeriod.Duration, time.Minute},
+		// Set in the file and the environment
+		{"listen address", cfg.ListenAddr, "env:2"},
+		{"gc min age", cfg.GC.MinAge.Duration, 20 * time.Minute},
+		// Set everywhere
+		{"temp dir", cfg.TempDir, "/flag"},
+		{"session timeout", cfg.Publish.SessionTimeout.Duration, 3 * time.Hour},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %v, want %v", test.setting, test.got, test.want)
+		}
+	}
+}
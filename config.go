@@ -0,0 +1,304 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything depman-srv needs to start up. It is populated
+// from defaults, an optional JSON config file, DEPMAN_* environment
+// variables and command line flags (in that order of precedence).
+type Config struct {
+	ListenAddr string        `json:"listen"`
+	StoreDir   string        `json:"store_dir"`
+	DefaultNS  string        `json:"default_ns"`
+	TempDir    string        `json:"temp_dir"`
+	AdminToken string        `json:"admin_token"`
+	DB         DBConfig      `json:"db"`
+	Blob       BlobConfig    `json:"blob"`
+	GC         GCConfig      `json:"gc"`
+	Publish    PublishConfig `json:"publish"`
+	Auth       AuthConfig    `json:"auth"`
+	TLS        TLSConfig     `json:"tls"`
+}
+
+// TLSConfig turns on HTTPS when CertFile and KeyFile are set.
+//
+// ClientAuth is "none" (the default), "optional" or "require"; client
+// certificates are verified against ClientCAFile. Identities maps the
+// common name of a client certificate to its grants, like a token.
+type TLSConfig struct {
+	CertFile     string             `json:"cert_file"`
+	KeyFile      string             `json:"key_file"`
+	ClientCAFile string             `json:"client_ca_file"`
+	ClientAuth   string             `json:"client_auth"`
+	Identities   map[string][]Grant `json:"identities"`
+}
+
+// AuthConfig controls access for requests without a token. Anonymous is
+// the permission level they get on every namespace: "none", "read" (the
+// default), "write" or "admin".
+type AuthConfig struct {
+	Anonymous string `json:"anonymous"`
+}
+
+// PublishConfig controls when uploaded contents become immutable. A file
+// may be overwritten for GracePeriod after it was created; after that only
+// an admin can force it. AllowOverwrite turns immutability off entirely.
+// Publish sessions not committed within SessionTimeout are aborted by
+// garbage collection.
+type PublishConfig struct {
+	GracePeriod    Duration `json:"grace_period"`
+	AllowOverwrite bool     `json:"allow_overwrite"`
+	SessionTimeout Duration `json:"session_timeout"`
+}
+
+// GCConfig controls garbage collection of orphaned blobs and metadata.
+// Interval 0 disables the background collector. Nothing younger than
+// MinAge is ever collected.
+type GCConfig struct {
+	Interval Duration `json:"interval"`
+	MinAge   Duration `json:"min_age"`
+}
+
+// BlobConfig selects where file contents are stored. Driver is either
+// "fs" (the default, files below StoreDir) or "s3".
+type BlobConfig struct {
+	Driver string   `json:"driver"`
+	S3     S3Config `json:"s3"`
+}
+
+// S3Config points the s3 blob driver at a bucket on any S3-compatible
+// service. PathStyle addressing is what MinIO and most self-hosted
+// implementations expect.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style"`
+}
+
+// DBConfig selects and configures the metadata store. Driver is either
+// "postgres" (the default) or "memory"; the memory store persists to Path
+// if it is set.
+//
+// For Postgres, DSN is used verbatim if set, otherwise a connection string
+// is built from the other fields.
+type DBConfig struct {
+	Driver          string   `json:"driver"`
+	Path            string   `json:"path"`
+	DSN             string   `json:"dsn"`
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	User            string   `json:"user"`
+	Password        string   `json:"password"`
+	Name            string   `json:"name"`
+	SSLMode         string   `json:"sslmode"`
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+}
+
+// Duration is a time.Duration which reads from JSON as a string
+// such as "5m" or "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Invalid duration %s: %s", b, err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr: "0.0.0.0:8082",
+		StoreDir:   "/tmp/depman_files",
+		DefaultNS:  "default",
+		DB: DBConfig{
+			Driver:       "postgres",
+			Host:         "postgres",
+			Port:         5432,
+			User:         "depman",
+			Password:     "depman",
+			Name:         "depman",
+			SSLMode:      "disable",
+			MaxOpenConns: 0,
+			MaxIdleConns: 2,
+		},
+		GC: GCConfig{
+			MinAge: Duration{time.Hour},
+		},
+		Publish: PublishConfig{
+			SessionTimeout: Duration{24 * time.Hour},
+		},
+		Auth: AuthConfig{
+			Anonymous: "read",
+		},
+		TLS: TLSConfig{
+			ClientAuth: "none",
+		},
+		Blob: BlobConfig{
+			Driver: "fs",
+			S3: S3Config{
+				Region:    "us-east-1",
+				PathStyle: true,
+			},
+		},
+	}
+}
+
+// LoadFile merges the JSON config file at path into c. Keys missing
+// from the file keep their current values.
+func (c *Config) LoadFile(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Cannot open config file %s: %s", path, err)
+	}
+	defer fh.Close()
+
+	if err = json.NewDecoder(fh).Decode(c); err != nil {
+		return fmt.Errorf("Cannot parse config file %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// LoadEnv overrides settings from DEPMAN_* environment variables.
+func (c *Config) LoadEnv() error {
+	strs := map[string]*string{
+		"DEPMAN_LISTEN":          &c.ListenAddr,
+		"DEPMAN_STORE_DIR":       &c.StoreDir,
+		"DEPMAN_DEFAULT_NS":      &c.DefaultNS,
+		"DEPMAN_TEMP_DIR":        &c.TempDir,
+		"DEPMAN_ADMIN_TOKEN":     &c.AdminToken,
+		"DEPMAN_AUTH_ANONYMOUS":  &c.Auth.Anonymous,
+		"DEPMAN_TLS_CERT":        &c.TLS.CertFile,
+		"DEPMAN_TLS_KEY":         &c.TLS.KeyFile,
+		"DEPMAN_TLS_CLIENT_CA":   &c.TLS.ClientCAFile,
+		"DEPMAN_TLS_CLIENT_AUTH": &c.TLS.ClientAuth,
+		"DEPMAN_DB_DRIVER":       &c.DB.Driver,
+		"DEPMAN_DB_PATH":         &c.DB.Path,
+		"DEPMAN_DB_DSN":          &c.DB.DSN,
+		"DEPMAN_DB_HOST":         &c.DB.Host,
+		"DEPMAN_DB_USER":         &c.DB.User,
+		"DEPMAN_DB_PASSWORD":     &c.DB.Password,
+		"DEPMAN_DB_NAME":         &c.DB.Name,
+		"DEPMAN_DB_SSLMODE":      &c.DB.SSLMode,
+		"DEPMAN_BLOB_DRIVER":     &c.Blob.Driver,
+		"DEPMAN_S3_ENDPOINT":     &c.Blob.S3.Endpoint,
+		"DEPMAN_S3_REGION":       &c.Blob.S3.Region,
+		"DEPMAN_S3_BUCKET":       &c.Blob.S3.Bucket,
+		"DEPMAN_S3_PREFIX":       &c.Blob.S3.Prefix,
+		"DEPMAN_S3_ACCESS_KEY":   &c.Blob.S3.AccessKey,
+		"DEPMAN_S3_SECRET_KEY":   &c.Blob.S3.SecretKey,
+	}
+	for env, dst := range strs {
+		if v, ok := os.LookupEnv(env); ok {
+			*dst = v
+		}
+	}
+
+	ints := map[string]*int{
+		"DEPMAN_DB_PORT":           &c.DB.Port,
+		"DEPMAN_DB_MAX_OPEN_CONNS": &c.DB.MaxOpenConns,
+		"DEPMAN_DB_MAX_IDLE_CONNS": &c.DB.MaxIdleConns,
+	}
+	for env, dst := range ints {
+		if v, ok := os.LookupEnv(env); ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", env, err)
+			}
+			*dst = i
+		}
+	}
+
+	bools := map[string]*bool{
+		"DEPMAN_S3_PATH_STYLE":   &c.Blob.S3.PathStyle,
+		"DEPMAN_ALLOW_OVERWRITE": &c.Publish.AllowOverwrite,
+	}
+	for env, dst := range bools {
+		if v, ok := os.LookupEnv(env); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", env, err)
+			}
+			*dst = b
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"DEPMAN_DB_CONN_MAX_LIFETIME":    &c.DB.ConnMaxLifetime.Duration,
+		"DEPMAN_GC_INTERVAL":             &c.GC.Interval.Duration,
+		"DEPMAN_GC_MIN_AGE":              &c.GC.MinAge.Duration,
+		"DEPMAN_PUBLISH_GRACE_PERIOD":    &c.Publish.GracePeriod.Duration,
+		"DEPMAN_PUBLISH_SESSION_TIMEOUT": &c.Publish.SessionTimeout.Duration,
+	}
+	for env, dst := range durations {
+		if v, ok := os.LookupEnv(env); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", env, err)
+			}
+			*dst = d
+		}
+	}
+
+	return nil
+}
+
+// ConnString returns the connection string handed to lib/pq
+func (c DBConfig) ConnString() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	params := []string{}
+	for _, kv := range [][2]string{
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Name},
+		{"host", c.Host},
+		{"sslmode", c.SSLMode},
+	} {
+		if kv[1] != "" {
+			params = append(params, fmt.Sprintf("%s=%s", kv[0], quoteConnValue(kv[1])))
+		}
+	}
+	if c.Port != 0 {
+		params = append(params, fmt.Sprintf("port=%d", c.Port))
+	}
+
+	return strings.Join(params, " ")
+}
+
+// quoteConnValue quotes a value for a key=value connection string
+// if it contains spaces, quotes or backslashes.
+func quoteConnValue(v string) string {
+	if !strings.ContainsAny(v, " '\\") {
+		return v
+	}
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "'", "\\'", -1)
+	return "'" + v + "'"
+}
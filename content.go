@@ -0,0 +1,385 @@
+package depman
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentKey is the BlobStore key for contents with the given SHA-256.
+// Every distinct content is stored exactly once, no matter how many
+// files reference it.
+func ContentKey(checksum string) string {
+	return fmt.Sprintf("blobs/sha256/%s/%s", checksum[:2], checksum)
+}
+
+// storeContent reads r into a local staging file while hashing it, stores
+// the contents under their ContentKey unless they already exist and takes
+// a reference on the blob. Callers own that reference and have to hand it
+// back with releaseContent once nothing points to it anymore.
+//
+// Contents which do not have the expected size or checksum (if not -1 or
+// empty, e.g. from the request headers) are rejected before anything is
+// stored, so broken off uploads leave nothing behind.
+func (c *DepMan) storeContent(r io.Reader, expectedSize int64, expectedChecksum string) (string, int64, error) {
+	staging, err := ioutil.TempFile(c.Config.TempDir, "depman-upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(staging.Name())
+	defer staging.Close()
+
+	body := newHashingReader(r)
+	if _, err = io.Copy(staging, body); err != nil {
+		return "", 0, err
+	}
+	checksum := body.Checksum()
+	size := body.Size()
+	if expectedSize >= 0 && size != expectedSize {
+		return "", 0, BadRequestError(fmt.Sprintf("Upload incomplete: received %d of %d bytes", size, expectedSize))
+	}
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		return "", 0, BadRequestError(fmt.Sprintf("Checksum mismatch: %s says %s, received %s", ChecksumHeader, expectedChecksum, checksum))
+	}
+	key := ContentKey(checksum)
+
+	// The reference is taken before looking for the blob, and under the
+	// lock of the content, so the last release of it cannot delete the
+	// blob after it was found
+	unlock := c.contentLocks.lock(checksum)
+	defer unlock()
+	if err = c.Store.AddBlobRef(checksum, size); err != nil {
+		return "", 0, err
+	}
+
+	_, err = c.Blobs.Stat(key)
+	switch {
+	case err == nil:
+		log.Debugf("Content %s already stored - deduplicated %d bytes", checksum, size)
+	case err == ErrNotFound:
+		if _, err = staging.Seek(0, io.SeekStart); err == nil {
+			var written int64
+			if written, err = c.Blobs.Put(key, staging); err == nil {
+				log.Debugf("Stored %d bytes as %s", written, key)
+			}
+		}
+	}
+	if err != nil {
+		if _, rerr := c.Store.ReleaseBlobRef(checksum); rerr != nil {
+			log.Errorf("Cannot release reference to %s: %s", checksum, rerr)
+		}
+		return "", 0, err
+	}
+
+	return checksum, size, nil
+}
+
+// releaseContent drops a reference taken by storeContent and deletes the
+// blob when the last reference is gone.
+func (c *DepMan) releaseContent(checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	unlock := c.contentLocks.lock(checksum)
+	defer unlock()
+	remaining, err := c.Store.ReleaseBlobRef(checksum)
+	switch {
+	case err == ErrNotFound:
+		log.Warnf("No reference recorded for content %s", checksum)
+		return nil
+	case err != nil:
+		return err
+	case remaining > 0:
+		return nil
+	}
+
+	log.Debugf("Last reference to %s released - deleting", checksum)
+	err = c.Blobs.Delete(ContentKey(checksum))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// contentLocks serializes taking the first and releasing the last
+// reference to the same content within this process
+type contentLocks struct {
+	sync.Mutex
+	locks map[string]*contentLock
+}
+
+type contentLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks checksum and returns the function unlocking it again
+func (l *contentLocks) lock(checksum string) func() {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*contentLock)
+	}
+	cl, ok := l.locks[checksum]
+	if !ok {
+		cl = &contentLock{}
+		l.locks[checksum] = cl
+	}
+	cl.users++
+	l.Unlock()
+
+	cl.Lock()
+	return func() {
+		cl.Unlock()
+		l.Lock()
+		if cl.users--; cl.users == 0 {
+			delete(l.locks, checksum)
+		}
+		l.Unlock()
+	}
+}
+
+// getContent opens the first of keys which exists. Files uploaded before
+// content addressing still live at their legacy key until migrated.
+func (c *DepMan) getContent(keys ...string) (io.ReadCloser, error) {
+	return c.getContentRange(0, keys...)
+}
+
+// getContentRange is getContent reading from offset on
+func (c *DepMan) getContentRange(offset int64, keys ...string) (io.ReadCloser, error) {
+	for _, key := range keys {
+		fh, err := c.Blobs.GetRange(key, offset)
+		if err == ErrNotFound {
+			continue
+		}
+		return fh, err
+	}
+	return nil, ErrNotFound
+}
+
+// serveStored answers a download of a file or extra file. Rows from
+// before checksums were recorded have no size either, it is looked up
+// in the blob store.
+func (c *DepMan) serveStored(w http.ResponseWriter, r *http.Request, checksum string, size int64, modified time.Time,
+	keys ...string) {
+
+	if checksum == "" {
+		size = -1
+		for _, key := range keys {
+			info, err := c.Blobs.Stat(key)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				SendErrorResponse(w, r, err)
+				return
+			}
+			size = info.Size
+			break
+		}
+		if size < 0 {
+			SendErrorResponse(w, r, ErrNotFound)
+			return
+		}
+	}
+
+	serveContent(w, r, checksum, size, modified, func(offset int64) (io.ReadCloser, error) {
+		return c.getContentRange(offset, keys...)
+	})
+}
+
+// serveContent answers a download of size bytes of contents, which open
+// opens from an offset on.
+//
+// Downloads support a single byte range ("bytes=100-", "bytes=100-199"
+// or "bytes=-100") so clients can resume interrupted transfers; other
+// Range headers get the whole contents. Files with a checksum get it as
+// strong ETag. If-Range takes that ETag or, for files without checksum,
+// the Last-Modified date. If-None-Match and If-Modified-Since are
+// answered with 304 Not Modified. HEAD requests get the headers without
+// the contents being opened at all.
+func serveContent(w http.ResponseWriter, r *http.Request, checksum string, size int64, modified time.Time,
+	open func(offset int64) (io.ReadCloser, error)) {
+
+	etag := ""
+	if checksum != "" {
+		etag = `"` + checksum + `"`
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	code := http.StatusOK
+	length := size
+	var start, end int64
+	var ok bool
+	var err error
+	// Unless the client has other contents, which are sent in full
+	if ifRangeMatches(r, etag, modified) {
+		start, end, ok, err = parseRange(r.Header.Get("Range"), size)
+	}
+	switch {
+	case err != nil:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		SendErrorResponse(w, r, errRangeNotSatisfiable)
+		return
+	case ok:
+		code = http.StatusPartialContent
+		length = end - start + 1
+	}
+
+	var fh io.ReadCloser
+	if r.Method != "HEAD" {
+		if fh, err = open(start); err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+		defer fh.Close()
+	}
+
+	setContentHeaders(w, checksum, size)
+	if code == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	w.WriteHeader(code)
+	if fh == nil {
+		return
+	}
+
+	written, err := io.CopyN(w, fh, length)
+	if err != nil {
+		// Too late for an error response, the status is out
+		log.Errorf("Download aborted after %d bytes: %s", written, err)
+		return
+	}
+	log.Debugf("Wrote %d bytes", written)
+}
+
+// notModified evaluates If-None-Match or, without it, If-Modified-Since
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etag != "" && etagListMatches(inm, etag)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// Last-Modified has a resolution of seconds
+	return !modified.Truncate(time.Second).After(t)
+}
+
+// etagListMatches compares an If-None-Match list weakly against etag
+func etagListMatches(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches checks If-Range, which needs an exact ETag or date
+func ifRangeMatches(r *http.Request, etag string, modified time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	switch {
+	case ir == "":
+		return true
+	case strings.HasPrefix(ir, `"`):
+		return ir == etag
+	case strings.HasPrefix(ir, "W/"):
+		return false
+	}
+
+	t, err := http.ParseTime(ir)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(t)
+}
+
+// errRangeNotSatisfiable is answered with 416
+var errRangeNotSatisfiable = rangeError("Requested range not satisfiable")
+
+type rangeError string
+
+func (e rangeError) Error() string {
+	return string(e)
+}
+
+// parseRange reads a single range of a Range header. ok is false if
+// there is none or it is not one depman understands.
+func parseRange(header string, size int64) (int64, int64, bool, error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false, nil
+	}
+	first, last := spec[:dash], spec[dash+1:]
+
+	var start, end int64
+	var err error
+	switch {
+	case first == "":
+		// Suffix: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, nil
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+			return 0, 0, false, nil
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, false, nil
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
+
+// skipContent moves fh forward by n bytes, seeking if it can
+func skipContent(fh io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if seeker, ok := fh.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, fh, n)
+	return err
+}
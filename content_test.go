@@ -0,0 +1,326 @@
+package depman
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDepMan(t *testing.T) (*DepMan, func()) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.TempDir = dir
+	cfg.Auth.Anonymous = "admin"
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := NewFSBlobStore(dir + "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DepMan{Config: cfg, Store: store, Blobs: blobs}, func() { os.RemoveAll(dir) }
+}
+
+func TestStoreContentDeduplicates(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+
+	first, size, err := c.storeContent(strings.NewReader("hello"), 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := c.storeContent(strings.NewReader("hello"), -1, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || size != 5 {
+		t.Fatalf("Same contents stored as %s and %s (%d bytes)", first, second, size)
+	}
+
+	for _, test := range []struct {
+		body     string
+		size     int64
+		checksum string
+	}{
+		{"hello", 6, ""},
+		{"hello", -1, strings.Repeat("0", 64)},
+	} {
+		if _, _, err = c.storeContent(strings.NewReader(test.body), test.size, test.checksum); err == nil {
+			t.Errorf("Contents not matching size %d and checksum %q were stored", test.size, test.checksum)
+		}
+	}
+
+	if err = c.releaseContent(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Blobs.Stat(ContentKey(first)); err != nil {
+		t.Fatalf("Blob gone while still referenced: %v", err)
+	}
+	if err = c.releaseContent(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Blobs.Stat(ContentKey(first)); err != ErrNotFound {
+		t.Fatalf("Blob still there after the last release: %v", err)
+	}
+}
+
+// Whoever holds a reference must find the blob, no matter how stores and
+// releases of the same contents interleave
+func TestStoreContentConcurrentRelease(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				checksum, _, err := c.storeContent(strings.NewReader("shared"), -1, "")
+				if err == nil {
+					_, err = c.Blobs.Stat(ContentKey(checksum))
+				}
+				if err == nil {
+					err = c.releaseContent(checksum)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+		err        error
+	}{
+		{"", 100, 0, 0, false, nil},
+		{"bytes=0-99", 100, 0, 99, true, nil},
+		{"bytes=10-19", 100, 10, 19, true, nil},
+		{"bytes=90-", 100, 90, 99, true, nil},
+		{"bytes=90-500", 100, 90, 99, true, nil},
+		{"bytes=-10", 100, 90, 99, true, nil},
+		{"bytes=-500", 100, 0, 99, true, nil},
+		{"bytes= 5-6", 100, 5, 6, true, nil},
+		{"bytes=100-", 100, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=150-200", 100, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=-1", 0, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=0-1,5-6", 100, 0, 0, false, nil},
+		{"bytes=20-10", 100, 0, 0, false, nil},
+		{"bytes=-0", 100, 0, 0, false, nil},
+		{"bytes=a-b", 100, 0, 0, false, nil},
+		{"bytes=5", 100, 0, 0, false, nil},
+		{"items=0-5", 100, 0, 0, false, nil},
+	}
+	for _, test := range tests {
+		start, end, ok, err := parseRange(test.header, test.size)
+		if start != test.start || end != test.end || ok != test.ok || err != test.err {
+			t.Errorf("parseRange(%q, %d) = %d, %d, %t, %v; want %d, %d, %t, %v", test.header, test.size,
+				start, end, ok, err, test.start, test.end, test.ok, test.err)
+		}
+	}
+}
+
+func TestConditionalHeaders(t *testing.T) {
+	etag := `"abc"`
+	modified := time.Date(2026, 10, 1, 12, 0, 0, 500, time.UTC)
+	at := func(d time.Duration) string {
+		return modified.Add(d).Format(http.TimeFormat)
+	}
+
+	notModifiedTests := []struct {
+		headers  map[string]string
+		etag     string
+		modified time.Time
+		want     bool
+	}{
+		{map[string]string{}, etag, modified, false},
+		{map[string]string{"If-None-Match": `"abc"`}, etag, modified, true},
+		{map[string]string{"If-None-Match": `"x", W/"abc"`}, etag, modified, true},
+		{map[string]string{"If-None-Match": `*`}, etag, modified, true},
+		{map[string]string{"If-None-Match": `"x"`}, etag, modified, false},
+		{map[string]string{"If-None-Match": `"abc"`}, "", modified, false},
+		// If-None-Match wins over If-Modified-Since
+		{map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": at(time.Hour)}, etag, modified, false},
+		{map[string]string{"If-Modified-Since": at(0)}, etag, modified, true},
+		{map[string]string{"If-Modified-Since": at(time.Hour)}, etag, modified, true},
+		{map[string]string{"If-Modified-Since": at(-time.Second)}, etag, modified, false},
+		{map[string]string{"If-Modified-Since": "yesterday"}, etag, modified, false},
+		{map[string]string{"If-Modified-Since": at(0)}, etag, time.Time{}, false},
+	}
+	for _, test := range notModifiedTests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if got := notModified(r, test.etag, test.modified); got != test.want {
+			t.Errorf("notModified(%v, %q, %s) = %t, want %t", test.headers, test.etag, test.modified, got, test.want)
+		}
+	}
+
+	ifRangeTests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"abc"`, true},
+		{`"x"`, false},
+		{`W/"abc"`, false},
+		{at(0), true},
+		{at(time.Second), false},
+		{"garbage", false},
+	}
+	for _, test := range ifRangeTests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		if got := ifRangeMatches(r, etag, modified); got != test.want {
+			t.Errorf("ifRangeMatches(%q) = %t, want %t", test.ifRange, got, test.want)
+		}
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	body := "0123456789"
+	checksum := "abc"
+	modified := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	open := func(offset int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(body[offset:])), nil
+	}
+
+	tests := []struct {
+		method       string
+		headers      map[string]string
+		checksum     string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"GET", nil, checksum, http.StatusOK, body, ""},
+		{"HEAD", nil, checksum, http.StatusOK, "", ""},
+		{"GET", map[string]string{"Range": "bytes=2-4"}, checksum, http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"GET", map[string]string{"Range": "bytes=-3"}, checksum, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"HEAD", map[string]string{"Range": "bytes=8-"}, checksum, http.StatusPartialContent, "", "bytes 8-9/10"},
+		{"GET", map[string]string{"Range": "bytes=20-"}, checksum, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"GET", map[string]string{"Range": "bytes=0-1,4-5"}, checksum, http.StatusOK, body, ""},
+		{"GET", map[string]string{"Range": "bytes=2-4", "If-Range": `"abc"`}, checksum, http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"GET", map[string]string{"Range": "bytes=2-4", "If-Range": `"old"`}, checksum, http.StatusOK, body, ""},
+		{"GET", map[string]string{"Range": "bytes=20-", "If-Range": `"old"`}, checksum, http.StatusOK, body, ""},
+		{"GET", map[string]string{"If-None-Match": `"abc"`}, checksum, http.StatusNotModified, "", ""},
+		{"GET", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, checksum, http.StatusNotModified, "", ""},
+		// Legacy contents without checksum resume against their date
+		{"GET", map[string]string{"Range": "bytes=2-4"}, "", http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"GET", map[string]string{"Range": "bytes=2-4", "If-Range": modified.Format(http.TimeFormat)}, "", http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"GET", map[string]string{"Range": "bytes=2-4", "If-Range": modified.Add(-time.Hour).Format(http.TimeFormat)}, "", http.StatusOK, body, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		serveContent(w, r, test.checksum, int64(len(body)), modified, open)
+
+		desc := fmt.Sprintf("%s %v", test.method, test.headers)
+		if w.Code != test.code {
+			t.Errorf("%s: status %d, want %d", desc, w.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", desc, w.Body.String(), test.body)
+		}
+		if got := w.Header().Get("Content-Range"); got != test.contentRange {
+			t.Errorf("%s: Content-Range %q, want %q", desc, got, test.contentRange)
+		}
+		if got := w.Header().Get("Content-Length"); test.method == "GET" && test.code < 300 && got != strconv.Itoa(len(test.body)) {
+			t.Errorf("%s: Content-Length %q, want %d", desc, got, len(test.body))
+		}
+		if test.checksum != "" && w.Header().Get("ETag") != `"abc"` {
+			t.Errorf("%s: ETag %q, want %q", desc, w.Header().Get("ETag"), `"abc"`)
+		}
+	}
+}
+
+func TestDownloadLegacyFile(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	// Stored before checksums and sizes were recorded
+	file := newTestFile("libfoo.a")
+	file.Checksum, file.Size = "", 0
+	if err := c.Store.StoreFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Blobs.Put(file.LegacyBlobKey(), strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := c.Store.GetFiles(map[string]interface{}{"name": "libfoo.a"})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("Stored file: %v %v", stored, err)
+	}
+	modified := stored[0].LastModified().UTC().Format(http.TimeFormat)
+
+	url := server.URL + "/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a/download"
+	for _, test := range []struct {
+		method        string
+		headers       map[string]string
+		code          int
+		body          string
+		contentLength string
+	}{
+		{"GET", nil, http.StatusOK, "0123456789", "10"},
+		{"HEAD", nil, http.StatusOK, "", "10"},
+		{"GET", map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "789", "3"},
+		{"GET", map[string]string{"Range": "bytes=7-", "If-Range": modified}, http.StatusPartialContent, "789", "3"},
+		{"GET", map[string]string{"Range": "bytes=7-", "If-Range": `"abc"`}, http.StatusOK, "0123456789", "10"},
+	} {
+		req, err := http.NewRequest(test.method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		desc := fmt.Sprintf("%s %v", test.method, test.headers)
+		if resp.StatusCode != test.code || string(body) != test.body {
+			t.Errorf("%s: %d %q, want %d %q", desc, resp.StatusCode, body, test.code, test.body)
+		}
+		if got := resp.Header.Get("Content-Length"); got != test.contentLength {
+			t.Errorf("%s: Content-Length %q, want %q", desc, got, test.contentLength)
+		}
+	}
+}
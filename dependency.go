@@ -0,0 +1,365 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultWanted are the file types a dependency brings in unless it
+// says otherwise
+const DefaultWanted = "header,archive,shared"
+
+// Dependency declares that a library version (NameSpace, Library,
+// Version) needs another library matching Constraint, and which types
+// of its files.
+type Dependency struct {
+	Id         int       `json:"dependency_id"`
+	NameSpace  string    `json:"ns"`
+	Library    string    `json:"library"`
+	Version    string    `json:"version"`
+	Requires   string    `json:"requires"`
+	Constraint string    `json:"constraint"`
+	Wanted     string    `json:"wanted"`
+	Created    time.Time `json:"created"`
+}
+
+type Dependencies []Dependency
+
+func (d Dependency) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(d)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (d Dependency) ToString() string {
+	return fmt.Sprintf("%s:%s | %s", d.Requires, d.Constraint, d.Wanted)
+}
+
+func (d Dependencies) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(d)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (d Dependencies) ToString() string {
+	lines := make([]string, len(d))
+	for idx, dep := range d {
+		lines[idx] = dep.ToString()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validate fills in defaults and rejects dependencies which cannot be
+// resolved
+func (d *Dependency) validate() error {
+	if d.Requires == "" {
+		return BadRequestError("Dependency without library")
+	}
+	if d.Requires == d.Library {
+		return BadRequestError(fmt.Sprintf("Library %s cannot depend on itself", d.Library))
+	}
+	if d.Constraint == "" {
+		d.Constraint = "latest"
+	}
+	if _, err := ParseConstraint(d.Constraint); err != nil {
+		return err
+	}
+	if d.Wanted == "" {
+		d.Wanted = DefaultWanted
+	}
+	return nil
+}
+
+// Requirement is one library to resolve, either requested directly or
+// pulled in by a dependency
+type Requirement struct {
+	Library    string `json:"library"`
+	Constraint string `json:"constraint"`
+	Wanted     string `json:"wanted"`
+}
+
+// ResolvedLib is one library of a resolved dependency closure
+type ResolvedLib struct {
+	Library    string   `json:"library"`
+	Version    string   `json:"version"`
+	NameSpace  string   `json:"ns"`
+	Wanted     string   `json:"wanted"`
+	RequiredBy []string `json:"required_by"`
+	Files      Files    `json:"files"`
+}
+
+// Resolution is a dependency closure, every library before the ones it
+// depends on (the order linkers want)
+type Resolution []ResolvedLib
+
+func (r Resolution) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (r Resolution) ToString() string {
+	lines := make([]string, len(r))
+	for idx, lib := range r {
+		lines[idx] = fmt.Sprintf("%s/%s:%s (%s)", lib.NameSpace, lib.Library, lib.Version, strings.Join(lib.RequiredBy, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mergeWanted returns the union of two comma separated type lists
+func mergeWanted(a string, b string) string {
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(a+","+b, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			seen[t] = true
+		}
+	}
+
+	types := make([]string, 0, len(seen))
+	for t := range seen {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+// versionConstraint is a constraint on a library and where it came from
+type versionConstraint struct {
+	constraint string
+	from       string
+}
+
+// ResolveDependencies computes the transitive closure of reqs for a
+// platform and architecture, looking libraries up along a namespace
+// chain. Each library is resolved to the highest version satisfying the
+// constraints of everything requiring it. When a newly found constraint
+// rules out a version picked earlier, resolution starts over with that
+// constraint applied from the start; everything else is learned anew
+// from the versions picked in the new pass. There is no backtracking
+// beyond that, so a library whose constraints cannot all be met is
+// reported as a ConflictError.
+func (c *DepMan) ResolveDependencies(chain []string, platform string, arch string, reqs []Requirement) (Resolution, error) {
+	// Constraints which forced a restart, for all later passes
+	forced := make(map[string][]versionConstraint)
+
+	// Every restart forces one more constraint, so this terminates
+	for {
+		// The requested constraints and those of the versions picked in
+		// this pass
+		constraints := make(map[string][]versionConstraint)
+		addConstraint := func(library string, vc versionConstraint) bool {
+			if hasConstraint(constraints[library], vc) {
+				return false
+			}
+			constraints[library] = append(constraints[library], vc)
+			return true
+		}
+
+		queue := []Requirement{}
+		for _, req := range reqs {
+			if req.Constraint == "" {
+				req.Constraint = "latest"
+			}
+			if req.Wanted == "" {
+				req.Wanted = DefaultWanted
+			}
+			addConstraint(req.Library, versionConstraint{req.Constraint, "(requested)"})
+			queue = append(queue, req)
+		}
+
+		restart := false
+		resolution := Resolution{}
+		chosen := make(map[string]int)
+
+		for len(queue) > 0 && !restart {
+			req := queue[0]
+			queue = queue[1:]
+
+			if idx, ok := chosen[req.Library]; ok {
+				resolution[idx].Wanted = mergeWanted(resolution[idx].Wanted, req.Wanted)
+				continue
+			}
+
+			applying := append([]versionConstraint{}, constraints[req.Library]...)
+			for _, vc := range forced[req.Library] {
+				if !hasConstraint(applying, vc) {
+					applying = append(applying, vc)
+				}
+			}
+			lib, err := c.resolveLibrary(chain, platform, arch, req.Library, applying)
+			if err != nil {
+				return nil, err
+			}
+			lib.Wanted = mergeWanted("", req.Wanted)
+			for _, vc := range constraints[req.Library] {
+				lib.RequiredBy = append(lib.RequiredBy, vc.from)
+			}
+			chosen[req.Library] = len(resolution)
+			resolution = append(resolution, lib)
+
+			deps, err := c.Store.GetDependencies(map[string]interface{}{
+				"ns":      lib.NameSpace,
+				"library": lib.Library,
+				"version": lib.Version,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			from := fmt.Sprintf("%s:%s", lib.Library, lib.Version)
+			for _, dep := range deps {
+				vc := versionConstraint{dep.Constraint, from}
+				if !addConstraint(dep.Requires, vc) {
+					continue
+				}
+				if idx, ok := chosen[dep.Requires]; ok {
+					if cons, _ := ParseConstraint(dep.Constraint); !cons.Match(resolution[idx].Version) {
+						log.Debugf("%s needs %s %s, have %s - starting over",
+							from, dep.Requires, dep.Constraint, resolution[idx].Version)
+						forced[dep.Requires] = append(forced[dep.Requires], vc)
+						restart = true
+						break
+					}
+					resolution[idx].RequiredBy = append(resolution[idx].RequiredBy, from)
+				}
+				queue = append(queue, Requirement{dep.Requires, dep.Constraint, dep.Wanted})
+			}
+		}
+
+		if !restart {
+			return resolution, nil
+		}
+	}
+}
+
+func hasConstraint(constraints []versionConstraint, vc versionConstraint) bool {
+	for _, existing := range constraints {
+		if existing == vc {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveLibrary picks the highest version of library which has files
+// for platform and arch and satisfies all constraints, from the first
+// namespace of chain which has one.
+func (c *DepMan) resolveLibrary(chain []string, platform string, arch string, library string, constraints []versionConstraint) (ResolvedLib, error) {
+	lib := ResolvedLib{Library: library}
+
+	terms := make([]string, len(constraints))
+	for idx, vc := range constraints {
+		terms[idx] = vc.constraint
+	}
+	combined := strings.Join(terms, ",")
+
+	for _, tryNs := range chain {
+		filter := map[string]interface{}{
+			"ns":       tryNs,
+			"library":  library,
+			"platform": platform,
+			"arch":     arch,
+		}
+		versions, err := c.Store.FileVersions(filter)
+		if err != nil {
+			return lib, err
+		}
+
+		ver, err := ResolveVersion(versions, combined)
+		switch {
+		case err == ErrNotFound:
+			continue
+		case err != nil:
+			return lib, err
+		}
+
+		filter["version"] = ver
+		files, err := c.GetFilesByFilter(filter, false)
+		if err != nil {
+			return lib, err
+		}
+
+		lib.NameSpace = tryNs
+		lib.Version = ver
+		lib.Files = files
+		return lib, nil
+	}
+
+	wants := make([]string, len(constraints))
+	for idx, vc := range constraints {
+		wants[idx] = fmt.Sprintf("%s wants %s", vc.from, vc.constraint)
+	}
+	return lib, ConflictError(fmt.Sprintf("No version of %s for %s/%s satisfies all constraints: %s",
+		library, platform, arch, strings.Join(wants, "; ")))
+}
+
+// SetDependencies replaces the dependencies declared for a library
+// version
+func (c *DepMan) SetDependencies(ns string, library string, version string, deps Dependencies) error {
+	seen := make(map[string]bool)
+	for idx := range deps {
+		deps[idx].NameSpace = ns
+		deps[idx].Library = library
+		deps[idx].Version = version
+		if err := deps[idx].validate(); err != nil {
+			return err
+		}
+		if seen[deps[idx].Requires] {
+			return BadRequestError(fmt.Sprintf("Dependency on %s declared twice", deps[idx].Requires))
+		}
+		seen[deps[idx].Requires] = true
+	}
+
+	return c.Store.StoreDependencies(ns, library, version, deps)
+}
+
+// sameDependencies compares two declarations, ignoring order
+func sameDependencies(a Dependencies, b Dependencies) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	keys := make(map[string]bool)
+	for _, d := range a {
+		keys[d.ToString()] = true
+	}
+	for _, d := range b {
+		if !keys[d.ToString()] {
+			return false
+		}
+	}
+	return true
+}
+
+// versionPublished reports whether any file of a library version is
+// published
+func (c *DepMan) versionPublished(ns string, library string, version string) (bool, error) {
+	files, err := c.Store.GetFiles(map[string]interface{}{
+		"ns":      ns,
+		"library": library,
+		"version": version,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range files {
+		if c.isPublished(f.Created, f.Checksum, f.LegacyBlobKey()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,154 @@
+package depman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testLib is a library version with files for el7/x86_64 and the
+// dependencies it declares as "library:constraint"
+type testLib struct {
+	name string
+	deps []string
+}
+
+func storeTestLibs(t *testing.T, c *DepMan, libs []testLib) {
+	for _, lib := range libs {
+		parts := strings.SplitN(lib.name, ":", 2)
+		f := newTestFile("lib" + parts[0] + ".so")
+		f.Library, f.Version = parts[0], parts[1]
+		if err := c.Store.StoreFile(f); err != nil {
+			t.Fatal(err)
+		}
+
+		deps := Dependencies{}
+		for _, dep := range lib.deps {
+			d := strings.SplitN(dep, ":", 2)
+			deps = append(deps, Dependency{Requires: d[0], Constraint: d[1]})
+		}
+		if err := c.SetDependencies("default", parts[0], parts[1], deps); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveDependencies(t *testing.T) {
+	tests := []struct {
+		desc     string
+		libs     []testLib
+		reqs     []Requirement
+		want     []string
+		conflict bool
+	}{
+		{
+			desc: "transitive closure, each library before its dependencies",
+			libs: []testLib{
+				{"app:1.0", []string{"net:^2", "log:latest"}},
+				{"net:2.0", []string{"log:>=1.1"}},
+				{"net:2.5", []string{"log:>=1.1"}},
+				{"net:3.0", nil},
+				{"log:1.0", nil},
+				{"log:1.2", nil},
+			},
+			reqs: []Requirement{{Library: "app"}},
+			want: []string{"app:1.0 (requested)", "net:2.5 app:1.0", "log:1.2 app:1.0,net:2.5"},
+		},
+		{
+			desc: "constraint found later rules out a version picked earlier",
+			libs: []testLib{
+				{"app:1.0", []string{"zlib:latest", "png:1.6"}},
+				{"png:1.6", []string{"zlib:<1.3"}},
+				{"zlib:1.2", nil},
+				{"zlib:1.3", nil},
+			},
+			reqs: []Requirement{{Library: "app"}},
+			want: []string{"app:1.0 (requested)", "zlib:1.2 app:1.0,png:1.6", "png:1.6 app:1.0"},
+		},
+		{
+			// p:2.0 pulls in a:1.2, which wants b <2. z rules p:2.0 out;
+			// without it a:1.3 is picked, which leaves b alone, so z
+			// gets its b >=2.
+			desc: "constraints of versions dropped on restart do not apply",
+			libs: []testLib{
+				{"p:1.0", []string{"a:latest"}},
+				{"p:2.0", []string{"a:1.2"}},
+				{"a:1.2", []string{"b:<2"}},
+				{"a:1.3", nil},
+				{"b:1.0", nil},
+				{"b:2.0", nil},
+				{"z:1.0", []string{"p:<2", "b:>=2"}},
+			},
+			reqs: []Requirement{{Library: "p"}, {Library: "z"}},
+			want: []string{"p:1.0 (requested),z:1.0", "z:1.0 (requested)", "a:1.3 p:1.0", "b:2.0 z:1.0"},
+		},
+		{
+			desc: "constraints which cannot all be met",
+			libs: []testLib{
+				{"app:1.0", []string{"ssl:<1.1", "curl:latest"}},
+				{"curl:7.0", []string{"ssl:>=1.1"}},
+				{"ssl:1.0.2k", nil},
+				{"ssl:1.1.1", nil},
+			},
+			reqs:     []Requirement{{Library: "app"}},
+			conflict: true,
+		},
+		{
+			desc:     "unknown library",
+			reqs:     []Requirement{{Library: "nothing"}},
+			conflict: true,
+		},
+	}
+
+	for _, test := range tests {
+		c, cleanup := newTestDepMan(t)
+		storeTestLibs(t, c, test.libs)
+
+		resolution, err := c.ResolveDependencies([]string{"default"}, "el7", "x86_64", test.reqs)
+		cleanup()
+		if test.conflict {
+			if _, ok := err.(ConflictError); !ok {
+				t.Errorf("%s: got %v, %v; want a ConflictError", test.desc, resolution.ToString(), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+
+		got := []string{}
+		for _, lib := range resolution {
+			got = append(got, lib.Library+":"+lib.Version+" "+strings.Join(lib.RequiredBy, ","))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: resolved %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestPutDependenciesValidates(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+	storeTestLibs(t, c, []testLib{{"app:1.0", []string{"zlib:latest"}}})
+
+	for _, body := range []string{
+		`[{"requires": "app"}]`,
+		`[{"requires": "zlib", "constraint": ">=1.x"}]`,
+		`[{"constraint": "1.0"}]`,
+	} {
+		req, _ := http.NewRequest("PUT", server.URL+"/v1/default/lib/app/versions/1.0/dependencies", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
@@ -1,43 +1,104 @@
 package depman
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 	"net/http"
+	"sync"
 )
 
 var (
-	dbconn    *sql.DB
-	StoreDir  string
-	DefaultNS string
+	ErrNotFound     = errors.New("Entry not found")
+	ErrImmutable    = errors.New("Published contents cannot be changed")
+	ErrForbidden    = errors.New("Permission denied")
+	ErrUnauthorized = errors.New("Authentication required")
+	// ErrContentChanged is a conditional update which lost against
+	// another request changing the same row
+	ErrContentChanged = errors.New("Contents were changed by another request - try again")
+	// ErrLocked is a change to a namespace which was made read-only
+	ErrLocked = errors.New("Namespace is locked")
 )
 
-var ErrNotFound = errors.New("Entry not found")
+// BadRequestError is a mistake in the request, reported as 400
+type BadRequestError string
+
+func (e BadRequestError) Error() string {
+	return string(e)
+}
+
+// ConflictError is a request which contradicts what is stored, such as
+// unsatisfiable dependencies, reported as 409
+type ConflictError string
+
+func (e ConflictError) Error() string {
+	return string(e)
+}
 
 type DepMan struct {
 	Router *mux.Router
+	Config *Config
+	Store  MetadataStore
+	Blobs  BlobStore
+
+	gcLock       sync.Mutex
+	contentLocks contentLocks
 }
 
-func NewServer() (*DepMan, error) {
-	depman := &DepMan{}
-	var err error
-	// TODO: Pull from config or some such
-	dbconn, err = sql.Open("postgres", "user=depman password=depman dbname=depman host=postgres port=5432 sslmode=disable")
+func NewServer(cfg *Config) (*DepMan, error) {
+	depman := &DepMan{
+		Config: cfg,
+	}
+
+	if _, err := ParsePermission(cfg.Auth.Anonymous); err != nil {
+		return nil, fmt.Errorf("Invalid anonymous access level: %s", err)
+	}
+
+	if cfg.TLS.TLSEnabled() {
+		if _, err := cfg.TLS.ServerConfig(); err != nil {
+			return nil, fmt.Errorf("Invalid TLS configuration: %s", err)
+		}
+	}
+
+	store, err := NewMetadataStore(cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	depman.Router = NewRouter()
+	depman.Store = store
+
+	blobs, err := NewBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	depman.Blobs = blobs
+
+	depman.Router = depman.NewRouter()
 	log.Info("initialized")
 	return depman, nil
 }
 
-func (c *DepMan) Run(listenAddr string) {
-	log.Infof("Listening on: %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, c.Router))
+func (c *DepMan) Run() {
+	if c.Config.GC.Interval.Duration > 0 {
+		go c.runPeriodicGC()
+	}
+
+	if !c.Config.TLS.TLSEnabled() {
+		log.Infof("Listening on: %s", c.Config.ListenAddr)
+		log.Fatal(http.ListenAndServe(c.Config.ListenAddr, c.Router))
+	}
+
+	tlsConfig, err := c.Config.TLS.ServerConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %s", err)
+	}
+	server := &http.Server{
+		Addr:      c.Config.ListenAddr,
+		Handler:   c.Router,
+		TLSConfig: tlsConfig,
+	}
+	log.Infof("Listening on: %s (TLS, client certificates: %s)", c.Config.ListenAddr, c.Config.TLS.ClientAuth)
+	log.Fatal(server.ListenAndServeTLS(c.Config.TLS.CertFile, c.Config.TLS.KeyFile))
 }
 
 func prepareFilter(pairs ...string) (map[string]string, error) {
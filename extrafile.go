@@ -1,7 +1,6 @@
 package depman
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -15,7 +14,10 @@ type ExtraFile struct {
 	NameSpace string    `json:"ns"`
 	Name      string    `json:"name"`
 	Info      string    `json:"info"`
+	Checksum  string    `json:"checksum"`
+	Size      int64     `json:"size"`
 	Created   time.Time `json:"created"`
+	Modified  time.Time `json:"modified"`
 }
 
 func (f ExtraFile) ToJsonString() (string, error) {
@@ -31,38 +33,24 @@ func (f ExtraFile) ToString() string {
 	return fmt.Sprintf("%s/%s/%s", f.NameSpace, f.Version, f.Name)
 }
 
-func GetExtraFileByFilter(filter map[string]interface{}) (ExtraFile, error) {
-	ef := ExtraFile{}
-
+// GetExtraFileByFilter returns the extra file matching filter, resolving
+// the "version" in filter, a Constraint, to the highest matching version.
+func (c *DepMan) GetExtraFileByFilter(filter map[string]interface{}) (ExtraFile, error) {
 	if _, ok := filter["version"]; ok {
 		// Got version
 		log.Debug("Have to find latest version")
-		ver, err := GetLatestVersion(filter, "extrafiles")
-		if err == nil {
-			filter["version"] = ver
+		versions, err := c.Store.ExtraFileVersions(filter)
+		if err != nil {
+			return ExtraFile{}, err
 		}
+		ver, err := ResolveVersion(versions, fmt.Sprint(filter["version"]))
+		if err != nil {
+			return ExtraFile{}, err
+		}
+		filter["version"] = ver
 	}
 
-	query := `SELECT extrafile_id, version, ns, name, info, created
-		FROM extrafiles
-		WHERE version=$1 AND ns=$2 AND name=$3`
-
-	log.Debugf("Query: %s", query)
-	err := dbconn.QueryRow(query,
-		filter["version"],
-		filter["ns"],
-		filter["name"]).
-		Scan(&ef.Id, &ef.Version, &ef.NameSpace, &ef.Name, &ef.Info, &ef.Created)
-
-	switch {
-	case err == sql.ErrNoRows:
-		return ef, ErrNotFound
-	case err != nil:
-		log.Error(err)
-		return ef, err
-	}
-
-	return ef, err
+	return c.Store.GetExtraFile(filter)
 }
 
 func NewExtraFileFromVars(vars map[string]string) ExtraFile {
@@ -82,35 +70,51 @@ func NewExtraFileFromVars(vars map[string]string) ExtraFile {
 	return f
 }
 
-func (f *ExtraFile) FilePath() string {
-	return fmt.Sprintf(StoreDir+"/_extras_/%s/%s/%s", f.NameSpace, f.Name, f.Version)
-}
+// DeleteExtraFile removes an extra file and releases its contents
+func (c *DepMan) DeleteExtraFile(f ExtraFile) error {
+	log.Infof("Deleting extra file %s", f.ToString())
 
-func (f *ExtraFile) Store() error {
-	var query string
-	if f.Id == 0 {
-		//insert
-		query = `INSERT INTO extrafiles (version, ns, name, info)
-			VALUES
-			($1, $2, $3, $4)
-			RETURNING extrafile_id
-			`
-	} else {
-		//update
-		query = `UPDATE files SET library=$1, version=$2, ns=$3, name=$4, type=$5, platform=$6, arch=$7 WHERE file_id = $8`
+	if err := c.Store.DeleteExtraFile(f.Id); err != nil {
+		return err
 	}
 
-	var lastInsertId int
-	err := dbconn.QueryRow(query, f.Version, f.NameSpace, f.Name, f.Info).Scan(&lastInsertId)
-	if err != nil {
-		return err
+	var err error
+	if f.Checksum == "" {
+		err = c.Blobs.Delete(f.LegacyBlobKey())
+	} else {
+		err = c.releaseContent(f.Checksum)
+	}
+	if err != nil && err != ErrNotFound {
+		// The row is gone already - garbage collection cleans up
+		log.Errorf("Cannot remove contents of %s: %s", f.ToString(), err)
 	}
-	log.Debugf("Stored as: %d", lastInsertId)
-	f.Id = lastInsertId
 
 	return nil
 }
 
+// BlobKey is the location of the file contents in the BlobStore
+func (f *ExtraFile) BlobKey() string {
+	if f.Checksum != "" {
+		return ContentKey(f.Checksum)
+	}
+	return f.LegacyBlobKey()
+}
+
+// LegacyBlobKey is where contents were kept before they were stored by
+// checksum. See MigrateBlobs.
+func (f *ExtraFile) LegacyBlobKey() string {
+	return fmt.Sprintf("_extras_/%s/%s/%s", f.NameSpace, f.Name, f.Version)
+}
+
+// LastModified is when the contents last changed. Files stored before
+// that was recorded only have their creation time.
+func (f *ExtraFile) LastModified() time.Time {
+	if f.Modified.IsZero() {
+		return f.Created
+	}
+	return f.Modified
+}
+
 type ExtraFiles []ExtraFile
 
 func (f ExtraFiles) ToJsonString() (string, error) {
@@ -1,7 +1,6 @@
 package depman
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -20,10 +19,17 @@ type File struct {
 	Platform         string    `json:"platform"`
 	Arch             string    `json:"arch"`
 	Info             string    `json:"info"`
+	Checksum         string    `json:"checksum"`
+	Size             int64     `json:"size"`
 	Created          time.Time `json:"created"`
+	Modified         time.Time `json:"modified"`
 	Links            FileLinks `json:"file_links"`
 }
 
+// ChecksumHeader carries the hex encoded SHA-256 of a file's contents
+// on upload and download responses
+const ChecksumHeader = "X-Checksum-Sha256"
+
 func (f File) ToJsonString() (string, error) {
 	var retval string
 	jsonblob, err := json.Marshal(f)
@@ -82,153 +88,110 @@ func (f Files) ToString() string {
 	return strings.Join(entries, "\n")
 }
 
-func GetLatestVersion(filter map[string]interface{}, table string) (string, error) {
-	// Don't filter by version anymore
-	ver_search := filter["version"]
-	delete(filter, "version")
-	query := fmt.Sprintf("SELECT version FROM %s WHERE ", table)
-
-	// TODO: Code duplication with the below
-	var i int = 0
-	var values = make([]interface{}, len(filter))
-	var where_clauses = make([]string, len(filter))
-	for col, val := range filter {
-		where_clauses[i] = fmt.Sprintf("%s = $%d", col, i+1)
-		values[i] = val
-		i++
-	}
-
-	if ver_search != "latest" {
-		// Search by prefix - for gigglz
-		where_clauses = append(where_clauses, fmt.Sprintf("version LIKE $%d || '%%'", len(values)+1))
-		values = append(values, ver_search)
-	}
-
-	query += strings.Join(where_clauses, " AND ")
-	query += " ORDER BY string_to_array(version, '.')::int[] DESC LIMIT 1"
-	log.Debugf("GetLatestVersion query: %s", query)
-
-	version := ""
-
-	err := dbconn.QueryRow(query, values...).Scan(&version)
-	switch {
-	case err == sql.ErrNoRows:
-		return version, ErrNotFound
-	case err != nil:
-		log.Error(err)
-		return version, err
-	}
-
-	log.Debugf("Latest version: %s", version)
-
-	return version, err
-}
-
-func GetFilesByFilter(filter map[string]interface{}, find_version bool) (Files, error) {
-	files := Files{}
-
+// GetFilesByFilter returns all files matching filter. If find_version is
+// set, the "version" in filter is a Constraint and resolved to the highest
+// matching version first.
+func (c *DepMan) GetFilesByFilter(filter map[string]interface{}, find_version bool) (Files, error) {
 	if find_version {
 		if _, ok := filter["version"]; ok {
 			// Got version
 			log.Debug("Have to find latest version")
-			ver, err := GetLatestVersion(filter, "files")
-			if err == nil {
-				filter["version"] = ver
-				log.Debugf("Found latest version: %s", filter["version"])
+			versions, err := c.Store.FileVersions(filter)
+			if err != nil {
+				return Files{}, err
+			}
+			ver, err := ResolveVersion(versions, fmt.Sprint(filter["version"]))
+			switch {
+			case err == ErrNotFound:
+				return Files{}, nil
+			case err != nil:
+				return Files{}, err
 			}
+			filter["version"] = ver
+			log.Debugf("Found latest version: %s", filter["version"])
 		}
 	}
-	query := `SELECT file_id, library, version, ns, name, type, platform, arch, info, created
-		FROM files
-		WHERE `
-
-	// TODO: Code duplication with the above
-	var i int = 0
-	var values = make([]interface{}, len(filter))
-	var where_clauses = make([]string, len(filter))
-	for col, val := range filter {
-		where_clauses[i] = fmt.Sprintf("%s = $%d", col, i+1)
-		values[i] = val
-		i++
-	}
-
-	query = query + strings.Join(where_clauses, " AND ")
-	log.Debugf("Filterquery: %s", query)
 
-	rows, err := dbconn.Query(query, values...)
+	files, err := c.Store.GetFiles(filter)
 	if err != nil {
 		return files, err
 	}
 
-	for rows.Next() {
-		file := File{}
-		rows.Scan(&file.Id, &file.Library, &file.Version, &file.NameSpace, &file.Name, &file.Type, &file.Platform, &file.Arch, &file.Info, &file.Created)
-
-		files = append(files, file)
-	}
-
 	for idx, _ := range files {
-		files[idx].Links, _ = files[idx].GetLinks()
+		files[idx].Links, _ = c.Store.GetFileLinks(files[idx].Id)
 	}
 
 	return files, nil
 }
 
-func (f *File) GetLinks() (FileLinks, error) {
-	links, err := GetFileLinksByFileId(f.Id)
-	return links, err
-}
+// DeleteFiles removes files with their links and releases their contents
+func (c *DepMan) DeleteFiles(files Files) error {
+	for idx := range files {
+		f := &files[idx]
+		log.Infof("Deleting file %s/%s/%s/%s", f.NameSpace, f.Library, f.Version, f.ToString())
 
-func (f *File) Store() error {
-	var query string
-	if f.Id == 0 {
-		//insert
-		query = `INSERT INTO files (library, version, ns, name, type, platform, arch, info)
-			VALUES
-			($1, $2, $3, $4, $5, $6, $7, $8)
-			RETURNING file_id
-			`
-	} else {
-		//update
-		query = `UPDATE files SET library=$1, version=$2, ns=$3, name=$4, type=$5, platform=$6, arch=$7 WHERE file_id = $8`
+		if err := c.Store.DeleteFile(f.Id); err != nil {
+			return err
+		}
+
+		var err error
+		if f.Checksum == "" {
+			err = c.Blobs.Delete(f.LegacyBlobKey())
+		} else {
+			err = c.releaseContent(f.Checksum)
+		}
+		if err != nil && err != ErrNotFound {
+			// The row is gone already - garbage collection cleans up
+			log.Errorf("Cannot remove contents of %s: %s", f.ToString(), err)
+		}
 	}
 
-	var lastInsertId int
-	err := dbconn.QueryRow(query, f.Library, f.Version, f.NameSpace, f.Name, f.Type, f.Platform, f.Arch, f.Info).Scan(&lastInsertId)
-	if err != nil {
-		return err
+	// Versions without any files left lose their dependencies too
+	done := make(map[string]bool)
+	for _, f := range files {
+		key := f.NameSpace + "/" + f.Library + "/" + f.Version
+		if done[key] {
+			continue
+		}
+		done[key] = true
+
+		remaining, err := c.Store.GetFiles(map[string]interface{}{
+			"ns":      f.NameSpace,
+			"library": f.Library,
+			"version": f.Version,
+		})
+		if err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			if err = c.Store.StoreDependencies(f.NameSpace, f.Library, f.Version, nil); err != nil {
+				return err
+			}
+		}
 	}
-	log.Debugf("Stored as: %d", lastInsertId)
-	f.Id = lastInsertId
 
 	return nil
 }
 
-func (f *File) FilePath() string {
-	return fmt.Sprintf(StoreDir+"/%s/%s/%s/%s/%s/%s/%s", f.NameSpace, f.Library, f.Version, f.Platform, f.Arch, f.Type, f.Name)
+// BlobKey is the location of the file contents in the BlobStore
+func (f *File) BlobKey() string {
+	if f.Checksum != "" {
+		return ContentKey(f.Checksum)
+	}
+	return f.LegacyBlobKey()
 }
 
-func (fl *FileLink) Store() error {
-	var query string
-	if fl.Id == 0 {
-		//insert
-		query = `INSERT INTO filelinks (file_id, name)
-			VALUES
-			($1, $2)
-			RETURNING file_link_id
-			`
-	} else {
-		//update
-		query = `UPDATE filelinks SET file_id=$1, name=$2 WHERE file_link_id = $3`
-	}
+// LegacyBlobKey is where contents were kept before they were stored by
+// checksum. See MigrateBlobs.
+func (f *File) LegacyBlobKey() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%s/%s", f.NameSpace, f.Library, f.Version, f.Platform, f.Arch, f.Type, f.Name)
+}
 
-	var lastInsertId int
-	err := dbconn.QueryRow(query, fl.FileId, fl.Name).Scan(&lastInsertId)
-	if err != nil {
-		return err
+// LastModified is when the contents last changed. Files stored before
+// that was recorded only have their creation time.
+func (f *File) LastModified() time.Time {
+	if f.Modified.IsZero() {
+		return f.Created
 	}
-	log.Debugf("Stored as: %d", lastInsertId)
-	fl.Id = lastInsertId
-
-	return nil
+	return f.Modified
 }
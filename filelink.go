@@ -2,7 +2,6 @@ package depman
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 )
 
@@ -15,30 +14,6 @@ type FileLink struct {
 
 type FileLinks []FileLink
 
-func GetFileLinksByFileId(file_id int) (FileLinks, error) {
-	links := FileLinks{}
-
-	query := `SELECT file_link_id, file_id, name, created
-		FROM filelinks
-		WHERE file_id = $1`
-
-	log.Debugf("Query: %s", query)
-
-	rows, err := dbconn.Query(query, file_id)
-	if err != nil {
-		return links, err
-	}
-
-	for rows.Next() {
-		fl := FileLink{}
-		rows.Scan(&fl.Id, &fl.FileId, &fl.Name, &fl.Created)
-
-		links = append(links, fl)
-	}
-
-	return links, err
-}
-
 func (f FileLinks) ToJsonString() (string, error) {
 	var retval string
 	jsonblob, err := json.Marshal(f)
@@ -52,3 +27,13 @@ func (f FileLinks) ToString() string {
 	//TODO
 	return ""
 }
+
+// contains reports whether there is a link of the given name
+func (f FileLinks) contains(name string) bool {
+	for _, link := range f {
+		if link.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,356 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"path"
+	"strings"
+	"time"
+)
+
+// GCReport lists everything a garbage collection run found (and removed,
+// unless it was a dry run)
+type GCReport struct {
+	DryRun        bool     `json:"dry_run"`
+	DeleteMissing bool     `json:"delete_missing"`
+	OrphanBlobs   []string `json:"orphan_blobs"`
+	MissingFiles  []string `json:"missing_files"`
+	MissingExtras []string `json:"missing_extrafiles"`
+	FixedRefs     []string `json:"fixed_refs"`
+	FreedBytes    int64    `json:"freed_bytes"`
+	Errors        []string `json:"errors"`
+	// ExpiredSessions are publish sessions older than the timeout
+	ExpiredSessions []string `json:"expired_sessions"`
+}
+
+func (g GCReport) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(g)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (g GCReport) ToString() string {
+	lines := []string{}
+	for _, b := range g.OrphanBlobs {
+		lines = append(lines, "orphan blob: "+b)
+	}
+	kept := ""
+	if !g.DeleteMissing {
+		kept = " (kept)"
+	}
+	for _, f := range g.MissingFiles {
+		lines = append(lines, "missing content: "+f+kept)
+	}
+	for _, f := range g.MissingExtras {
+		lines = append(lines, "missing extra file content: "+f+kept)
+	}
+	for _, s := range g.ExpiredSessions {
+		lines = append(lines, "expired publish session: "+s)
+	}
+	for _, r := range g.FixedRefs {
+		lines = append(lines, "fixed reference count: "+r)
+	}
+	for _, e := range g.Errors {
+		lines = append(lines, "error: "+e)
+	}
+	lines = append(lines, fmt.Sprintf("freed: %d bytes (dry run: %t)", g.FreedBytes, g.DryRun))
+
+	return strings.Join(lines, "\n")
+}
+
+func (g *GCReport) addError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Error(msg)
+	g.Errors = append(g.Errors, msg)
+}
+
+// CollectGarbage reconciles the metadata store against the blob store:
+//
+//   - publish sessions older than Publish.SessionTimeout are aborted
+//   - files and extra files whose contents are gone are reported; with
+//     deleteMissing they are deleted as through the API, links and
+//     references included, and audited
+//   - reference counts lower than the number of rows using a blob are
+//     raised (too high counts only delay deletion and are left alone)
+//   - blobs no row references, including legacy copies and _extras_
+//     entries, are deleted; contents still having a reference count
+//     are kept
+//
+// Anything younger than GC.MinAge is skipped so uploads in flight are
+// never touched. With dryRun nothing is modified.
+//
+// Contents are looked for in one listing of the blob store. As listings
+// of eventually consistent stores can be incomplete, whatever is missing
+// from it is looked up once more before it counts as gone.
+func (c *DepMan) CollectGarbage(dryRun bool, deleteMissing bool) (GCReport, error) {
+	c.gcLock.Lock()
+	defer c.gcLock.Unlock()
+
+	report := GCReport{DryRun: dryRun, DeleteMissing: deleteMissing}
+	cutoff := time.Now().Add(-c.Config.GC.MinAge.Duration)
+
+	blobs, err := c.Blobs.List("")
+	if err != nil {
+		return report, err
+	}
+	stored := make(map[string]BlobInfo, len(blobs))
+	for _, b := range blobs {
+		stored[b.Key] = b
+	}
+
+	// Keys and checksums still in use, and how often each checksum is
+	needed := make(map[string]bool)
+	refs := make(map[string]int)
+	sizes := make(map[string]int64)
+
+	// exists records which of the keys a row can be served from is
+	// present; false means the contents are missing.
+	exists := func(checksum string, size int64, keys ...string) bool {
+		for _, key := range keys {
+			if c.blobStored(stored, key) {
+				needed[key] = true
+				if checksum != "" && key == ContentKey(checksum) {
+					refs[checksum]++
+					sizes[checksum] = size
+				}
+				return true
+			}
+		}
+		return false
+	}
+
+	files, err := c.Store.GetFiles(map[string]interface{}{})
+	if err != nil {
+		return report, err
+	}
+	for _, f := range files {
+		if exists(f.Checksum, f.Size, f.BlobKey(), f.LegacyBlobKey()) || f.Created.After(cutoff) {
+			continue
+		}
+		desc := fmt.Sprintf("%s/%s/%s/%s", f.NameSpace, f.Library, f.Version, f.ToString())
+		log.Warnf("GC: no contents for file %s", desc)
+		report.MissingFiles = append(report.MissingFiles, desc)
+		if deleteMissing && !dryRun {
+			if err := c.DeleteFiles(Files{f}); err != nil {
+				report.addError("Cannot delete file %s: %s", desc, err)
+				continue
+			}
+			c.auditAs("garbage collection", "gc-delete", f.NameSpace, fmt.Sprintf("%s/%s/%s", f.Library, f.Version, f.ToString()),
+				fmt.Sprintf("Deleted file without contents %s", describeContent(f.Checksum)))
+		}
+	}
+
+	extrafiles, err := c.Store.GetExtraFiles(map[string]interface{}{})
+	if err != nil {
+		return report, err
+	}
+	for _, f := range extrafiles {
+		if exists(f.Checksum, f.Size, f.BlobKey(), f.LegacyBlobKey()) || f.Created.After(cutoff) {
+			continue
+		}
+		log.Warnf("GC: no contents for extra file %s", f.ToString())
+		report.MissingExtras = append(report.MissingExtras, f.ToString())
+		if deleteMissing && !dryRun {
+			if err := c.DeleteExtraFile(f); err != nil {
+				report.addError("Cannot delete extra file %s: %s", f.ToString(), err)
+				continue
+			}
+			c.auditAs("garbage collection", "gc-delete", f.NameSpace, fmt.Sprintf("extra/%s/%s", f.Name, f.Version),
+				fmt.Sprintf("Deleted extra file without contents %s", describeContent(f.Checksum)))
+		}
+	}
+
+	sessions, err := c.Store.GetPublishSessions()
+	if err != nil {
+		return report, err
+	}
+	expiry := time.Now().Add(-c.Config.Publish.SessionTimeout.Duration)
+	for _, session := range sessions {
+		if c.Config.Publish.SessionTimeout.Duration > 0 && session.Created.Before(expiry) {
+			log.Warnf("GC: publish session %s expired", session.Id)
+			report.ExpiredSessions = append(report.ExpiredSessions, session.Id)
+			if dryRun {
+				continue
+			}
+			if err := c.abortPublishSession(session.Id); err != nil && err != ErrNotFound {
+				report.addError("Cannot abort publish session %s: %s", session.Id, err)
+			}
+			continue
+		}
+		// Staged contents hold references like files do
+		for _, f := range session.Files {
+			exists(f.Checksum, f.Size, ContentKey(f.Checksum))
+		}
+	}
+
+	records, err := c.Store.ListBlobRefs()
+	if err != nil {
+		return report, err
+	}
+	recorded := make(map[string]BlobRef, len(records))
+	for _, ref := range records {
+		recorded[ref.Checksum] = ref
+	}
+
+	for checksum, actual := range refs {
+		if recorded[checksum].RefCount >= actual {
+			continue
+		}
+		desc := fmt.Sprintf("%s %d -> %d", checksum, recorded[checksum].RefCount, actual)
+		log.Warnf("GC: reference count too low: %s", desc)
+		report.FixedRefs = append(report.FixedRefs, desc)
+		if dryRun {
+			continue
+		}
+		for i := recorded[checksum].RefCount; i < actual; i++ {
+			if err := c.Store.AddBlobRef(checksum, sizes[checksum]); err != nil {
+				report.addError("Cannot fix reference count of %s: %s", checksum, err)
+				break
+			}
+		}
+	}
+
+	for _, b := range blobs {
+		if needed[b.Key] || b.Modified.After(cutoff) {
+			continue
+		}
+
+		if strings.HasPrefix(b.Key, "blobs/sha256/") {
+			c.collectContent(&report, b, refs[path.Base(b.Key)], dryRun)
+			continue
+		}
+
+		log.Infof("GC: orphan blob %s (%d bytes)", b.Key, b.Size)
+		report.OrphanBlobs = append(report.OrphanBlobs, b.Key)
+		report.FreedBytes += b.Size
+		if dryRun {
+			continue
+		}
+		if err := c.Blobs.Delete(b.Key); err != nil && err != ErrNotFound {
+			report.addError("Cannot delete blob %s: %s", b.Key, err)
+		}
+	}
+
+	// Records of blobs which are not stored at all
+	for checksum, ref := range recorded {
+		if ref.Created.After(cutoff) || c.blobStored(stored, ContentKey(checksum)) {
+			continue
+		}
+		log.Infof("GC: record for missing blob %s", checksum)
+		if !dryRun {
+			if err := c.Store.DeleteBlobRef(checksum); err != nil {
+				report.addError("Cannot delete blob record %s: %s", checksum, err)
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"orphan_blobs":   len(report.OrphanBlobs),
+		"missing_files":  len(report.MissingFiles) + len(report.MissingExtras),
+		"fixed_refs":     len(report.FixedRefs),
+		"sessions":       len(report.ExpiredSessions),
+		"freed_bytes":    report.FreedBytes,
+		"errors":         len(report.Errors),
+		"dry_run":        dryRun,
+		"delete_missing": deleteMissing,
+	}).Info("Garbage collection finished")
+
+	return report, nil
+}
+
+// blobStored checks whether key is in the listing of the blob store, or
+// else whether it exists nonetheless. Blobs found that way are added to
+// the listing. Only ErrNotFound counts as missing.
+func (c *DepMan) blobStored(stored map[string]BlobInfo, key string) bool {
+	if _, ok := stored[key]; ok {
+		return true
+	}
+
+	info, err := c.Blobs.Stat(key)
+	switch {
+	case err == ErrNotFound:
+		return false
+	case err != nil:
+		log.Warnf("GC: cannot check %s - assuming it exists: %s", key, err)
+		info = BlobInfo{Key: key}
+	default:
+		log.Warnf("GC: %s exists but was not listed", key)
+	}
+	stored[key] = info
+	return true
+}
+
+// collectContent deletes the content blob b, which uses rows referenced
+// when they were listed, unless it has been taken into use since. An
+// upload takes its reference before it stores its row, so a reference
+// count above uses means the row may be on its way. The content lock
+// keeps uploads from taking a reference while the blob is deleted.
+func (c *DepMan) collectContent(report *GCReport, b BlobInfo, uses int, dryRun bool) {
+	checksum := path.Base(b.Key)
+	unlock := c.contentLocks.lock(checksum)
+	defer unlock()
+
+	ref, err := c.Store.GetBlobRef(checksum)
+	switch {
+	case err != nil && err != ErrNotFound:
+		report.addError("Cannot read blob record %s: %s", checksum, err)
+		return
+	case ref.RefCount > uses:
+		log.Infof("GC: blob %s is referenced %d times - keeping it", b.Key, ref.RefCount)
+		return
+	case c.contentInUse(checksum):
+		return
+	}
+
+	log.Infof("GC: orphan blob %s (%d bytes)", b.Key, b.Size)
+	report.OrphanBlobs = append(report.OrphanBlobs, b.Key)
+	report.FreedBytes += b.Size
+	if dryRun {
+		return
+	}
+	if err = c.Blobs.Delete(b.Key); err != nil && err != ErrNotFound {
+		report.addError("Cannot delete blob %s: %s", b.Key, err)
+	}
+}
+
+// contentInUse checks whether any file, extra file or publish session
+// references checksum
+func (c *DepMan) contentInUse(checksum string) bool {
+	filter := map[string]interface{}{"checksum": checksum}
+
+	files, err := c.Store.GetFiles(filter)
+	if err != nil || len(files) > 0 {
+		return true
+	}
+	extrafiles, err := c.Store.GetExtraFiles(filter)
+	if err != nil || len(extrafiles) > 0 {
+		return true
+	}
+	sessions, err := c.Store.GetPublishSessions()
+	if err != nil {
+		return true
+	}
+	for _, session := range sessions {
+		for _, f := range session.Files {
+			if f.Checksum == checksum {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runPeriodicGC collects garbage every GC.Interval until the process exits
+func (c *DepMan) runPeriodicGC() {
+	log.Infof("Collecting garbage every %s", c.Config.GC.Interval)
+	ticker := time.NewTicker(c.Config.GC.Interval.Duration)
+	for range ticker.C {
+		if _, err := c.CollectGarbage(false, false); err != nil {
+			log.Errorf("Garbage collection failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package depman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// partialListing hides keys from List, like an incomplete listing of an
+// eventually consistent store
+type partialListing struct {
+	BlobStore
+	hidden map[string]bool
+}
+
+func (p partialListing) List(prefix string) ([]BlobInfo, error) {
+	all, err := p.BlobStore.List(prefix)
+	listed := []BlobInfo{}
+	for _, b := range all {
+		if !p.hidden[b.Key] {
+			listed = append(listed, b)
+		}
+	}
+	return listed, err
+}
+
+func TestCollectGarbageMissingContents(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	c.Config.GC.MinAge.Duration = 0
+
+	store := func(name string, body string) File {
+		checksum, size, err := c.storeContent(strings.NewReader(body), -1, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newTestFile(name)
+		f.Checksum, f.Size = checksum, size
+		if err = c.Store.StoreFile(f); err != nil {
+			t.Fatal(err)
+		}
+		return *f
+	}
+	unlisted := store("libfoo.so", "unlisted")
+	gone := store("libfoo.a", "gone")
+	if err := c.Blobs.Delete(gone.BlobKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store.StoreFileLink(&FileLink{FileId: gone.Id, Name: "libfoo.a.1"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Blobs = partialListing{c.Blobs, map[string]bool{unlisted.BlobKey(): true}}
+
+	tests := []struct {
+		deleteMissing bool
+		remaining     int
+	}{
+		{false, 2},
+		{true, 1},
+	}
+	for _, test := range tests {
+		report, err := c.CollectGarbage(false, test.deleteMissing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.MissingFiles) != 1 || !strings.HasSuffix(report.MissingFiles[0], "libfoo.a") {
+			t.Errorf("deleteMissing %t: missing files %v, want only libfoo.a", test.deleteMissing, report.MissingFiles)
+		}
+		if len(report.OrphanBlobs) != 0 {
+			t.Errorf("deleteMissing %t: orphan blobs %v, want none", test.deleteMissing, report.OrphanBlobs)
+		}
+		files, err := c.Store.GetFiles(map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != test.remaining {
+			t.Errorf("deleteMissing %t: %d files left, want %d", test.deleteMissing, len(files), test.remaining)
+		}
+	}
+
+	if _, err := c.Blobs.Stat(unlisted.BlobKey()); err != nil {
+		t.Errorf("Unlisted contents were deleted: %v", err)
+	}
+	refs, err := c.Store.ListBlobRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ref := range refs {
+		found = found || ref.Checksum == unlisted.Checksum
+	}
+	if !found {
+		t.Error("Reference record of unlisted contents was deleted")
+	}
+
+	// Rows are deleted as through the API
+	if links, _ := c.Store.GetFileLinks(gone.Id); len(links) != 0 {
+		t.Errorf("Links of the deleted file are left: %v", links)
+	}
+	if ref, err := c.Store.GetBlobRef(gone.Checksum); err != ErrNotFound {
+		t.Errorf("Reference record of missing contents: %+v %v", ref, err)
+	}
+	entries, err := c.Store.GetAuditEntries(map[string]interface{}{"action": "gc-delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Object != "foo/1.0/el7/x86_64/lib/libfoo.a" {
+		t.Errorf("Audited %v, want the deleted libfoo.a", entries)
+	}
+}
+
+// collectingStore runs a garbage collection right before a file is
+// stored, when an upload has taken its reference but has no row yet
+type collectingStore struct {
+	MetadataStore
+	c      *DepMan
+	report GCReport
+}
+
+func (s *collectingStore) StoreFile(f *File) error {
+	report, err := s.c.CollectGarbage(false, false)
+	if err != nil {
+		return err
+	}
+	s.report = report
+	return s.MetadataStore.StoreFile(f)
+}
+
+func TestCollectGarbageDuringUpload(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	c.Config.GC.MinAge.Duration = 0
+
+	// Left behind without any reference, as by a failed delete
+	for _, body := range []string{"reused", "orphan"} {
+		if _, err := c.Blobs.Put(ContentKey(testChecksum(body)), strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &collectingStore{MetadataStore: c.Store, c: c}
+	c.Store = store
+
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+	code, body := testRequest(t, "PUT", server.URL+"/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.so/upload", "reused")
+	if code != http.StatusOK {
+		t.Fatalf("Upload: %d %s", code, body)
+	}
+
+	if want := []string{ContentKey(testChecksum("orphan"))}; !reflect.DeepEqual(store.report.OrphanBlobs, want) {
+		t.Errorf("Collected %v, want %v", store.report.OrphanBlobs, want)
+	}
+	files, err := c.Store.GetFiles(map[string]interface{}{"checksum": testChecksum("reused")})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Uploaded file: %v %v", files, err)
+	}
+	if _, err = c.Blobs.Stat(files[0].BlobKey()); err != nil {
+		t.Errorf("Contents of the uploaded file: %v", err)
+	}
+	if ref, err := c.Store.GetBlobRef(files[0].Checksum); err != nil || ref.RefCount != 1 {
+		t.Errorf("Reference record of the uploaded file: %+v %v", ref, err)
+	}
+}
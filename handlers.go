@@ -1,37 +1,46 @@
 package depman
 
 import (
-	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-func HandleIndex(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Welcome!")
 }
 
-func HandleListLibraries(w http.ResponseWriter, r *http.Request) {
-	libraries, err := ListLibraries()
+// HandleListLibraries lists the libraries of the namespace and its chain
+func (c *DepMan) HandleListLibraries(w http.ResponseWriter, r *http.Request) {
+	libraries, err := c.chainEntries(r, c.Store.ListLibraries)
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
+	sort.Slice(libraries, func(i, j int) bool {
+		return libraries[i].Name < libraries[j].Name
+	})
 	SendResponse(w, r, libraries)
 }
 
-func HandleGetLibrary(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleGetLibrary(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "Get Library")
 
-	lib, err := GetLibrary(reqVars["library"])
+	var lib SimpleEntry
+	_, err := c.findInChain(w, r, func(ns string) (bool, error) {
+		var err error
+		lib, err = c.Store.GetLibrary(ns, reqVars["library"])
+		lib.NameSpace = ns
+		return err == nil, err
+	})
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
@@ -49,32 +58,53 @@ func logRequest(muxvars map[string]string, msg string) {
 	log.WithFields(f).Info(msg)
 }
 
-func HandleListLibraryVersions(w http.ResponseWriter, r *http.Request) {
+// HandleListLibraryVersions lists the versions of a library in the
+// namespace and its chain
+func (c *DepMan) HandleListLibraryVersions(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "Listing versions by library")
 
-	versions, err := ListVersions(reqVars["library"])
+	versions, err := c.chainEntries(r, func(ns string) (SimpleEntries, error) {
+		return c.Store.ListVersions(ns, reqVars["library"])
+	})
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i].Name, versions[j].Name) < 0
+	})
 	SendResponse(w, r, versions)
 }
 
-func HandleGetLibraryVersion(w http.ResponseWriter, r *http.Request) {
+// HandleGetLibraryVersion resolves a version constraint in the first
+// namespace of the chain with a matching version
+func (c *DepMan) HandleGetLibraryVersion(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "Get Library Version")
 
-	lv, err := GetVersion(reqVars["library"], reqVars["version"])
+	var ver string
+	ns, err := c.findInChain(w, r, func(ns string) (bool, error) {
+		versions, err := c.Store.ListVersions(ns, reqVars["library"])
+		if err != nil {
+			return false, err
+		}
 
+		names := make([]string, len(versions))
+		for i, v := range versions {
+			names[i] = v.Name
+		}
+		ver, err = ResolveVersion(names, reqVars["version"])
+		return err == nil, err
+	})
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	SendResponse(w, r, lv)
+	SendResponse(w, r, SimpleEntry{Name: ver, NameSpace: ns})
 }
 
 func reqToFilter(req map[string]string) map[string]interface{} {
@@ -85,52 +115,45 @@ func reqToFilter(req map[string]string) map[string]interface{} {
 	return filter
 }
 
-func HandleListFiles(w http.ResponseWriter, r *http.Request) {
+// chainFiles returns the files matching the request from the first
+// namespace of its chain which has any
+func (c *DepMan) chainFiles(w http.ResponseWriter, r *http.Request) (Files, error) {
+	var files Files
+	_, err := c.findInChain(w, r, func(ns string) (bool, error) {
+		filter := reqToFilter(mux.Vars(r))
+		filter["ns"] = ns
+
+		var err error
+		files, err = c.GetFilesByFilter(filter, true)
+		return len(files) > 0, err
+	})
+	return files, err
+}
+
+func (c *DepMan) HandleListFiles(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "List Files")
 
-	files, err := GetFilesByFilter(reqToFilter(reqVars), true)
-
-	switch {
-	case err != nil && err == ErrNotFound:
-		fallthrough
-	case err == nil && len(files) == 0:
-		log.Debugf("No files found - try default namespace %s", DefaultNS)
-		reqVars["ns"] = DefaultNS
-		files, err = GetFilesByFilter(reqToFilter(reqVars), true)
-
-		if err != nil {
-			SendErrorResponse(w, r, err)
-			return
-		}
-	case err != nil:
+	files, err := c.chainFiles(w, r)
+	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	if len(files) == 0 {
-		SendErrorResponse(w, r, ErrNotFound)
-	} else {
-		SendResponse(w, r, files)
-	}
+	SendResponse(w, r, files)
 }
 
-func HandleGetFileLinks(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleGetFileLinks(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "Get Links")
 
-	files, err := GetFilesByFilter(reqToFilter(reqVars), true)
+	files, err := c.chainFiles(w, r)
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	if len(files) == 0 {
-		SendErrorResponse(w, r, ErrNotFound)
-		return
-	}
-
-	links, err := files[0].GetLinks()
+	links, err := c.Store.GetFileLinks(files[0].Id)
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
@@ -140,13 +163,13 @@ func HandleGetFileLinks(w http.ResponseWriter, r *http.Request) {
 	SendResponse(w, r, links)
 }
 
-func HandlePutLink(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandlePutLink(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "Add Link")
 
 	linkname := reqVars["linkname"]
 	delete(reqVars, "linkname")
-	files, err := GetFilesByFilter(reqToFilter(reqVars), false)
+	files, err := c.GetFilesByFilter(reqToFilter(reqVars), false)
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
@@ -158,122 +181,156 @@ func HandlePutLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	links, err := files[0].GetLinks()
+	file := files[0]
+	links, err := c.Store.GetFileLinks(file.Id)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
 
-	for _, link := range links {
-		if link.Name == linkname {
-			log.Debugf("File link already exists - not creating")
+	if links.contains(linkname) {
+		log.Debugf("File link already exists - not creating")
 
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprint(w, "Stored")
-			return
-		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Stored")
+		return
+	}
+
+	forced, err := c.authorizeAddition(r, file.NameSpace, file.Library, file.Version)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
 	}
 
 	fl := &FileLink{}
-	fl.FileId = files[0].Id
+	fl.FileId = file.Id
 	fl.Name = linkname
-	err = fl.Store()
+	err = c.Store.StoreFileLink(fl)
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
+	if forced {
+		c.audit(r, "force-upload", file.NameSpace, fmt.Sprintf("%s/%s/%s", file.Library, file.Version, file.ToString()),
+			fmt.Sprintf("Added link %s to published file", linkname))
+	}
+
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Stored")
 }
 
-func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "File Upload")
 
-	files, err := GetFilesByFilter(reqToFilter(reqVars), false)
-
-	var file File
-
-	switch {
-	case err != nil:
+	files, err := c.GetFilesByFilter(reqToFilter(reqVars), false)
+	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
-	case len(files) == 0:
-		// Create the file in the database
-		log.Debug("File not found, storing")
+	}
+
+	// New files are only stored once their contents are, so a failed
+	// upload leaves no row without contents behind
+	var file File
+	if len(files) == 0 {
+		log.Debug("File not found, creating")
 		file = NewFileFromVars(reqVars)
-		err = file.Store()
-		if err != nil {
-			SendErrorResponse(w, r, err)
-			return
-		}
-	default:
+	} else {
 		log.Debugf("Found file: %d", files[0].Id)
 		file = files[0]
 	}
 
-	log.Infof("Storing file at %s", file.FilePath())
+	if file.Checksum != "" && r.Header.Get(ChecksumHeader) == file.Checksum {
+		log.Debugf("File %d already has contents %s", file.Id, file.Checksum)
+		w.Header().Set(ChecksumHeader, file.Checksum)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Unchanged")
+		return
+	}
 
-	_, err = os.Stat(file.FilePath())
-	if err == nil {
-		log.Debug("File exists - removing")
-		os.Remove(file.FilePath())
+	// Adding files to a published version changes it as much as
+	// replacing one of its files
+	forced := false
+	if file.Id == 0 {
+		forced, err = c.authorizeAddition(r, file.NameSpace, file.Library, file.Version)
+	} else if c.isPublished(file.Created, file.Checksum, file.LegacyBlobKey()) {
+		forced, err = true, c.authorizeOverwrite(r)
+	}
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
 	}
+	added := file.Id == 0
 
-	err = os.MkdirAll(filepath.Dir(file.FilePath()), 0700)
+	checksum, size, err := c.storeContent(r.Body, r.ContentLength, r.Header.Get(ChecksumHeader))
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
+	log.Infof("Stored %d bytes as %s", size, ContentKey(checksum))
 
-	localfile, err := os.OpenFile(file.FilePath(), os.O_WRONLY|os.O_CREATE, 0600)
+	previous := file.Checksum
+	file.Checksum = checksum
+	file.Size = size
+	if file.Id == 0 {
+		err = c.Store.StoreFile(&file)
+	} else {
+		// Fails if another upload replaced the contents meanwhile,
+		// which would otherwise release previous twice
+		err = c.Store.ReplaceFileContent(&file, previous)
+	}
 	if err != nil {
+		// Nothing refers to the new contents
+		c.releaseContent(checksum)
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	for {
-		buffer := make([]byte, 4096)
-		len, err := r.Body.Read(buffer)
-		if err != nil && err != io.EOF {
-			SendErrorResponse(w, r, err)
-			return
-		}
-		if len == 0 {
-			// Nothing more to read
-			log.Debug("Finished reading")
-			break
-		}
-		log.Debugf("Read %d bytes from request body", len)
-		_ = bytes.Trim(buffer, "\x00")
-		len_w, err := localfile.Write(buffer[:len])
-		if err != nil {
-			SendErrorResponse(w, r, err)
-			return
+	if previous == "" {
+		// Replaces a file from before content addressing
+		c.Blobs.Delete(file.LegacyBlobKey())
+	} else if err = c.releaseContent(previous); err != nil {
+		log.Errorf("Cannot release previous content %s: %s", previous, err)
+	}
+
+	if forced {
+		detail := fmt.Sprintf("Overwrote published contents %s with %s", describeContent(previous), checksum)
+		if added {
+			detail = fmt.Sprintf("Added to published version with %s", checksum)
 		}
-		log.Debugf("Wrote %d bytes to file", len_w)
+		c.audit(r, "force-upload", file.NameSpace, fmt.Sprintf("%s/%s/%s", file.Library, file.Version, file.ToString()), detail)
 	}
+
+	w.Header().Set(ChecksumHeader, file.Checksum)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Stored")
 }
 
-func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleFileDownload(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
 	logRequest(reqVars, "File Download")
 
-	files, err := GetFilesByFilter(reqToFilter(reqVars), true)
+	files, err := c.chainFiles(w, r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
 
-	switch {
-	case err != nil && err == ErrNotFound:
-		fallthrough
-	case err == nil && len(files) == 0:
-		log.Debugf("No files found - try default namespace %s", DefaultNS)
-		reqVars["ns"] = DefaultNS
-		files, err = GetFilesByFilter(reqToFilter(reqVars), true)
+	file := files[0]
+	c.serveStored(w, r, file.Checksum, file.Size, file.LastModified(), file.BlobKey(), file.LegacyBlobKey())
+}
 
-		if err != nil {
-			SendErrorResponse(w, r, err)
-			return
-		}
-	case err != nil:
+// HandleDeleteFiles deletes everything matching the request: a single
+// file, all files of a library version or all files of a library in the
+// namespace. Versions are matched exactly.
+func (c *DepMan) HandleDeleteFiles(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Delete Files")
+
+	files, err := c.GetFilesByFilter(reqToFilter(reqVars), false)
+	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
@@ -283,48 +340,68 @@ func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file := files[0]
-	fh, err := os.Open(file.FilePath())
+	if err = c.DeleteFiles(files); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, files)
+}
+
+func (c *DepMan) HandleDeleteLink(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Delete Link")
+
+	linkname := reqVars["linkname"]
+	delete(reqVars, "linkname")
+	files, err := c.GetFilesByFilter(reqToFilter(reqVars), false)
+
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	buffer := make([]byte, 4096)
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	for {
-		len, err := fh.Read(buffer)
-		if err != nil && err != io.EOF {
-			SendErrorResponse(w, r, err)
-			return
-		}
-		if len == 0 {
-			// Nothing more to read
-			log.Debug("Finished reading")
-			break
-		}
-		log.Debugf("Read %d bytes from disk", len)
-		len_w, err := w.Write(buffer[:len])
-		if len_w != len {
-			SendErrorResponse(w, r, errors.New(fmt.Sprintf("Only wrote %d bytes, but should have written %d", len_w, len)))
-			return
-		}
-		if err != nil {
-			SendErrorResponse(w, r, err)
+	if len(files) == 0 {
+		SendErrorResponse(w, r, ErrNotFound)
+		return
+	}
+
+	for _, link := range files[0].Links {
+		if link.Name == linkname {
+			if err = c.Store.DeleteFileLink(link.Id); err != nil {
+				SendErrorResponse(w, r, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "Deleted")
 			return
 		}
-		log.Debugf("Wrote %d bytes to http response", len_w)
 	}
+
+	SendErrorResponse(w, r, ErrNotFound)
 }
 
-func HandlePutFile(w http.ResponseWriter, r *http.Request) {
-	reqVars := mux.Vars(r)
-	logRequest(reqVars, "File Store")
+// chainExtraFile returns the extra file matching the request from the
+// first namespace of its chain which has it
+func (c *DepMan) chainExtraFile(w http.ResponseWriter, r *http.Request) (ExtraFile, error) {
+	var file ExtraFile
+	_, err := c.findInChain(w, r, func(ns string) (bool, error) {
+		filter := reqToFilter(mux.Vars(r))
+		filter["ns"] = ns
+
+		var err error
+		file, err = c.GetExtraFileByFilter(filter)
+		return err == nil, err
+	})
+	return file, err
+}
 
-	file := NewFileFromVars(reqVars)
+func (c *DepMan) HandleGetExtraFile(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Get Extrafile")
 
-	err := file.Store()
+	file, err := c.chainExtraFile(w, r)
 
 	if err != nil {
 		SendErrorResponse(w, r, err)
@@ -334,107 +411,336 @@ func HandlePutFile(w http.ResponseWriter, r *http.Request) {
 	SendResponse(w, r, file)
 }
 
-func HandleGetExtraFile(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleDownloadExtraFile(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
-	logRequest(reqVars, "Get Extrafile")
-
-	file, err := GetExtraFileByFilter(reqToFilter(reqVars))
+	logRequest(reqVars, "Download Extrafile")
 
+	file, err := c.chainExtraFile(w, r)
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	SendResponse(w, r, file)
+	c.serveStored(w, r, file.Checksum, file.Size, file.LastModified(), file.BlobKey(), file.LegacyBlobKey())
 }
 
-func HandleDownloadExtraFile(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleUploadExtraFile(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
-	logRequest(reqVars, "Download Extrafile")
+	logRequest(reqVars, "Upload Extrafile")
 
-	file, err := GetExtraFileByFilter(reqToFilter(reqVars))
+	file, err := c.Store.GetExtraFile(reqToFilter(reqVars))
+
+	// New files are only stored once their contents are
 	switch {
 	case err != nil && err == ErrNotFound:
-		log.Debugf("No files found - try default namespace %s", DefaultNS)
-		reqVars["ns"] = DefaultNS
-		file, err = GetExtraFileByFilter(reqToFilter(reqVars))
+		log.Debug("File not found, creating")
+		file = NewExtraFileFromVars(reqVars)
+	case err != nil:
+		SendErrorResponse(w, r, err)
+		return
+	default:
+		log.Debugf("Found file: %d", file.Id)
+	}
 
-		if err != nil {
+	if file.Checksum != "" && r.Header.Get(ChecksumHeader) == file.Checksum {
+		log.Debugf("Extra file %d already has contents %s", file.Id, file.Checksum)
+		w.Header().Set(ChecksumHeader, file.Checksum)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Unchanged")
+		return
+	}
+
+	forced := false
+	if file.Id != 0 && c.isPublished(file.Created, file.Checksum, file.LegacyBlobKey()) {
+		if err = c.authorizeOverwrite(r); err != nil {
 			SendErrorResponse(w, r, err)
 			return
 		}
-	case err != nil:
+		forced = true
+	}
+
+	checksum, size, err := c.storeContent(r.Body, r.ContentLength, r.Header.Get(ChecksumHeader))
+	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
+	log.Infof("Stored %d bytes as %s", size, ContentKey(checksum))
 
-	fh, err := os.Open(file.FilePath())
-	defer fh.Close()
+	previous := file.Checksum
+	file.Checksum = checksum
+	file.Size = size
+	if file.Id == 0 {
+		err = c.Store.StoreExtraFile(&file)
+	} else {
+		// Fails if another upload replaced the contents meanwhile,
+		// which would otherwise release previous twice
+		err = c.Store.ReplaceExtraFileContent(&file, previous)
+	}
+	if err != nil {
+		// Nothing refers to the new contents
+		c.releaseContent(checksum)
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if previous == "" {
+		// Replaces a file from before content addressing
+		c.Blobs.Delete(file.LegacyBlobKey())
+	} else if err = c.releaseContent(previous); err != nil {
+		log.Errorf("Cannot release previous content %s: %s", previous, err)
+	}
+
+	if forced {
+		c.audit(r, "force-upload", file.NameSpace, fmt.Sprintf("extra/%s/%s", file.Name, file.Version),
+			fmt.Sprintf("Overwrote published contents %s with %s", describeContent(previous), checksum))
+	}
+
+	w.Header().Set(ChecksumHeader, file.Checksum)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Stored")
+}
+
+func (c *DepMan) HandleCollectGarbage(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	deleteMissing, _ := strconv.ParseBool(r.URL.Query().Get("delete_missing"))
+	log.WithFields(log.Fields{"dry_run": dryRun, "delete_missing": deleteMissing}).Info("Collect garbage")
+
+	report, err := c.CollectGarbage(dryRun, deleteMissing)
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	written, err := io.Copy(w, fh)
+	SendResponse(w, r, report)
+}
+
+// HandleListAudit returns the audit trail, optionally filtered by the ns
+// and action query parameters.
+func (c *DepMan) HandleListAudit(w http.ResponseWriter, r *http.Request) {
+	filter := make(map[string]interface{})
+	for _, key := range []string{"ns", "action"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filter[key] = v
+		}
+	}
 
+	entries, err := c.Store.GetAuditEntries(filter)
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
-	log.Debugf("Wrote %d bytes", written)
+
+	SendResponse(w, r, entries)
 }
 
-func HandleUploadExtraFile(w http.ResponseWriter, r *http.Request) {
+func (c *DepMan) HandleGetDependencies(w http.ResponseWriter, r *http.Request) {
 	reqVars := mux.Vars(r)
-	logRequest(reqVars, "Upload Extrafile")
+	logRequest(reqVars, "Get Dependencies")
 
-	file, err := GetExtraFileByFilter(reqToFilter(reqVars))
+	var deps Dependencies
+	_, err := c.findInChain(w, r, func(ns string) (bool, error) {
+		filter := reqToFilter(reqVars)
+		filter["ns"] = ns
 
+		var err error
+		deps, err = c.Store.GetDependencies(filter)
+		return len(deps) > 0, err
+	})
 	switch {
-	case err != nil && err == ErrNotFound:
-		// Create the file in the database
-		log.Debug("File not found, storing")
-		file = NewExtraFileFromVars(reqVars)
-		err = file.Store()
+	case err == ErrNotFound:
+		// Declaring none is no error
+		deps = Dependencies{}
+	case err != nil:
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, deps)
+}
+
+// HandlePutDependencies replaces the dependencies of a library version
+// with the JSON list in the body. Once the version is published they can
+// only be changed with force, like its files.
+func (c *DepMan) HandlePutDependencies(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Put Dependencies")
+
+	deps := Dependencies{}
+	if err := json.NewDecoder(r.Body).Decode(&deps); err != nil {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot parse dependencies: %s", err)))
+		return
+	}
+
+	ns, library, version := reqVars["ns"], reqVars["library"], reqVars["version"]
+	for idx := range deps {
+		deps[idx].Library = library
+		if err := deps[idx].validate(); err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	existing, err := c.Store.GetDependencies(reqToFilter(reqVars))
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	forced := false
+	if len(existing) > 0 {
+		if sameDependencies(existing, deps) {
+			SendResponse(w, r, existing)
+			return
+		}
+
+		published, err := c.versionPublished(ns, library, version)
 		if err != nil {
 			SendErrorResponse(w, r, err)
 			return
 		}
-	case err != nil:
+		if published {
+			if err = c.authorizeOverwrite(r); err != nil {
+				SendErrorResponse(w, r, err)
+				return
+			}
+			forced = true
+		}
+	}
+
+	if err = c.SetDependencies(ns, library, version, deps); err != nil {
 		SendErrorResponse(w, r, err)
 		return
-	default:
-		log.Debugf("Found file: %d", file.Id)
+	}
+	if forced {
+		c.audit(r, "force-dependencies", ns, fmt.Sprintf("%s/%s", library, version),
+			fmt.Sprintf("Replaced dependencies [%s] with [%s]",
+				strings.Replace(existing.ToString(), "\n", "; ", -1), strings.Replace(deps.ToString(), "\n", "; ", -1)))
 	}
 
-	log.Infof("Storing file at %s", file.FilePath())
+	SendResponse(w, r, deps)
+}
 
-	_, err = os.Stat(file.FilePath())
-	if err == nil {
-		log.Debug("File exists - removing")
-		os.Remove(file.FilePath())
+// HandleResolveLibrary returns the dependency closure of one library
+// version; the wanted query parameter selects its file types.
+func (c *DepMan) HandleResolveLibrary(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Resolve Library")
+
+	req := Requirement{
+		Library:    reqVars["library"],
+		Constraint: reqVars["version"],
+		Wanted:     r.URL.Query().Get("wanted"),
+	}
+	chain, err := c.lookupChain(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	resolution, err := c.ResolveDependencies(chain, reqVars["platform"], reqVars["arch"], []Requirement{req})
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, resolution)
+}
+
+// HandleResolve returns the dependency closure of the JSON list of
+// requirements in the body, resolved together so conflicts between them
+// are found.
+func (c *DepMan) HandleResolve(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Resolve")
+
+	reqs := []Requirement{}
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot parse requirements: %s", err)))
+		return
 	}
 
-	err = os.MkdirAll(filepath.Dir(file.FilePath()), 0700)
+	chain, err := c.lookupChain(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	resolution, err := c.ResolveDependencies(chain, reqVars["platform"], reqVars["arch"], reqs)
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	localfile, err := os.OpenFile(file.FilePath(), os.O_WRONLY|os.O_CREATE, 0600)
-	defer localfile.Close()
+	SendResponse(w, r, resolution)
+}
+
+func (c *DepMan) HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := c.Store.GetTokens()
 	if err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
 
-	written, err := io.Copy(localfile, r.Body)
+	SendResponse(w, r, tokens)
+}
+
+// HandleCreateToken creates a token from a JSON body such as
+// {"name": "ci", "grants": [{"ns": "team-a", "level": "write"}]}.
+// The response carries the secret, which cannot be retrieved later.
+func (c *DepMan) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name   string  `json:"name"`
+		Grants []Grant `json:"grants"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot parse token request: %s", err)))
+		return
+	}
+
+	issued, err := NewToken(req.Name, req.Grants)
+	if err != nil {
+		SendErrorResponse(w, r, BadRequestError(err.Error()))
+		return
+	}
+
+	if err = c.Store.StoreToken(&issued.Token); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	c.audit(r, "token-create", AllNamespaces, fmt.Sprintf("token/%d", issued.Id), issued.ToString())
+
+	SendResponse(w, r, issued)
+}
+
+func (c *DepMan) HandleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	tokenId, err := strconv.Atoi(mux.Vars(r)["token_id"])
 	if err != nil {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Invalid token id: %s", mux.Vars(r)["token_id"])))
+		return
+	}
+
+	if err = c.Store.DeleteToken(tokenId); err != nil {
 		SendErrorResponse(w, r, err)
 		return
 	}
-	log.Debugf("Wrote %d bytes", written)
+	c.audit(r, "token-delete", AllNamespaces, fmt.Sprintf("token/%d", tokenId), "Deleted token")
+
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Stored")
+	fmt.Fprint(w, "Deleted")
+}
+
+func (c *DepMan) HandleDeleteExtraFile(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Delete Extrafile")
+
+	file, err := c.Store.GetExtraFile(reqToFilter(reqVars))
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if err = c.DeleteExtraFile(file); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, file)
 }
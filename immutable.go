@@ -0,0 +1,59 @@
+package depman
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// isPublished reports whether contents created at created have been
+// published and therefore may not be changed anymore. Rows which were
+// created but never received any contents are not published.
+func (c *DepMan) isPublished(created time.Time, checksum string, legacyKey string) bool {
+	if c.Config.Publish.AllowOverwrite {
+		return false
+	}
+
+	if checksum == "" {
+		if _, err := c.Blobs.Stat(legacyKey); err == ErrNotFound {
+			return false
+		}
+	}
+
+	return time.Since(created) >= c.Config.Publish.GracePeriod.Duration
+}
+
+// authorizeOverwrite decides whether r may replace published contents.
+// That takes ?force=true and admin permission on the namespace; without
+// force the contents are immutable.
+func (c *DepMan) authorizeOverwrite(r *http.Request) error {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	switch {
+	case !force:
+		return ErrImmutable
+	case !requestIdentity(r).Allowed(mux.Vars(r)["ns"], PermAdmin):
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorizeAddition decides whether r may add files or links to the
+// library version ns/library/version. Once the version is published that
+// takes the same as replacing published contents. It reports whether
+// the addition is forced.
+func (c *DepMan) authorizeAddition(r *http.Request, ns string, library string, version string) (bool, error) {
+	published, err := c.versionPublished(ns, library, version)
+	if err != nil || !published {
+		return false, err
+	}
+	return true, c.authorizeOverwrite(r)
+}
+
+// describeContent names contents for the audit trail
+func describeContent(checksum string) string {
+	if checksum == "" {
+		return "(legacy, no checksum)"
+	}
+	return checksum
+}
@@ -0,0 +1,163 @@
+package depman
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImmutableVersions(t *testing.T) {
+	const (
+		file    = "/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.so.1"
+		newFile = "/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a"
+		link    = file + "/links/libfoo.so"
+	)
+
+	// Each step runs with the permission of anonymous requests. With
+	// checksum set, the body is declared by its checksum as the CLI does.
+	// {session} is a publish session of foo 1.0 for el7/x86_64.
+	type step struct {
+		perm, method, path, body string
+		checksum                 bool
+		code                     int
+	}
+	tests := []struct {
+		desc  string
+		steps []step
+		// Audited forced changes as "object: first word of the detail"
+		audit []string
+	}{
+		{
+			desc: "replacing published contents",
+			steps: []step{
+				{"write", "PUT", file + "/upload", "new", false, http.StatusConflict},
+				{"admin", "PUT", file + "/upload", "new", false, http.StatusConflict},
+				{"write", "PUT", file + "/upload?force=true", "new", false, http.StatusForbidden},
+				{"write", "PUT", file + "/upload", "so", true, http.StatusOK},
+				{"admin", "PUT", file + "/upload?force=true", "new", false, http.StatusOK},
+			},
+			audit: []string{"foo/1.0/el7/x86_64/lib/libfoo.so.1: Overwrote"},
+		},
+		{
+			desc: "adding a file to a published version",
+			steps: []step{
+				{"write", "PUT", newFile + "/upload", "a", false, http.StatusConflict},
+				{"admin", "PUT", newFile + "/upload", "a", false, http.StatusConflict},
+				{"write", "PUT", newFile + "/upload?force=true", "a", false, http.StatusForbidden},
+				{"admin", "PUT", newFile + "/upload?force=true", "a", false, http.StatusOK},
+			},
+			audit: []string{"foo/1.0/el7/x86_64/lib/libfoo.a: Added"},
+		},
+		{
+			desc: "adding a file to an unpublished version",
+			steps: []step{
+				{"write", "PUT", "/v1/default/lib/foo/versions/2.0/files/el7/x86_64/lib/libfoo.a/upload", "a", false, http.StatusOK},
+			},
+		},
+		{
+			desc: "adding a link to a published file",
+			steps: []step{
+				{"write", "PUT", link, "", false, http.StatusConflict},
+				{"write", "PUT", link + "?force=true", "", false, http.StatusForbidden},
+				{"admin", "PUT", link + "?force=true", "", false, http.StatusOK},
+				// Existing links are no change
+				{"write", "PUT", link, "", false, http.StatusOK},
+			},
+			audit: []string{"foo/1.0/el7/x86_64/lib/libfoo.so.1: Added"},
+		},
+		{
+			desc: "adding a file in a publish session",
+			steps: []step{
+				{"write", "PUT", "{session}/files/lib/libfoo.a", "a", false, http.StatusConflict},
+				{"write", "PUT", "{session}/files/lib/libfoo.a?force=true", "a", false, http.StatusForbidden},
+				{"admin", "PUT", "{session}/files/lib/libfoo.a?force=true", "a", false, http.StatusOK},
+				{"admin", "POST", "{session}/commit", "", false, http.StatusConflict},
+				{"write", "POST", "{session}/commit?force=true", "", false, http.StatusForbidden},
+				{"admin", "POST", "{session}/commit?force=true", "", false, http.StatusOK},
+			},
+			audit: []string{"foo/1.0/el7/x86_64/lib/libfoo.a: Added"},
+		},
+		{
+			desc: "adding a link in a publish session",
+			steps: []step{
+				// The same contents again need no force
+				{"write", "PUT", "{session}/files/lib/libfoo.so.1", "so", true, http.StatusOK},
+				{"write", "PUT", "{session}/files/lib/libfoo.so.1/links/libfoo.so", "", false, http.StatusConflict},
+				{"write", "PUT", "{session}/files/lib/libfoo.so.1/links/libfoo.so?force=true", "", false, http.StatusForbidden},
+				{"admin", "PUT", "{session}/files/lib/libfoo.so.1/links/libfoo.so?force=true", "", false, http.StatusOK},
+				{"admin", "POST", "{session}/commit", "", false, http.StatusConflict},
+				{"admin", "POST", "{session}/commit?force=true", "", false, http.StatusOK},
+			},
+			audit: []string{"foo/1.0/el7/x86_64/lib/libfoo.so.1: Added"},
+		},
+		{
+			desc: "republishing the same contents in a session",
+			steps: []step{
+				{"write", "PUT", "{session}/files/lib/libfoo.so.1", "so", true, http.StatusOK},
+				{"write", "POST", "{session}/commit", "", false, http.StatusOK},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c, cleanup := newTestDepMan(t)
+		server := httptest.NewServer(c.NewRouter())
+
+		checksum, size, err := c.storeContent(strings.NewReader("so"), -1, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		published := newTestFile("libfoo.so.1")
+		published.Checksum, published.Size = checksum, size
+		if err = c.Store.StoreFile(published); err != nil {
+			t.Fatal(err)
+		}
+
+		session := ""
+		for _, s := range test.steps {
+			c.Config.Auth.Anonymous = s.perm
+			path := s.path
+			if strings.HasPrefix(path, "{session}") {
+				if session == "" {
+					session = strings.TrimPrefix(openTestSession(t, server.URL), server.URL)
+				}
+				path = strings.Replace(path, "{session}", session, 1)
+			}
+			headers := map[string]string{}
+			if s.checksum {
+				headers[ChecksumHeader] = testChecksum(s.body)
+			}
+			if code, body := testRequestHeaders(t, s.method, server.URL+path, s.body, headers); code != s.code {
+				t.Errorf("%s: %s %s as %s: %d %s, want %d", test.desc, s.method, s.path, s.perm, code, body, s.code)
+			}
+		}
+
+		entries, err := c.Store.GetAuditEntries(map[string]interface{}{"action": "force-upload"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit := []string{}
+		for _, entry := range entries {
+			audit = append(audit, entry.Object+": "+strings.Fields(entry.Detail)[0])
+		}
+		sort.Strings(audit)
+		if len(audit) != 0 || len(test.audit) != 0 {
+			if !reflect.DeepEqual(audit, test.audit) {
+				t.Errorf("%s: audited %v, want %v", test.desc, audit, test.audit)
+			}
+		}
+
+		server.Close()
+		cleanup()
+	}
+}
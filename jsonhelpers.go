@@ -28,6 +28,20 @@ func SendErrorResponse(w http.ResponseWriter, r *http.Request, err_resp error) {
 		fallthrough
 	case os.IsNotExist(err_resp):
 		code = http.StatusNotFound
+	case err_resp == ErrImmutable, err_resp == ErrContentChanged:
+		code = http.StatusConflict
+	case err_resp == ErrLocked:
+		code = http.StatusLocked
+	case err_resp == ErrForbidden:
+		code = http.StatusForbidden
+	case err_resp == ErrUnauthorized:
+		code = http.StatusUnauthorized
+	case isBadRequest(err_resp):
+		code = http.StatusBadRequest
+	case isConflict(err_resp):
+		code = http.StatusConflict
+	case err_resp == errRangeNotSatisfiable:
+		code = http.StatusRequestedRangeNotSatisfiable
 	default:
 		code = http.StatusInternalServerError
 	}
@@ -57,6 +71,16 @@ func SendErrorResponse(w http.ResponseWriter, r *http.Request, err_resp error) {
 	}
 }
 
+func isBadRequest(err error) bool {
+	_, ok := err.(BadRequestError)
+	return ok
+}
+
+func isConflict(err error) bool {
+	_, ok := err.(ConflictError)
+	return ok
+}
+
 func SendTEXTResponse(w http.ResponseWriter, code int, resp string) {
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 	w.WriteHeader(code)
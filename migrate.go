@@ -0,0 +1,143 @@
+package depman
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+)
+
+// MigrationReport summarizes a MigrateBlobs run
+type MigrationReport struct {
+	Migrated     int   `json:"migrated"`
+	Deduplicated int   `json:"deduplicated"`
+	Missing      int   `json:"missing"`
+	Failed       int   `json:"failed"`
+	BytesBefore  int64 `json:"bytes_before"`
+	BytesAfter   int64 `json:"bytes_after"`
+}
+
+// MigrateBlobs converts files and extra files stored at their legacy
+// ns/library/version/... keys into the content addressed layout: every
+// content is stored once under ContentKey, rows get their checksum and
+// size, and the legacy copy is removed. Rows which already point to an
+// existing content blob are left alone, so the migration can be re-run
+// after an interruption.
+func (c *DepMan) MigrateBlobs(dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{}
+	seen := make(map[string]bool)
+
+	files, err := c.Store.GetFiles(map[string]interface{}{})
+	if err != nil {
+		return report, err
+	}
+
+	for idx := range files {
+		f := &files[idx]
+		checksum, size, ok := c.migrateBlob(f.Checksum, f.LegacyBlobKey(), dryRun, &report)
+		if !ok {
+			continue
+		}
+		c.countMigrated(checksum, size, seen, &report)
+		if dryRun {
+			continue
+		}
+		f.Checksum = checksum
+		f.Size = size
+		if err = c.Store.StoreFile(f); err != nil {
+			return report, err
+		}
+		c.Blobs.Delete(f.LegacyBlobKey())
+	}
+
+	extrafiles, err := c.Store.GetExtraFiles(map[string]interface{}{})
+	if err != nil {
+		return report, err
+	}
+
+	for idx := range extrafiles {
+		f := &extrafiles[idx]
+		checksum, size, ok := c.migrateBlob(f.Checksum, f.LegacyBlobKey(), dryRun, &report)
+		if !ok {
+			continue
+		}
+		c.countMigrated(checksum, size, seen, &report)
+		if dryRun {
+			continue
+		}
+		f.Checksum = checksum
+		f.Size = size
+		if err = c.Store.StoreExtraFile(f); err != nil {
+			return report, err
+		}
+		c.Blobs.Delete(f.LegacyBlobKey())
+	}
+
+	log.WithFields(log.Fields{
+		"migrated":     report.Migrated,
+		"deduplicated": report.Deduplicated,
+		"missing":      report.Missing,
+		"failed":       report.Failed,
+		"bytes_before": report.BytesBefore,
+		"bytes_after":  report.BytesAfter,
+		"dry_run":      dryRun,
+	}).Info("Blob migration finished")
+
+	return report, nil
+}
+
+// migrateBlob moves the contents at legacyKey into the content store and
+// returns their checksum and size. ok is false if there is nothing to do
+// or the contents cannot be read.
+func (c *DepMan) migrateBlob(checksum string, legacyKey string, dryRun bool, report *MigrationReport) (string, int64, bool) {
+	if checksum != "" {
+		if _, err := c.Blobs.Stat(ContentKey(checksum)); err == nil {
+			log.Debugf("%s already content addressed", legacyKey)
+			return "", 0, false
+		}
+	}
+
+	fh, err := c.Blobs.Get(legacyKey)
+	switch {
+	case err == ErrNotFound:
+		log.Warnf("No contents stored for %s", legacyKey)
+		report.Missing++
+		return "", 0, false
+	case err != nil:
+		log.Errorf("Cannot read %s: %s", legacyKey, err)
+		report.Failed++
+		return "", 0, false
+	}
+	defer fh.Close()
+
+	if dryRun {
+		body := newHashingReader(fh)
+		if _, err = io.Copy(ioutil.Discard, body); err != nil {
+			log.Errorf("Cannot read %s: %s", legacyKey, err)
+			report.Failed++
+			return "", 0, false
+		}
+		log.Infof("Would migrate %s to %s", legacyKey, ContentKey(body.Checksum()))
+		return body.Checksum(), body.Size(), true
+	}
+
+	checksum, size, err := c.storeContent(fh, -1, "")
+	if err != nil {
+		log.Errorf("Cannot migrate %s: %s", legacyKey, err)
+		report.Failed++
+		return "", 0, false
+	}
+	log.Infof("Migrated %s to %s", legacyKey, ContentKey(checksum))
+
+	return checksum, size, true
+}
+
+func (c *DepMan) countMigrated(checksum string, size int64, seen map[string]bool, report *MigrationReport) {
+	report.Migrated++
+	report.BytesBefore += size
+	if seen[checksum] {
+		report.Deduplicated++
+		return
+	}
+	seen[checksum] = true
+	report.BytesAfter += size
+}
@@ -0,0 +1,532 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NamespaceHeader names the namespace a lookup was answered from, which
+// may be any namespace of the chain of the one in the URL
+const NamespaceHeader = "X-Depman-Namespace"
+
+// Namespace is the record of a namespace. Lookups which find nothing in
+// a namespace continue in its parent, the parent's parent and so on, and
+// finally in the default namespace. Namespaces without a record have the
+// default namespace as their only parent. Locked namespaces are read-only.
+type Namespace struct {
+	Name    string    `json:"ns"`
+	Parent  string    `json:"parent"`
+	Locked  bool      `json:"locked"`
+	Created time.Time `json:"created"`
+	// Chain is the order lookups search namespaces in, starting with
+	// this one, and Usage what the namespace holds. Both are filled in
+	// for responses only.
+	Chain []string        `json:"chain,omitempty"`
+	Usage *NamespaceUsage `json:"usage,omitempty"`
+}
+
+// NamespaceUsage sums up the contents of a namespace. Size counts every
+// file in full, although identical contents are only stored once.
+type NamespaceUsage struct {
+	Libraries    int       `json:"libraries"`
+	Versions     int       `json:"versions"`
+	Files        int       `json:"files"`
+	ExtraFiles   int       `json:"extra_files"`
+	Size         int64     `json:"size"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+type Namespaces []Namespace
+
+func (n Namespace) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(n)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (n Namespace) ToString() string {
+	desc := n.Name
+	switch {
+	case len(n.Chain) > 0:
+		desc = strings.Join(n.Chain, " -> ")
+	case n.Parent != "":
+		desc = fmt.Sprintf("%s -> %s", n.Name, n.Parent)
+	}
+	if n.Locked {
+		desc += " (locked)"
+	}
+	if n.Usage != nil {
+		desc += ": " + n.Usage.ToString()
+	}
+	return desc
+}
+
+func (u NamespaceUsage) ToString() string {
+	desc := fmt.Sprintf("%d libraries, %d versions, %d files, %d extra files, %d bytes",
+		u.Libraries, u.Versions, u.Files, u.ExtraFiles, u.Size)
+	if !u.LastActivity.IsZero() {
+		desc += ", last activity " + u.LastActivity.Format(time.RFC3339)
+	}
+	return desc
+}
+
+// touch records activity at t
+func (u *NamespaceUsage) touch(t time.Time) {
+	if t.After(u.LastActivity) {
+		u.LastActivity = t
+	}
+}
+
+func (n Namespaces) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(n)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (n Namespaces) ToString() string {
+	lines := make([]string, len(n))
+	for i, ns := range n {
+		lines[i] = ns.ToString()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NamespaceChain returns ns, its parents and the default namespace, in
+// the order lookups search them. A parent chain running in a circle is
+// cut where it comes back.
+func (c *DepMan) NamespaceChain(ns string) ([]string, error) {
+	chain := []string{}
+	seen := make(map[string]bool)
+	for name := ns; name != "" && !seen[name]; {
+		seen[name] = true
+		chain = append(chain, name)
+
+		record, err := c.Store.GetNamespace(name)
+		switch {
+		case err == ErrNotFound:
+			name = ""
+		case err != nil:
+			return chain, err
+		default:
+			name = record.Parent
+		}
+	}
+
+	if !seen[c.Config.DefaultNS] {
+		chain = append(chain, c.Config.DefaultNS)
+	}
+	return chain, nil
+}
+
+// lookupChain is the chain of the namespace in the request without the
+// namespaces the requester may not read, so a parent does not give away
+// what its children's readers should not see. The default namespace is
+// open to lookups from everywhere, as it always was.
+func (c *DepMan) lookupChain(r *http.Request) ([]string, error) {
+	ns := mux.Vars(r)["ns"]
+	chain, err := c.NamespaceChain(ns)
+	if err != nil {
+		return chain, err
+	}
+
+	id := requestIdentity(r)
+	readable := make([]string, 0, len(chain))
+	for _, name := range chain {
+		if name == ns || name == c.Config.DefaultNS || id.Allowed(name, PermRead) {
+			readable = append(readable, name)
+		} else {
+			log.Debugf("Skipping namespace %s: %s may not read it", name, id.Name)
+		}
+	}
+	return readable, nil
+}
+
+// findInChain calls find for the namespaces of the request's chain in
+// turn until one reports a hit, and names that namespace in the response
+// headers. ErrNotFound from find counts as a miss. Returns ErrNotFound if
+// no namespace had anything.
+func (c *DepMan) findInChain(w http.ResponseWriter, r *http.Request, find func(ns string) (bool, error)) (string, error) {
+	chain, err := c.lookupChain(r)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ns := range chain {
+		found, err := find(ns)
+		switch {
+		case err != nil && err != ErrNotFound:
+			return "", err
+		case found:
+			w.Header().Set(NamespaceHeader, ns)
+			return ns, nil
+		}
+		log.Debugf("Nothing found in namespace %s", ns)
+	}
+	return "", ErrNotFound
+}
+
+// chainEntries merges what list returns for each namespace of the
+// request's chain, every entry marked with the nearest namespace which
+// has it
+func (c *DepMan) chainEntries(r *http.Request, list func(ns string) (SimpleEntries, error)) (SimpleEntries, error) {
+	entries := SimpleEntries{}
+
+	chain, err := c.lookupChain(r)
+	if err != nil {
+		return entries, err
+	}
+
+	seen := make(map[string]bool)
+	for _, ns := range chain {
+		found, err := list(ns)
+		if err != nil {
+			return entries, err
+		}
+		for _, e := range found {
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				entries = append(entries, SimpleEntry{Name: e.Name, NameSpace: ns})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// getNamespace returns the record of ns, or what a namespace without
+// one is like
+func (c *DepMan) getNamespace(ns string) (Namespace, error) {
+	record, err := c.Store.GetNamespace(ns)
+	if err == ErrNotFound {
+		return Namespace{Name: ns}, nil
+	}
+	return record, err
+}
+
+// SetNamespaceParent creates or updates the record of namespace ns. An
+// empty parent leaves only the default namespace behind it.
+func (c *DepMan) SetNamespaceParent(ns string, parent string) (Namespace, error) {
+	if err := validNamespace(ns); err != nil {
+		return Namespace{}, err
+	}
+	record, err := c.getNamespace(ns)
+	if err != nil {
+		return record, err
+	}
+	record.Parent = parent
+
+	if parent != "" {
+		if err := validNamespace(parent); err != nil {
+			return record, err
+		}
+		chain, err := c.NamespaceChain(parent)
+		if err != nil {
+			return record, err
+		}
+		for _, name := range chain {
+			if name == ns {
+				return record, BadRequestError(fmt.Sprintf("Namespace %s would become its own parent: %s -> %s",
+					ns, ns, strings.Join(chain, " -> ")))
+			}
+		}
+	}
+
+	if err := c.Store.StoreNamespace(&record); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// DeleteNamespace removes everything in namespace ns and its record.
+// Namespaces with contents are only deleted with force; the default
+// namespace and parents of other namespaces not at all. Returns what
+// was deleted.
+func (c *DepMan) DeleteNamespace(ns string, force bool) (NamespaceUsage, error) {
+	usage := NamespaceUsage{}
+	if ns == c.Config.DefaultNS {
+		return usage, BadRequestError("The default namespace cannot be deleted")
+	}
+
+	records, err := c.Store.GetNamespaces()
+	if err != nil {
+		return usage, err
+	}
+	for _, n := range records {
+		if n.Parent == ns {
+			return usage, ConflictError(fmt.Sprintf("Namespace %s is the parent of %s", ns, n.Name))
+		}
+	}
+
+	all, err := c.Store.GetNamespaceUsage()
+	if err != nil {
+		return usage, err
+	}
+	usage = all[ns]
+	if usage.Files+usage.ExtraFiles > 0 && !force {
+		return usage, ConflictError(fmt.Sprintf("Namespace %s has %d files and %d extra files - delete them with force",
+			ns, usage.Files, usage.ExtraFiles))
+	}
+
+	// Nothing may be committed into it while it goes away
+	sessions, err := c.Store.GetPublishSessions()
+	if err != nil {
+		return usage, err
+	}
+	for _, session := range sessions {
+		if session.NameSpace == ns {
+			if err = c.abortPublishSession(session.Id); err != nil && err != ErrNotFound {
+				return usage, err
+			}
+		}
+	}
+
+	files, err := c.Store.GetFiles(map[string]interface{}{"ns": ns})
+	if err != nil {
+		return usage, err
+	}
+	if err = c.DeleteFiles(files); err != nil {
+		return usage, err
+	}
+
+	extras, err := c.Store.GetExtraFiles(map[string]interface{}{"ns": ns})
+	if err != nil {
+		return usage, err
+	}
+	for _, f := range extras {
+		if err = c.DeleteExtraFile(f); err != nil {
+			return usage, err
+		}
+	}
+
+	// Dependencies declared for versions without files
+	deps, err := c.Store.GetDependencies(map[string]interface{}{"ns": ns})
+	if err != nil {
+		return usage, err
+	}
+	done := make(map[string]bool)
+	for _, d := range deps {
+		if key := d.Library + "/" + d.Version; !done[key] {
+			done[key] = true
+			if err = c.Store.StoreDependencies(ns, d.Library, d.Version, nil); err != nil {
+				return usage, err
+			}
+		}
+	}
+
+	if err = c.Store.DeleteNamespace(ns); err != nil && err != ErrNotFound {
+		return usage, err
+	}
+	log.Infof("Deleted namespace %s: %s", ns, usage.ToString())
+	return usage, nil
+}
+
+// describeNamespace fills in the chain and usage of a namespace for a
+// response
+func (c *DepMan) describeNamespace(n *Namespace, usage map[string]NamespaceUsage) error {
+	var err error
+	if n.Chain, err = c.NamespaceChain(n.Name); err != nil {
+		return err
+	}
+	u := usage[n.Name]
+	n.Usage = &u
+	return nil
+}
+
+// validNamespace rejects names which cannot be used in URLs or grants
+func validNamespace(ns string) error {
+	switch {
+	case ns == "":
+		return BadRequestError("Namespace name missing")
+	case ns == AllNamespaces, strings.HasPrefix(ns, "_"), strings.ContainsAny(ns, "/?#% "):
+		return BadRequestError(fmt.Sprintf("Invalid namespace name: %s", ns))
+	}
+	return nil
+}
+
+// HandleListNamespaces lists every namespace with a record or contents
+func (c *DepMan) HandleListNamespaces(w http.ResponseWriter, r *http.Request) {
+	records, err := c.Store.GetNamespaces()
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	usage, err := c.Store.GetNamespaceUsage()
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	recorded := make(map[string]bool)
+	for _, n := range records {
+		recorded[n.Name] = true
+	}
+	for ns := range usage {
+		if !recorded[ns] {
+			records = append(records, Namespace{Name: ns})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+
+	for idx := range records {
+		if err = c.describeNamespace(&records[idx], usage); err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	SendResponse(w, r, records)
+}
+
+// HandleGetNamespace describes the namespace in the URL with its chain
+// and usage, whether it has a record or not
+func (c *DepMan) HandleGetNamespace(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Get Namespace")
+
+	record, err := c.getNamespace(reqVars["ns"])
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	usage, err := c.Store.GetNamespaceUsage()
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if err = c.describeNamespace(&record, usage); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, record)
+}
+
+// HandlePutNamespace creates the namespace in the URL or changes its
+// parent, from a JSON body like {"parent": "team"}
+func (c *DepMan) HandlePutNamespace(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Put Namespace")
+
+	req := struct {
+		Parent string `json:"parent"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot parse namespace: %s", err)))
+		return
+	}
+
+	record, err := c.SetNamespaceParent(reqVars["ns"], req.Parent)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	if record.Chain, err = c.NamespaceChain(record.Name); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	c.audit(r, "namespace-parent", record.Name, record.Name, fmt.Sprintf("Lookups search %s", record.ToString()))
+
+	SendResponse(w, r, record)
+}
+
+// HandleLockNamespace makes the namespace in the URL read-only
+func (c *DepMan) HandleLockNamespace(w http.ResponseWriter, r *http.Request) {
+	c.setNamespaceLock(w, r, true)
+}
+
+func (c *DepMan) HandleUnlockNamespace(w http.ResponseWriter, r *http.Request) {
+	c.setNamespaceLock(w, r, false)
+}
+
+func (c *DepMan) setNamespaceLock(w http.ResponseWriter, r *http.Request, locked bool) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Lock Namespace")
+
+	if err := validNamespace(reqVars["ns"]); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	record, err := c.getNamespace(reqVars["ns"])
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if record.Locked != locked {
+		record.Locked = locked
+		if err = c.Store.StoreNamespace(&record); err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+		action := "namespace-unlock"
+		if locked {
+			action = "namespace-lock"
+		}
+		c.audit(r, action, record.Name, record.Name, fmt.Sprintf("Locked: %t", locked))
+	}
+
+	SendResponse(w, r, record)
+}
+
+// HandleDeleteNamespace deletes the namespace in the URL; with
+// ?force=true also everything in it
+func (c *DepMan) HandleDeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Delete Namespace")
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	usage, err := c.DeleteNamespace(reqVars["ns"], force)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	c.audit(r, "namespace-delete", reqVars["ns"], reqVars["ns"], fmt.Sprintf("Deleted %s", usage.ToString()))
+
+	SendResponse(w, r, Namespace{Name: reqVars["ns"], Usage: &usage})
+}
+
+// checkLock refuses changes to locked namespaces
+func (c *DepMan) checkLock(next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record, err := c.Store.GetNamespace(mux.Vars(r)["ns"])
+		switch {
+		case err == ErrNotFound:
+		case err != nil:
+			SendErrorResponse(w, r, err)
+			return
+		case record.Locked:
+			SendErrorResponse(w, r, ErrLocked)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lockExempt are changes still allowed on locked namespaces
+var lockExempt = map[string]bool{
+	"LockNamespace":   true,
+	"UnlockNamespace": true,
+	"AbortPublish":    true,
+}
+
+// changesNamespace tells whether a route changes the namespace in its URL
+func changesNamespace(route Route) bool {
+	return route.Permission >= PermWrite && strings.Contains(route.Pattern, "{ns}") &&
+		route.Method != "GET" && route.Method != "HEAD" && !lockExempt[route.Name]
+}
@@ -0,0 +1,262 @@
+package depman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceChain(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+
+	for _, n := range []struct{ ns, parent string }{{"dept", ""}, {"team", "dept"}, {"app", "team"}} {
+		if _, err := c.SetNamespaceParent(n.ns, n.parent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only possible by changing records behind depman's back
+	for _, n := range []Namespace{{Name: "x", Parent: "y"}, {Name: "y", Parent: "x"}} {
+		if err := c.Store.StoreNamespace(&n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ns   string
+		want []string
+	}{
+		{"app", []string{"app", "team", "dept", "default"}},
+		{"team", []string{"team", "dept", "default"}},
+		{"unknown", []string{"unknown", "default"}},
+		{"default", []string{"default"}},
+		// Cut where it comes back
+		{"x", []string{"x", "y", "default"}},
+	}
+	for _, test := range tests {
+		chain, err := c.NamespaceChain(test.ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chain, test.want) {
+			t.Errorf("NamespaceChain(%s) = %v, want %v", test.ns, chain, test.want)
+		}
+	}
+
+	if _, err := c.SetNamespaceParent("dept", "app"); err == nil {
+		t.Errorf("Making dept a child of its own child app succeeded")
+	}
+	if _, err := c.SetNamespaceParent("dept", "dept"); err == nil {
+		t.Errorf("Making dept its own parent succeeded")
+	}
+}
+
+func TestFindInChain(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	for _, n := range []struct{ ns, parent string }{{"dept", ""}, {"team", "dept"}, {"app", "team"}} {
+		if _, err := c.SetNamespaceParent(n.ns, n.parent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ns := range []string{"dept", "team", "default"} {
+		f := newTestFile("libfoo.so.1")
+		f.NameSpace = ns
+		if err := c.Store.StoreFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := func(secret string) string {
+		req, err := http.NewRequest("GET", server.URL+"/v1/app/lib/foo/versions/1.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.Status
+		}
+		return resp.Header.Get(NamespaceHeader)
+	}
+
+	// The nearest namespace wins
+	if got := found(""); got != "team" {
+		t.Errorf("Found foo in %s, want team", got)
+	}
+	files, err := c.Store.GetFiles(map[string]interface{}{"ns": "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	if got := found(""); got != "dept" {
+		t.Errorf("Found foo in %s after deleting it from team, want dept", got)
+	}
+
+	// Parents the requester cannot read are skipped
+	c.Config.Auth.Anonymous = "none"
+	if got := found(storeTestToken(t, c, Grant{"app", "read"})); got != "default" {
+		t.Errorf("Found foo in %s without access to dept, want default", got)
+	}
+	if got := found(storeTestToken(t, c, Grant{"app", "read"}, Grant{"dept", "read"})); got != "dept" {
+		t.Errorf("Found foo in %s with access to dept, want dept", got)
+	}
+}
+
+func TestNamespaceLock(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	code, body := testRequest(t, "POST", server.URL+"/v1/team/lib/foo/versions/1.0/publish/el7/x86_64", "")
+	if code != http.StatusOK {
+		t.Fatalf("Opening session: %d %s", code, body)
+	}
+	opened := PublishSession{}
+	if err := json.Unmarshal([]byte(body), &opened); err != nil {
+		t.Fatal(err)
+	}
+	session := server.URL + "/v1/team/publish/" + opened.Id
+
+	if code, _ := testRequest(t, "PUT", server.URL+"/v1/team/namespace/lock", ""); code != http.StatusOK {
+		t.Fatalf("Locking: %d", code)
+	}
+
+	// Every change to team is refused, whatever the route
+	vars := regexp.MustCompile(`\{[a-z_]+\}`)
+	locked := 0
+	for _, route := range c.RouteDefinitions() {
+		if !changesNamespace(route) {
+			continue
+		}
+		path := vars.ReplaceAllStringFunc(route.Pattern, func(v string) string {
+			if v == "{ns}" {
+				return "team"
+			}
+			return "x"
+		})
+		if code, _ := testRequest(t, route.Method, server.URL+path, ""); code != http.StatusLocked {
+			t.Errorf("%s %s in a locked namespace: %d, want 423", route.Method, path, code)
+		}
+		locked++
+	}
+	if locked == 0 {
+		t.Fatal("No route changes namespaces")
+	}
+
+	steps := []struct {
+		method, url string
+		code        int
+	}{
+		// Reading goes on, other namespaces are not affected
+		{"GET", "/v1/team/lib", http.StatusOK},
+		{"GET", "/v1/team/namespace", http.StatusOK},
+		{"PUT", "/v1/other/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a/upload", http.StatusOK},
+		// Sessions can be given up but not committed
+		{"POST", session + "/commit", http.StatusLocked},
+		{"DELETE", session, http.StatusOK},
+		// Locking is no change, so unlocking works
+		{"PUT", "/v1/team/namespace/lock", http.StatusOK},
+		{"DELETE", "/v1/team/namespace/lock", http.StatusOK},
+		{"PUT", "/v1/team/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a/upload", http.StatusOK},
+	}
+	for _, step := range steps {
+		url := step.url
+		if !strings.HasPrefix(url, "http") {
+			url = server.URL + url
+		}
+		if code, body := testRequest(t, step.method, url, "a"); code != step.code {
+			t.Errorf("%s %s: %d %s, want %d", step.method, step.url, code, body, step.code)
+		}
+	}
+	for name := range lockExempt {
+		for _, route := range c.RouteDefinitions() {
+			if route.Name == name && changesNamespace(route) {
+				t.Errorf("Exempt route %s checks the lock", name)
+			}
+		}
+	}
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	if _, err := c.SetNamespaceParent("app", "team"); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{"1.0", "1.1"} {
+		url := server.URL + "/v1/team/lib/foo/versions/" + version + "/files/el7/x86_64/lib/libfoo.a/upload"
+		if code, body := testRequest(t, "PUT", url, version); code != http.StatusOK {
+			t.Fatalf("Uploading %s: %d %s", version, code, body)
+		}
+	}
+	if err := c.SetDependencies("team", "bar", "2.0", Dependencies{{Requires: "zlib", Constraint: "latest"}}); err != nil {
+		t.Fatal(err)
+	}
+	code, body := testRequest(t, "POST", server.URL+"/v1/team/lib/foo/versions/2.0/publish/el7/x86_64", "")
+	if code != http.StatusOK {
+		t.Fatalf("Opening session: %d %s", code, body)
+	}
+
+	steps := []struct {
+		method, path string
+		code         int
+	}{
+		{"DELETE", "/v1/default/namespace", http.StatusBadRequest},
+		// Still the parent of app
+		{"DELETE", "/v1/team/namespace?force=true", http.StatusConflict},
+		{"DELETE", "/v1/app/namespace", http.StatusOK},
+		// Has files
+		{"DELETE", "/v1/team/namespace", http.StatusConflict},
+		{"DELETE", "/v1/team/namespace?force=true", http.StatusOK},
+	}
+	for _, step := range steps {
+		if code, body := testRequest(t, step.method, server.URL+step.path, ""); code != step.code {
+			t.Errorf("%s %s: %d %s, want %d", step.method, step.path, code, body, step.code)
+		}
+	}
+
+	if files, _ := c.Store.GetFiles(map[string]interface{}{"ns": "team"}); len(files) != 0 {
+		t.Errorf("Deleted namespace has files %v", files)
+	}
+	if deps, _ := c.Store.GetDependencies(map[string]interface{}{"ns": "team"}); len(deps) != 0 {
+		t.Errorf("Deleted namespace has dependencies %v", deps)
+	}
+	if sessions, _ := c.Store.GetPublishSessions(); len(sessions) != 0 {
+		t.Errorf("Deleted namespace has %d publish sessions", len(sessions))
+	}
+	if refs := blobRefs(t, c); len(refs) != 0 {
+		t.Errorf("Deleted namespace left references %v", refs)
+	}
+	for _, ns := range []string{"app", "team"} {
+		if _, err := c.Store.GetNamespace(ns); err != ErrNotFound {
+			t.Errorf("Record of deleted namespace %s: %v, want ErrNotFound", ns, err)
+		}
+	}
+
+	entries, err := c.Store.GetAuditEntries(map[string]interface{}{"action": "namespace-delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].NameSpace != "team" {
+		t.Errorf("Audited deletions %v, want app and team", entries)
+	}
+}
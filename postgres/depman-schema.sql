@@ -1,6 +1,13 @@
 
 CREATE TYPE filetype AS ENUM ('header', 'archive', 'shared', 'object');
 
+CREATE TABLE blobs (
+  "checksum" character varying(64) PRIMARY KEY,
+  "size" bigint NOT NULL,
+  "refcount" integer NOT NULL DEFAULT 0,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
 CREATE TABLE files (
   "file_id" SERIAL PRIMARY KEY,
   "library" character varying(255) NOT NULL,
@@ -11,7 +18,10 @@ CREATE TABLE files (
   "platform" character varying(10),
   "arch" character varying(10),
   "info" text NOT NULL DEFAULT '',
-  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+  "checksum" character varying(64) NOT NULL DEFAULT '',
+  "size" bigint NOT NULL DEFAULT 0,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone,
+  "modified" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
 );
 
 CREATE UNIQUE INDEX files_unique_idx ON files(library, version, ns, name, type, platform, arch);
@@ -33,7 +43,88 @@ CREATE TABLE extrafiles (
   "ns" character varying(255) NOT NULL,
   "name" character varying(255) NOT NULL,
   "info" text NOT NULL DEFAULT '',
-  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+  "checksum" character varying(64) NOT NULL DEFAULT '',
+  "size" bigint NOT NULL DEFAULT 0,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone,
+  "modified" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
 );
 
 CREATE UNIQUE INDEX extrafiles_unique_idx ON extrafiles(name, ns, version);
+
+CREATE TABLE audit (
+  "audit_id" SERIAL PRIMARY KEY,
+  "action" character varying(64) NOT NULL,
+  "ns" character varying(255) NOT NULL,
+  "object" text NOT NULL,
+  "actor" character varying(255) NOT NULL,
+  "detail" text NOT NULL DEFAULT '',
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE INDEX audit_ns_idx ON audit(ns);
+
+CREATE TABLE tokens (
+  "token_id" SERIAL PRIMARY KEY,
+  "name" character varying(255) NOT NULL,
+  "hash" character varying(64) NOT NULL,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE UNIQUE INDEX tokens_hash_idx ON tokens(hash);
+
+CREATE TABLE token_grants (
+  "token_id" integer NOT NULL REFERENCES tokens(token_id) ON DELETE CASCADE,
+  "ns" character varying(255) NOT NULL,
+  "level" character varying(16) NOT NULL
+);
+
+CREATE INDEX token_grants_token_id_idx ON token_grants(token_id);
+
+CREATE TABLE dependencies (
+  "dependency_id" SERIAL PRIMARY KEY,
+  "ns" character varying(255) NOT NULL,
+  "library" character varying(255) NOT NULL,
+  "version" character varying(255) NOT NULL,
+  "requires" character varying(255) NOT NULL,
+  "version_constraint" character varying(255) NOT NULL DEFAULT 'latest',
+  "wanted" character varying(255) NOT NULL DEFAULT 'header,archive,shared',
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE UNIQUE INDEX dependencies_unique_idx ON dependencies(ns, library, version, requires);
+
+CREATE TABLE publish_sessions (
+  "session_id" character varying(64) PRIMARY KEY,
+  "ns" character varying(255) NOT NULL,
+  "library" character varying(255) NOT NULL,
+  "version" character varying(255) NOT NULL,
+  "platform" character varying(10),
+  "arch" character varying(10),
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE TABLE publish_files (
+  "session_id" character varying(64) NOT NULL REFERENCES publish_sessions(session_id) ON DELETE CASCADE,
+  "type" filetype NOT NULL,
+  "name" character varying(255) NOT NULL,
+  "checksum" character varying(64) NOT NULL,
+  "size" bigint NOT NULL,
+  "info" text NOT NULL DEFAULT '',
+  PRIMARY KEY (session_id, type, name)
+);
+
+CREATE TABLE publish_links (
+  "session_id" character varying(64) NOT NULL,
+  "type" filetype NOT NULL,
+  "name" character varying(255) NOT NULL,
+  "linkname" character varying(255) NOT NULL,
+  PRIMARY KEY (session_id, type, name, linkname),
+  FOREIGN KEY (session_id, type, name) REFERENCES publish_files(session_id, type, name) ON DELETE CASCADE
+);
+
+CREATE TABLE namespaces (
+  "ns" character varying(255) PRIMARY KEY,
+  "parent" character varying(255) NOT NULL DEFAULT '',
+  "locked" boolean NOT NULL DEFAULT false,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
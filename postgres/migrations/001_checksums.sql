@@ -0,0 +1,7 @@
+-- Record SHA-256 and size of stored contents.
+-- Existing rows keep an empty checksum until their file is uploaded again.
+ALTER TABLE files ADD COLUMN "checksum" character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN "size" bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE extrafiles ADD COLUMN "checksum" character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE extrafiles ADD COLUMN "size" bigint NOT NULL DEFAULT 0;
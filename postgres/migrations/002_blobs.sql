@@ -0,0 +1,9 @@
+-- Contents are stored once per checksum and reference counted.
+-- Run `depman-srv migrate-blobs` afterwards to move existing files
+-- into the content addressed layout.
+CREATE TABLE blobs (
+  "checksum" character varying(64) PRIMARY KEY,
+  "size" bigint NOT NULL,
+  "refcount" integer NOT NULL DEFAULT 0,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
@@ -0,0 +1,12 @@
+-- Audit trail of administrative actions such as forced overwrites
+CREATE TABLE audit (
+  "audit_id" SERIAL PRIMARY KEY,
+  "action" character varying(64) NOT NULL,
+  "ns" character varying(255) NOT NULL,
+  "object" text NOT NULL,
+  "actor" character varying(255) NOT NULL,
+  "detail" text NOT NULL DEFAULT '',
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE INDEX audit_ns_idx ON audit(ns);
@@ -0,0 +1,18 @@
+-- API tokens and their per namespace permissions. Only the SHA-256 of
+-- the token secret is stored.
+CREATE TABLE tokens (
+  "token_id" SERIAL PRIMARY KEY,
+  "name" character varying(255) NOT NULL,
+  "hash" character varying(64) NOT NULL,
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE UNIQUE INDEX tokens_hash_idx ON tokens(hash);
+
+CREATE TABLE token_grants (
+  "token_id" integer NOT NULL REFERENCES tokens(token_id) ON DELETE CASCADE,
+  "ns" character varying(255) NOT NULL,
+  "level" character varying(16) NOT NULL
+);
+
+CREATE INDEX token_grants_token_id_idx ON token_grants(token_id);
@@ -0,0 +1,13 @@
+-- Dependencies declared by library versions
+CREATE TABLE dependencies (
+  "dependency_id" SERIAL PRIMARY KEY,
+  "ns" character varying(255) NOT NULL,
+  "library" character varying(255) NOT NULL,
+  "version" character varying(255) NOT NULL,
+  "requires" character varying(255) NOT NULL,
+  "version_constraint" character varying(255) NOT NULL DEFAULT 'latest',
+  "wanted" character varying(255) NOT NULL DEFAULT 'header,archive,shared',
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE UNIQUE INDEX dependencies_unique_idx ON dependencies(ns, library, version, requires);
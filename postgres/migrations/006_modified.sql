@@ -0,0 +1,7 @@
+-- Record when the contents of a file last changed, for Last-Modified.
+-- created stays the time the file was first published.
+ALTER TABLE files ADD COLUMN "modified" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone;
+UPDATE files SET modified = created;
+
+ALTER TABLE extrafiles ADD COLUMN "modified" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone;
+UPDATE extrafiles SET modified = created;
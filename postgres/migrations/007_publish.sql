@@ -0,0 +1,29 @@
+-- Publish sessions stage the files and links of a library version until
+-- they are committed into files and filelinks all at once.
+CREATE TABLE publish_sessions (
+  "session_id" character varying(64) PRIMARY KEY,
+  "ns" character varying(255) NOT NULL,
+  "library" character varying(255) NOT NULL,
+  "version" character varying(255) NOT NULL,
+  "platform" character varying(10),
+  "arch" character varying(10),
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
+
+CREATE TABLE publish_files (
+  "session_id" character varying(64) NOT NULL REFERENCES publish_sessions(session_id) ON DELETE CASCADE,
+  "type" filetype NOT NULL,
+  "name" character varying(255) NOT NULL,
+  "checksum" character varying(64) NOT NULL,
+  "size" bigint NOT NULL,
+  PRIMARY KEY (session_id, type, name)
+);
+
+CREATE TABLE publish_links (
+  "session_id" character varying(64) NOT NULL,
+  "type" filetype NOT NULL,
+  "name" character varying(255) NOT NULL,
+  "linkname" character varying(255) NOT NULL,
+  PRIMARY KEY (session_id, type, name, linkname),
+  FOREIGN KEY (session_id, type, name) REFERENCES publish_files(session_id, type, name) ON DELETE CASCADE
+);
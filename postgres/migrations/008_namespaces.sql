@@ -0,0 +1,8 @@
+-- Namespace records. Lookups which find nothing in a namespace continue
+-- in its parent; '' leaves only the default namespace behind it.
+-- Namespaces without a record keep working as before.
+CREATE TABLE namespaces (
+  "ns" character varying(255) PRIMARY KEY,
+  "parent" character varying(255) NOT NULL DEFAULT '',
+  "created" timestamp with time zone DEFAULT ('now'::text)::timestamp(6) with time zone
+);
@@ -0,0 +1,2 @@
+-- Locked namespaces are read-only
+ALTER TABLE namespaces ADD COLUMN "locked" boolean NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+-- Staged files keep their info, so promoted files do not lose it
+ALTER TABLE publish_files ADD COLUMN "info" text NOT NULL DEFAULT '';
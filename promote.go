@@ -0,0 +1,254 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// PromoteRequest names the namespace a library version is promoted from
+// and optionally restricts it to one platform and/or architecture
+type PromoteRequest struct {
+	From     string `json:"from"`
+	Platform string `json:"platform,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+func (p PromoteRequest) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(p)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (p PromoteRequest) ToString() string {
+	platform, arch := p.Platform, p.Arch
+	if platform == "" {
+		platform = "*"
+	}
+	if arch == "" {
+		arch = "*"
+	}
+	return fmt.Sprintf("%s %s/%s", p.From, platform, arch)
+}
+
+// stagePromoted stages a copy of files in a new publish session of the
+// target namespace. The copies reference the same contents, so nothing
+// but files from before content addressing is stored again.
+func (c *DepMan) stagePromoted(ns string, files Files) (PublishSession, error) {
+	id, err := newPublishSessionId()
+	if err != nil {
+		return PublishSession{}, err
+	}
+	session := PublishSession{
+		Id:        id,
+		NameSpace: ns,
+		Library:   files[0].Library,
+		Version:   files[0].Version,
+		Platform:  files[0].Platform,
+		Arch:      files[0].Arch,
+		Files:     Files{},
+	}
+	if err = c.Store.StorePublishSession(&session); err != nil {
+		return session, err
+	}
+
+	for _, f := range files {
+		file := session.newFile(f.Type, f.Name)
+		file.Info = f.Info
+		file.Size = f.Size
+		if f.Checksum == "" {
+			fh, err := c.getContent(f.LegacyBlobKey())
+			if err != nil {
+				return session, err
+			}
+			file.Checksum, file.Size, err = c.storeContent(fh, f.Size, "")
+			fh.Close()
+			if err != nil {
+				return session, err
+			}
+		} else {
+			if err = c.Store.AddBlobRef(f.Checksum, f.Size); err != nil {
+				return session, err
+			}
+			file.Checksum = f.Checksum
+		}
+
+		previous, err := c.Store.StagePublishFile(session.Id, &file)
+		if err != nil {
+			c.releaseContent(file.Checksum)
+			return session, err
+		}
+		if err = c.releaseContent(previous); err != nil {
+			log.Errorf("Cannot release previously staged content %s: %s", previous, err)
+		}
+		session.Files = append(session.Files, file)
+
+		for _, link := range f.Links {
+			if err = c.Store.StagePublishLink(session.Id, f.Type, f.Name, link.Name); err != nil {
+				return session, err
+			}
+		}
+	}
+
+	return session, nil
+}
+
+// HandlePromote copies all files, links and dependencies of a library
+// version from another namespace into the one in the URL. Each platform
+// and architecture is committed at once like a publish session, and
+// replacing published contents or dependencies needs ?force=true.
+func (c *DepMan) HandlePromote(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Promote Library Version")
+
+	req := PromoteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot parse promote request: %s", err)))
+		return
+	}
+	ns, library, version := reqVars["ns"], reqVars["library"], reqVars["version"]
+	switch {
+	case req.From == "":
+		SendErrorResponse(w, r, BadRequestError("Namespace to promote from missing"))
+		return
+	case req.From == ns:
+		SendErrorResponse(w, r, BadRequestError(fmt.Sprintf("Cannot promote %s/%s from %s into itself", library, version, ns)))
+		return
+	case !requestIdentity(r).Allowed(req.From, PermRead):
+		SendErrorResponse(w, r, ErrForbidden)
+		return
+	}
+
+	filter := map[string]interface{}{
+		"ns":      req.From,
+		"library": library,
+		"version": version,
+	}
+	if req.Platform != "" {
+		filter["platform"] = req.Platform
+	}
+	if req.Arch != "" {
+		filter["arch"] = req.Arch
+	}
+	files, err := c.GetFilesByFilter(filter, false)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		SendErrorResponse(w, r, ErrNotFound)
+		return
+	}
+
+	// Dependencies are declared per version, whatever the filter
+	deps, err := c.Store.GetDependencies(map[string]interface{}{"ns": req.From, "library": library, "version": version})
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	existing, err := c.Store.GetDependencies(map[string]interface{}{"ns": ns, "library": library, "version": version})
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	forcedDeps := false
+	if len(deps) > 0 && len(existing) > 0 && !sameDependencies(existing, deps) {
+		published, err := c.versionPublished(ns, library, version)
+		if err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+		if published {
+			if err = c.authorizeOverwrite(r); err != nil {
+				SendErrorResponse(w, r, err)
+				return
+			}
+			forcedDeps = true
+		}
+	}
+
+	groups := []Files{}
+	groupIdx := make(map[string]int)
+	for _, f := range files {
+		key := f.Platform + "/" + f.Arch
+		idx, ok := groupIdx[key]
+		if !ok {
+			idx = len(groups)
+			groupIdx[key] = idx
+			groups = append(groups, Files{})
+		}
+		groups[idx] = append(groups[idx], f)
+	}
+
+	// Stage everything before committing anything, so a conflict on one
+	// platform leaves the target untouched
+	sessions := []PublishSession{}
+	forced := [][]forcedChange{}
+	abort := func(sessions []PublishSession) {
+		for _, session := range sessions {
+			if err := c.abortPublishSession(session.Id); err != nil {
+				log.Errorf("Cannot abort promote session %s: %s", session.Id, err)
+			}
+		}
+	}
+	for _, group := range groups {
+		session, err := c.stagePromoted(ns, group)
+		if session.Id != "" {
+			sessions = append(sessions, session)
+		}
+		if err == nil {
+			var f []forcedChange
+			f, err = c.publishedFiles(r, session, session.Files)
+			forced = append(forced, f)
+		}
+		if err != nil {
+			abort(sessions)
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// A failed commit leaves the platforms committed before it in place;
+	// the ones after it are never committed
+	for idx, session := range sessions {
+		replaced, err := c.Store.CommitPublishSession(session.Id)
+		if err != nil {
+			abort(sessions[idx:])
+			SendErrorResponse(w, r, err)
+			return
+		}
+		c.releaseReplaced(replaced)
+		c.auditForced(r, forced[idx])
+	}
+
+	if len(deps) > 0 {
+		if err = c.SetDependencies(ns, library, version, deps); err != nil {
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	object := fmt.Sprintf("%s/%s", library, version)
+	if forcedDeps {
+		c.audit(r, "force-dependencies", ns, object,
+			fmt.Sprintf("Replaced dependencies [%s] with [%s]",
+				strings.Replace(existing.ToString(), "\n", "; ", -1), strings.Replace(deps.ToString(), "\n", "; ", -1)))
+	}
+	c.audit(r, "promote", ns, object, fmt.Sprintf("%d files from %s", len(files), req.ToString()))
+	log.Infof("Promoted %s with %d files from %s to %s", object, len(files), req.ToString(), ns)
+
+	filter["ns"] = ns
+	promoted, err := c.GetFilesByFilter(filter, false)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, promoted)
+}
@@ -0,0 +1,225 @@
+package depman
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// failingCommits fails the n-th commit of a publish session
+type failingCommits struct {
+	MetadataStore
+	commits int
+	n       int
+}
+
+func (s *failingCommits) CommitPublishSession(id string) (Files, error) {
+	s.commits++
+	if s.commits == s.n {
+		return nil, errors.New("Commit failed")
+	}
+	return s.MetadataStore.CommitPublishSession(id)
+}
+
+// storePromoteSource stores foo 1.0 in the team namespace: a shared
+// library with info and a link plus a header for el7, and a shared
+// library for el6, which depend on zlib
+func storePromoteSource(t *testing.T, c *DepMan) {
+	for _, src := range []struct {
+		platform, fileType, name, body, info, link string
+	}{
+		{"el7", "lib", "libfoo.so.1", "so", "built by ci", "libfoo.so"},
+		{"el7", "header", "foo.h", "header", "", ""},
+		{"el6", "lib", "libfoo.so.1", "so for el6", "", ""},
+	} {
+		checksum, size, err := c.storeContent(strings.NewReader(src.body), -1, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newTestFile(src.name)
+		f.NameSpace, f.Platform, f.Type, f.Info = "team", src.platform, src.fileType, src.info
+		f.Checksum, f.Size = checksum, size
+		if err = c.Store.StoreFile(f); err != nil {
+			t.Fatal(err)
+		}
+		if src.link != "" {
+			if err = c.Store.StoreFileLink(&FileLink{FileId: f.Id, Name: src.link}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := c.SetDependencies("team", "foo", "1.0", Dependencies{{Requires: "zlib", Constraint: "latest"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// describeFiles lists the files of foo 1.0 in a namespace with their
+// info and links
+func describeFiles(t *testing.T, c *DepMan, ns string) []string {
+	files, err := c.GetFilesByFilter(map[string]interface{}{"ns": ns, "library": "foo", "version": "1.0"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := []string{}
+	for _, f := range files {
+		links := []string{}
+		for _, link := range f.Links {
+			links = append(links, link.Name)
+		}
+		desc = append(desc, f.ToString()+" info="+f.Info+" links="+strings.Join(links, ","))
+	}
+	sort.Strings(desc)
+	return desc
+}
+
+func TestPromote(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+	storePromoteSource(t, c)
+	promote := server.URL + "/v1/default/lib/foo/versions/1.0/promote"
+
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"from": "default"}`, http.StatusBadRequest},
+		{`{"from": "team", "platform": "win64"}`, http.StatusNotFound},
+		{`not json`, http.StatusBadRequest},
+	} {
+		if code, body := testRequest(t, "POST", promote, test.body); code != test.code {
+			t.Errorf("Promoting %s: %d %s, want %d", test.body, code, body, test.code)
+		}
+	}
+
+	// Only the requested platform is promoted
+	if code, body := testRequest(t, "POST", promote, `{"from": "team", "platform": "el6"}`); code != http.StatusOK {
+		t.Fatalf("Promoting el6: %d %s", code, body)
+	}
+	want := []string{"el6/x86_64/lib/libfoo.so.1 info= links="}
+	if got := describeFiles(t, c, "default"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Promoted %v, want %v", got, want)
+	}
+
+	// The other platforms add files to the published version
+	if code, _ := testRequest(t, "POST", promote, `{"from": "team"}`); code != http.StatusConflict {
+		t.Errorf("Adding files to a published version: %d, want 409", code)
+	}
+	if code, body := testRequest(t, "POST", promote+"?force=true", `{"from": "team"}`); code != http.StatusOK {
+		t.Fatalf("Promoting everything: %d %s", code, body)
+	}
+	want = describeFiles(t, c, "team")
+	if got := describeFiles(t, c, "default"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Promoted %v, want %v", got, want)
+	}
+	if code, body := testRequest(t, "POST", promote, `{"from": "team"}`); code != http.StatusOK {
+		t.Errorf("Promoting the same contents again: %d %s", code, body)
+	}
+	deps, err := c.Store.GetDependencies(map[string]interface{}{"ns": "default", "library": "foo", "version": "1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].Requires != "zlib" {
+		t.Errorf("Promoted dependencies %v, want zlib", deps)
+	}
+
+	// The copies share the contents of the originals
+	refs := blobRefs(t, c)
+	if len(refs) != 3 {
+		t.Errorf("Reference counts %v, want 3 contents", refs)
+	}
+	for checksum, n := range refs {
+		if n != 2 {
+			t.Errorf("Content %s has %d references, want 2", checksum, n)
+		}
+	}
+
+	// Replacing published contents needs force and stages nothing without
+	files, err := c.Store.GetFiles(map[string]interface{}{"ns": "team", "name": "foo.h"})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Source header: %v %v", files, err)
+	}
+	header := files[0]
+	header.Checksum, header.Size, err = c.storeContent(strings.NewReader("new header"), -1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Store.StoreFile(&header); err != nil {
+		t.Fatal(err)
+	}
+	before := blobRefs(t, c)
+	if code, _ := testRequest(t, "POST", promote, `{"from": "team"}`); code != http.StatusConflict {
+		t.Errorf("Promoting over published contents: %d, want 409", code)
+	}
+	if sessions, _ := c.Store.GetPublishSessions(); len(sessions) != 0 {
+		t.Errorf("Refused promotion left %d publish sessions", len(sessions))
+	}
+	if after := blobRefs(t, c); !reflect.DeepEqual(after, before) {
+		t.Errorf("Refused promotion changed reference counts from %v to %v", before, after)
+	}
+
+	if code, body := testRequest(t, "POST", promote+"?force=true", `{"from": "team"}`); code != http.StatusOK {
+		t.Fatalf("Forced promotion: %d %s", code, body)
+	}
+	entries, err := c.Store.GetAuditEntries(map[string]interface{}{"action": "force-upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := []string{}
+	for _, entry := range entries {
+		objects = append(objects, entry.Object+": "+strings.Fields(entry.Detail)[0])
+	}
+	sort.Strings(objects)
+	want = []string{
+		"foo/1.0/el7/x86_64/header/foo.h: Added",
+		"foo/1.0/el7/x86_64/header/foo.h: Overwrote",
+		"foo/1.0/el7/x86_64/lib/libfoo.so.1: Added",
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("Audited forced uploads %v, want %v", objects, want)
+	}
+
+	// Locked namespaces refuse promotions
+	if code, _ := testRequest(t, "PUT", server.URL+"/v1/default/namespace/lock", ""); code != http.StatusOK {
+		t.Fatalf("Locking: %d", code)
+	}
+	if code, _ := testRequest(t, "POST", promote, `{"from": "team"}`); code != http.StatusLocked {
+		t.Errorf("Promoting into a locked namespace: %d, want 423", code)
+	}
+}
+
+func TestPromoteCommitFails(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	storePromoteSource(t, c)
+	c.Store = &failingCommits{MetadataStore: c.Store, n: 2}
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	code, _ := testRequest(t, "POST", server.URL+"/v1/default/lib/foo/versions/1.0/promote", `{"from": "team"}`)
+	if code != http.StatusInternalServerError {
+		t.Errorf("Promotion with a failing commit: %d, want 500", code)
+	}
+
+	// The platform committed first stays, the other one is aborted
+	promoted := describeFiles(t, c, "default")
+	if len(promoted) != 1 && len(promoted) != 2 {
+		t.Fatalf("Promoted %v, want the files of one platform", promoted)
+	}
+	if sessions, _ := c.Store.GetPublishSessions(); len(sessions) != 0 {
+		t.Errorf("Failed promotion left %d publish sessions", len(sessions))
+	}
+	refs := 0
+	for _, n := range blobRefs(t, c) {
+		refs += n
+	}
+	if want := 3 + len(promoted); refs != want {
+		t.Errorf("%d references after a failed promotion, want %d", refs, want)
+	}
+}
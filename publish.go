@@ -0,0 +1,394 @@
+package depman
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PublishSession stages the files and links of one library version for
+// one platform and architecture. Nothing of it is visible until it is
+// committed, which stores all files at once.
+type PublishSession struct {
+	Id        string    `json:"session_id"`
+	NameSpace string    `json:"ns"`
+	Library   string    `json:"library"`
+	Version   string    `json:"version"`
+	Platform  string    `json:"platform"`
+	Arch      string    `json:"arch"`
+	Created   time.Time `json:"created"`
+	// Files are the staged files with their links
+	Files Files `json:"files"`
+}
+
+func (s PublishSession) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(s)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (s PublishSession) ToString() string {
+	lines := []string{fmt.Sprintf("%s: %s/%s:%s %s/%s (%d files)",
+		s.Id, s.NameSpace, s.Library, s.Version, s.Platform, s.Arch, len(s.Files))}
+	for _, f := range s.Files {
+		lines = append(lines, "  "+f.ToString())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stagedFile returns the staged file of a type and name
+func (s *PublishSession) stagedFile(fileType string, name string) (*File, bool) {
+	for idx := range s.Files {
+		if s.Files[idx].Type == fileType && s.Files[idx].Name == name {
+			return &s.Files[idx], true
+		}
+	}
+	return nil, false
+}
+
+// newFile is a file of the session's library version
+func (s *PublishSession) newFile(fileType string, name string) File {
+	return File{
+		Library:   s.Library,
+		Version:   s.Version,
+		NameSpace: s.NameSpace,
+		Name:      name,
+		Type:      fileType,
+		Platform:  s.Platform,
+		Arch:      s.Arch,
+	}
+}
+
+func newPublishSessionId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// publishSession loads the session in the request. Sessions of other
+// namespaces are not found, so permissions on the namespace in the URL
+// apply.
+func (c *DepMan) publishSession(r *http.Request) (PublishSession, error) {
+	reqVars := mux.Vars(r)
+	session, err := c.Store.GetPublishSession(reqVars["session_id"])
+	if err != nil {
+		return session, err
+	}
+	if session.NameSpace != reqVars["ns"] {
+		return session, ErrNotFound
+	}
+	return session, nil
+}
+
+// releaseStaged hands back the contents of files staged by a session
+// which is gone
+func (c *DepMan) releaseStaged(session PublishSession) {
+	for _, f := range session.Files {
+		if err := c.releaseContent(f.Checksum); err != nil {
+			log.Errorf("Cannot release staged content %s: %s", f.Checksum, err)
+		}
+	}
+}
+
+// HandleOpenPublish starts a publish session for a library version
+func (c *DepMan) HandleOpenPublish(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Open Publish Session")
+
+	id, err := newPublishSessionId()
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	session := PublishSession{
+		Id:        id,
+		NameSpace: reqVars["ns"],
+		Library:   reqVars["library"],
+		Version:   reqVars["version"],
+		Platform:  reqVars["platform"],
+		Arch:      reqVars["arch"],
+		Files:     Files{},
+	}
+	if err = c.Store.StorePublishSession(&session); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	log.Infof("Opened publish session %s for %s/%s:%s %s/%s",
+		session.Id, session.NameSpace, session.Library, session.Version, session.Platform, session.Arch)
+
+	SendResponse(w, r, session)
+}
+
+func (c *DepMan) HandleGetPublish(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Get Publish Session")
+
+	session, err := c.publishSession(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, session)
+}
+
+// HandlePublishFile stages the contents of one file. Staging the same
+// file again replaces it.
+func (c *DepMan) HandlePublishFile(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Stage File")
+
+	session, err := c.publishSession(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	// Contents declared equal to the published ones need no force; the
+	// declared checksum is verified on storing
+	file := session.newFile(reqVars["type"], reqVars["name"])
+	file.Checksum = r.Header.Get(ChecksumHeader)
+	if _, err = c.publishedFiles(r, session, Files{file}); err != nil {
+		// Fail early rather than on commit
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	checksum, size, err := c.storeContent(r.Body, r.ContentLength, r.Header.Get(ChecksumHeader))
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	file.Checksum = checksum
+	file.Size = size
+	previous, err := c.Store.StagePublishFile(session.Id, &file)
+	if err != nil {
+		c.releaseContent(checksum)
+		SendErrorResponse(w, r, err)
+		return
+	}
+	if err = c.releaseContent(previous); err != nil {
+		log.Errorf("Cannot release previously staged content %s: %s", previous, err)
+	}
+	log.Infof("Staged %s (%d bytes) in publish session %s", file.ToString(), size, session.Id)
+
+	w.Header().Set(ChecksumHeader, file.Checksum)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Staged")
+}
+
+// HandlePublishLink stages a symlink to a staged file
+func (c *DepMan) HandlePublishLink(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Stage Link")
+
+	session, err := c.publishSession(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if staged, ok := session.stagedFile(reqVars["type"], reqVars["name"]); ok {
+		file := *staged
+		file.Links = append(FileLinks{{Name: reqVars["linkname"]}}, staged.Links...)
+		if _, err = c.publishedFiles(r, session, Files{file}); err != nil {
+			// Fail early rather than on commit
+			SendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = c.Store.StagePublishLink(session.Id, reqVars["type"], reqVars["name"], reqVars["linkname"])
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Staged")
+}
+
+// forcedChange is a change to a published library version which
+// ?force=true let through
+type forcedChange struct {
+	File   File
+	Detail string
+}
+
+// publishedFiles checks whether committing files would change a
+// published library version: replace published contents, add files to
+// it or add links to its files. That needs ?force=true and admin
+// permission. It returns the changes which are forced.
+func (c *DepMan) publishedFiles(r *http.Request, session PublishSession, files Files) ([]forcedChange, error) {
+	forced := []forcedChange{}
+	for _, f := range files {
+		existing, err := c.Store.GetFiles(map[string]interface{}{
+			"ns":       f.NameSpace,
+			"library":  f.Library,
+			"version":  f.Version,
+			"name":     f.Name,
+			"type":     f.Type,
+			"platform": f.Platform,
+			"arch":     f.Arch,
+		})
+		if err != nil {
+			return forced, err
+		}
+		if len(existing) == 0 {
+			added, err := c.authorizeAddition(r, f.NameSpace, f.Library, f.Version)
+			if err != nil {
+				return forced, err
+			}
+			if added {
+				forced = append(forced, forcedChange{f, fmt.Sprintf("Added to published version with %s", describeContent(f.Checksum))})
+			}
+			continue
+		}
+
+		old := existing[0]
+		if !c.isPublished(old.Created, old.Checksum, old.LegacyBlobKey()) {
+			continue
+		}
+		if f.Checksum == "" || f.Checksum != old.Checksum {
+			if err = c.authorizeOverwrite(r); err != nil {
+				return forced, err
+			}
+			forced = append(forced, forcedChange{old, fmt.Sprintf("Overwrote published contents %s with %s",
+				describeContent(old.Checksum), f.Checksum)})
+			continue
+		}
+
+		links, err := c.Store.GetFileLinks(old.Id)
+		if err != nil {
+			return forced, err
+		}
+		added := []string{}
+		for _, link := range f.Links {
+			if !links.contains(link.Name) {
+				added = append(added, link.Name)
+			}
+		}
+		if len(added) > 0 {
+			if err = c.authorizeOverwrite(r); err != nil {
+				return forced, err
+			}
+			forced = append(forced, forcedChange{old, fmt.Sprintf("Added links %s to published file", strings.Join(added, ", "))})
+		}
+	}
+	return forced, nil
+}
+
+// auditForced writes forced changes to the audit trail
+func (c *DepMan) auditForced(r *http.Request, forced []forcedChange) {
+	for _, change := range forced {
+		f := change.File
+		c.audit(r, "force-upload", f.NameSpace, fmt.Sprintf("%s/%s/%s", f.Library, f.Version, f.ToString()), change.Detail)
+	}
+}
+
+// HandleCommitPublish stores all staged files and links at once and
+// ends the session
+func (c *DepMan) HandleCommitPublish(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Commit Publish Session")
+
+	session, err := c.publishSession(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+	if len(session.Files) == 0 {
+		SendErrorResponse(w, r, BadRequestError("Nothing staged to publish"))
+		return
+	}
+
+	forced, err := c.publishedFiles(r, session, session.Files)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	replaced, err := c.Store.CommitPublishSession(session.Id)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	c.releaseReplaced(replaced)
+
+	object := fmt.Sprintf("%s/%s/%s/%s", session.Library, session.Version, session.Platform, session.Arch)
+	c.auditForced(r, forced)
+	c.audit(r, "publish", session.NameSpace, object, fmt.Sprintf("%d files (session %s)", len(session.Files), session.Id))
+	log.Infof("Committed publish session %s: %s/%s with %d files", session.Id, session.NameSpace, object, len(session.Files))
+
+	files, err := c.GetFilesByFilter(map[string]interface{}{
+		"ns":       session.NameSpace,
+		"library":  session.Library,
+		"version":  session.Version,
+		"platform": session.Platform,
+		"arch":     session.Arch,
+	}, false)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	SendResponse(w, r, files)
+}
+
+// HandleAbortPublish throws a session and everything staged away
+func (c *DepMan) HandleAbortPublish(w http.ResponseWriter, r *http.Request) {
+	reqVars := mux.Vars(r)
+	logRequest(reqVars, "Abort Publish Session")
+
+	session, err := c.publishSession(r)
+	if err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	if err = c.abortPublishSession(session.Id); err != nil {
+		SendErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Aborted")
+}
+
+// releaseReplaced drops the references of files a commit replaced. The
+// staged references now belong to the files; the contents they replaced
+// lose theirs.
+func (c *DepMan) releaseReplaced(replaced Files) {
+	for _, f := range replaced {
+		if f.Checksum == "" {
+			// Replaces a file from before content addressing
+			c.Blobs.Delete(f.LegacyBlobKey())
+		} else if err := c.releaseContent(f.Checksum); err != nil {
+			log.Errorf("Cannot release previous content %s: %s", f.Checksum, err)
+		}
+	}
+}
+
+func (c *DepMan) abortPublishSession(id string) error {
+	session, err := c.Store.DeletePublishSession(id)
+	if err != nil {
+		return err
+	}
+	c.releaseStaged(session)
+	log.Infof("Aborted publish session %s with %d staged files", session.Id, len(session.Files))
+	return nil
+}
@@ -0,0 +1,180 @@
+package depman
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testRequest(t *testing.T, method string, url string, body string) (int, string) {
+	return testRequestHeaders(t, method, url, body, nil)
+}
+
+func testRequestHeaders(t *testing.T, method string, url string, body string, headers map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(reply)
+}
+
+// blobRefs returns the reference count of every stored content
+func blobRefs(t *testing.T, c *DepMan) map[string]int {
+	records, err := c.Store.ListBlobRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := make(map[string]int)
+	for _, ref := range records {
+		refs[ref.Checksum] = ref.RefCount
+	}
+	return refs
+}
+
+func openTestSession(t *testing.T, base string) string {
+	code, body := testRequest(t, "POST", base+"/v1/default/lib/foo/versions/1.0/publish/el7/x86_64", "")
+	if code != http.StatusOK {
+		t.Fatalf("Opening session: %d %s", code, body)
+	}
+	session := PublishSession{}
+	if err := json.Unmarshal([]byte(body), &session); err != nil {
+		t.Fatal(err)
+	}
+	return base + "/v1/default/publish/" + session.Id
+}
+
+func TestPublishCommit(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	session := openTestSession(t, server.URL)
+	steps := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/commit", "", http.StatusBadRequest},
+		{"PUT", "/files/lib/libfoo.so.1", "so", http.StatusOK},
+		{"PUT", "/files/header/foo.h", "old header", http.StatusOK},
+		{"PUT", "/files/header/foo.h", "header", http.StatusOK},
+		{"PUT", "/files/lib/libfoo.so.1/links/libfoo.so", "", http.StatusOK},
+		{"PUT", "/files/lib/libbar.so.1/links/libbar.so", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if code, body := testRequest(t, step.method, session+step.path, step.body); code != step.code {
+			t.Fatalf("%s %s: %d %s, want %d", step.method, step.path, code, body, step.code)
+		}
+	}
+
+	files, err := c.Store.GetFiles(map[string]interface{}{"library": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Staged files visible before commit: %v", files)
+	}
+
+	code, body := testRequest(t, "POST", session+"/commit", "")
+	if code != http.StatusOK {
+		t.Fatalf("Commit: %d %s", code, body)
+	}
+	files, err = c.GetFilesByFilter(map[string]interface{}{"library": "foo"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for _, f := range files {
+		got[f.ToString()] = len(f.Links)
+	}
+	want := map[string]int{"el7/x86_64/lib/libfoo.so.1": 1, "el7/x86_64/header/foo.h": 0}
+	if len(got) != len(want) || got["el7/x86_64/lib/libfoo.so.1"] != 1 || got["el7/x86_64/header/foo.h"] != 0 {
+		t.Errorf("Committed %v, want %v", got, want)
+	}
+
+	// Restaging foo.h released the old header; each file holds one reference
+	refs := blobRefs(t, c)
+	if len(refs) != 2 {
+		t.Errorf("Reference counts %v, want one for each of the 2 files", refs)
+	}
+	for checksum, n := range refs {
+		if n != 1 {
+			t.Errorf("Content %s has %d references, want 1", checksum, n)
+		}
+	}
+
+	if code, _ = testRequest(t, "GET", session, ""); code != http.StatusNotFound {
+		t.Errorf("Committed session still there: %d", code)
+	}
+
+	// Published contents cannot be replaced without force, on staging or
+	// on commit
+	session = openTestSession(t, server.URL)
+	if code, _ = testRequest(t, "PUT", session+"/files/header/foo.h", "changed"); code != http.StatusConflict {
+		t.Errorf("Staging over published contents: %d, want 409", code)
+	}
+	if code, _ = testRequest(t, "PUT", session+"/files/header/foo.h?force=true", "changed"); code != http.StatusOK {
+		t.Errorf("Forced staging: %d, want 200", code)
+	}
+	if code, _ = testRequest(t, "POST", session+"/commit", ""); code != http.StatusConflict {
+		t.Errorf("Commit over published contents: %d, want 409", code)
+	}
+	if code, body = testRequest(t, "POST", session+"/commit?force=true", ""); code != http.StatusOK {
+		t.Errorf("Forced commit: %d %s", code, body)
+	}
+	if refs = blobRefs(t, c); len(refs) != 2 {
+		t.Errorf("Reference counts after forced commit %v, want the old header released", refs)
+	}
+}
+
+func TestPublishAbort(t *testing.T) {
+	c, cleanup := newTestDepMan(t)
+	defer cleanup()
+	server := httptest.NewServer(c.NewRouter())
+	defer server.Close()
+
+	session := openTestSession(t, server.URL)
+	for _, name := range []string{"libfoo.so.1", "libfoo.a"} {
+		if code, body := testRequest(t, "PUT", session+"/files/lib/"+name, name); code != http.StatusOK {
+			t.Fatalf("Staging %s: %d %s", name, code, body)
+		}
+	}
+	if refs := blobRefs(t, c); len(refs) != 2 {
+		t.Fatalf("Staged contents hold %v, want 2 references", refs)
+	}
+
+	// Sessions are only found in their own namespace
+	other := strings.Replace(session, "/v1/default/", "/v1/other/", 1)
+	if code, _ := testRequest(t, "DELETE", other, ""); code != http.StatusNotFound {
+		t.Errorf("Aborting through another namespace: %d, want 404", code)
+	}
+
+	if code, body := testRequest(t, "DELETE", session, ""); code != http.StatusOK {
+		t.Fatalf("Abort: %d %s", code, body)
+	}
+	if refs := blobRefs(t, c); len(refs) != 0 {
+		t.Errorf("Aborted session left references %v", refs)
+	}
+	blobs, err := c.Blobs.List("blobs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("Aborted session left blobs %v", blobs)
+	}
+	if code, _ := testRequest(t, "POST", session+"/commit", ""); code != http.StatusNotFound {
+		t.Errorf("Commit of an aborted session: %d, want 404", code)
+	}
+}
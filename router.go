@@ -8,24 +8,35 @@ import (
 	"time"
 )
 
-const RequestNS = 0
+// Keys of per request values in gorilla/context
+const (
+	RequestNS = iota
+	RequestIdentity
+)
 
+// Route describes one API endpoint. Permission is the level required on
+// the namespace in the URL, or on all namespaces if there is none.
 type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Permission  Permission
 }
 
 type Routes []Route
 
-func NewRouter() *mux.Router {
+func (c *DepMan) NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
-	for _, route := range RouteDefinitions() {
+	for _, route := range c.RouteDefinitions() {
 		log.Debugf("Setting up route %s for %s %s", route.Name, route.Method, route.Pattern)
 		var handler http.Handler
 		handler = handlerDecorate(route.HandlerFunc)
+		if changesNamespace(route) {
+			handler = c.checkLock(handler)
+		}
+		handler = c.authorize(route.Permission, handler)
 		//handler = c.ClientHandler(handler, route.Name)
 		router.
 			Methods(route.Method).
@@ -57,121 +68,343 @@ func handlerDecorate(f http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func RouteDefinitions() Routes {
+func (c *DepMan) RouteDefinitions() Routes {
 	return Routes{
 		Route{
 			"Index",
 			"GET",
 			"/",
-			HandleIndex,
+			c.HandleIndex,
+			PermNone,
+		},
+		Route{
+			"CollectGarbage",
+			"POST",
+			"/v1/_admin/gc",
+			c.HandleCollectGarbage,
+			PermAdmin,
+		},
+		Route{
+			"ListAudit",
+			"GET",
+			"/v1/_admin/audit",
+			c.HandleListAudit,
+			PermAdmin,
+		},
+		Route{
+			"ListTokens",
+			"GET",
+			"/v1/_admin/tokens",
+			c.HandleListTokens,
+			PermAdmin,
+		},
+		Route{
+			"CreateToken",
+			"POST",
+			"/v1/_admin/tokens",
+			c.HandleCreateToken,
+			PermAdmin,
+		},
+		Route{
+			"DeleteToken",
+			"DELETE",
+			"/v1/_admin/tokens/{token_id}",
+			c.HandleDeleteToken,
+			PermAdmin,
+		},
+		Route{
+			"ListNamespaces",
+			"GET",
+			"/v1/_admin/namespaces",
+			c.HandleListNamespaces,
+			PermAdmin,
+		},
+		Route{
+			"GetNamespace",
+			"GET",
+			"/v1/{ns}/namespace",
+			c.HandleGetNamespace,
+			PermRead,
+		},
+		Route{
+			"PutNamespace",
+			"PUT",
+			"/v1/{ns}/namespace",
+			c.HandlePutNamespace,
+			PermAdmin,
+		},
+		Route{
+			"DeleteNamespace",
+			"DELETE",
+			"/v1/{ns}/namespace",
+			c.HandleDeleteNamespace,
+			PermAdmin,
+		},
+		Route{
+			"LockNamespace",
+			"PUT",
+			"/v1/{ns}/namespace/lock",
+			c.HandleLockNamespace,
+			PermAdmin,
+		},
+		Route{
+			"UnlockNamespace",
+			"DELETE",
+			"/v1/{ns}/namespace/lock",
+			c.HandleUnlockNamespace,
+			PermAdmin,
 		},
 		Route{
 			"FindFile",
 			"GET",
 			"/v1/{ns}/search/{platform}/{arch}/{name}",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
 			"ListLibraries",
 			"GET",
 			"/v1/{ns}/lib",
-			HandleListLibraries,
+			c.HandleListLibraries,
+			PermRead,
 		},
 		Route{
 			"GetLibrary",
 			"GET",
 			"/v1/{ns}/lib/{library}",
-			HandleGetLibrary,
+			c.HandleGetLibrary,
+			PermRead,
+		},
+		Route{
+			"DeleteLibrary",
+			"DELETE",
+			"/v1/{ns}/lib/{library}",
+			c.HandleDeleteFiles,
+			PermAdmin,
 		},
 		Route{
 			"GetLibrary",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions",
-			HandleListLibraryVersions,
+			c.HandleListLibraryVersions,
+			PermRead,
 		},
 		Route{
 			"GetLibrary",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}",
-			HandleGetLibraryVersion,
+			c.HandleGetLibraryVersion,
+			PermRead,
+		},
+		Route{
+			"DeleteLibraryVersion",
+			"DELETE",
+			"/v1/{ns}/lib/{library}/versions/{version}",
+			c.HandleDeleteFiles,
+			PermAdmin,
+		},
+		Route{
+			"GetDependencies",
+			"GET",
+			"/v1/{ns}/lib/{library}/versions/{version}/dependencies",
+			c.HandleGetDependencies,
+			PermRead,
+		},
+		Route{
+			"PutDependencies",
+			"PUT",
+			"/v1/{ns}/lib/{library}/versions/{version}/dependencies",
+			c.HandlePutDependencies,
+			PermWrite,
+		},
+		Route{
+			"ResolveLibrary",
+			"GET",
+			"/v1/{ns}/lib/{library}/versions/{version}/resolve/{platform}/{arch}",
+			c.HandleResolveLibrary,
+			PermRead,
+		},
+		Route{
+			"Resolve",
+			"POST",
+			"/v1/{ns}/resolve/{platform}/{arch}",
+			c.HandleResolve,
+			PermRead,
+		},
+		Route{
+			"PromoteLibraryVersion",
+			"POST",
+			"/v1/{ns}/lib/{library}/versions/{version}/promote",
+			c.HandlePromote,
+			PermWrite,
+		},
+		Route{
+			"BundleDownload",
+			"GET",
+			"/v1/{ns}/lib/{library}/versions/{version}/bundle/{platform}/{arch}",
+			c.HandleBundleDownload,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFiles",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFilesPlatform",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFilesPlatformArch",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFilesPlatformArchType",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFilesPlatformArchTypeName",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}",
-			HandleListFiles,
+			c.HandleListFiles,
+			PermRead,
 		},
 		Route{
-			"PutLibraryFilesPlatformArchTypeName",
-			"PUT",
+			"DeleteLibraryFilesPlatformArchTypeName",
+			"DELETE",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}",
-			HandlePutFile,
+			c.HandleDeleteFiles,
+			PermAdmin,
 		},
 		Route{
 			"GetLibraryFilesPlatformArchTypeNameLinks",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/links",
-			HandleGetFileLinks,
+			c.HandleGetFileLinks,
+			PermRead,
 		},
 		Route{
 			"GetLibraryFilesPlatformArchTypeNameLinks",
 			"PUT",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/links/{linkname}",
-			HandlePutLink,
+			c.HandlePutLink,
+			PermWrite,
+		},
+		Route{
+			"DeleteLibraryFilesPlatformArchTypeNameLink",
+			"DELETE",
+			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/links/{linkname}",
+			c.HandleDeleteLink,
+			PermAdmin,
 		},
 		Route{
 			"FileDownload",
 			"GET",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/download",
-			HandleFileDownload,
+			c.HandleFileDownload,
+			PermRead,
+		},
+		Route{
+			"FileDownloadHead",
+			"HEAD",
+			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/download",
+			c.HandleFileDownload,
+			PermRead,
 		},
 		Route{
 			"FileUpload",
 			"PUT",
 			"/v1/{ns}/lib/{library}/versions/{version}/files/{platform}/{arch}/{type}/{name}/upload",
-			HandleFileUpload,
+			c.HandleFileUpload,
+			PermWrite,
+		},
+		Route{
+			"OpenPublish",
+			"POST",
+			"/v1/{ns}/lib/{library}/versions/{version}/publish/{platform}/{arch}",
+			c.HandleOpenPublish,
+			PermWrite,
+		},
+		Route{
+			"GetPublish",
+			"GET",
+			"/v1/{ns}/publish/{session_id}",
+			c.HandleGetPublish,
+			PermWrite,
+		},
+		Route{
+			"AbortPublish",
+			"DELETE",
+			"/v1/{ns}/publish/{session_id}",
+			c.HandleAbortPublish,
+			PermWrite,
+		},
+		Route{
+			"PublishFile",
+			"PUT",
+			"/v1/{ns}/publish/{session_id}/files/{type}/{name}",
+			c.HandlePublishFile,
+			PermWrite,
+		},
+		Route{
+			"PublishLink",
+			"PUT",
+			"/v1/{ns}/publish/{session_id}/files/{type}/{name}/links/{linkname}",
+			c.HandlePublishLink,
+			PermWrite,
+		},
+		Route{
+			"CommitPublish",
+			"POST",
+			"/v1/{ns}/publish/{session_id}/commit",
+			c.HandleCommitPublish,
+			PermWrite,
 		},
 		Route{
 			"GetExtraFile",
 			"GET",
 			"/v1/{ns}/extra/{name}/{version}",
-			HandleGetExtraFile,
+			c.HandleGetExtraFile,
+			PermRead,
+		},
+		Route{
+			"DeleteExtraFile",
+			"DELETE",
+			"/v1/{ns}/extra/{name}/{version}",
+			c.HandleDeleteExtraFile,
+			PermAdmin,
 		},
 		Route{
 			"DownloadExtraFile",
 			"GET",
 			"/v1/{ns}/extra/{name}/{version}/download",
-			HandleDownloadExtraFile,
+			c.HandleDownloadExtraFile,
+			PermRead,
+		},
+		Route{
+			"DownloadExtraFileHead",
+			"HEAD",
+			"/v1/{ns}/extra/{name}/{version}/download",
+			c.HandleDownloadExtraFile,
+			PermRead,
 		},
 		Route{
 			"UploadExtraFile",
 			"PUT",
 			"/v1/{ns}/extra/{name}/{version}/upload",
-			HandleUploadExtraFile,
+			c.HandleUploadExtraFile,
+			PermWrite,
 		},
 	}
 }
@@ -0,0 +1,126 @@
+package depman
+
+import (
+	"fmt"
+	"time"
+)
+
+// MetadataStore is the persistence layer for everything depman knows
+// about files, file links, extra files, libraries and versions.
+//
+// Filters are maps of column name to value (library, version, ns, name,
+// type, platform, arch, checksum) and are matched exactly. An empty filter matches
+// everything.
+type MetadataStore interface {
+	GetFiles(filter map[string]interface{}) (Files, error)
+	StoreFile(f *File) error
+	// ReplaceFileContent sets checksum and size of a stored file, but
+	// only if its checksum is still previous; otherwise it returns
+	// ErrContentChanged and changes nothing
+	ReplaceFileContent(f *File, previous string) error
+	// DeleteFile removes a file together with its links
+	DeleteFile(fileId int) error
+
+	GetFileLinks(fileId int) (FileLinks, error)
+	StoreFileLink(fl *FileLink) error
+	DeleteFileLink(fileLinkId int) error
+
+	GetExtraFile(filter map[string]interface{}) (ExtraFile, error)
+	GetExtraFiles(filter map[string]interface{}) (ExtraFiles, error)
+	StoreExtraFile(f *ExtraFile) error
+	ReplaceExtraFileContent(f *ExtraFile, previous string) error
+	DeleteExtraFile(extraFileId int) error
+
+	// Publish sessions stage files which GetFiles does not see until
+	// CommitPublishSession stores them, with their links, all at once.
+	// It returns the files as they were before their contents were
+	// replaced. StagePublishFile replaces a staged file of the same type
+	// and name and returns its checksum ("" if there was none);
+	// DeletePublishSession returns what it removed.
+	StorePublishSession(s *PublishSession) error
+	GetPublishSession(id string) (PublishSession, error)
+	GetPublishSessions() ([]PublishSession, error)
+	StagePublishFile(id string, f *File) (string, error)
+	StagePublishLink(id string, fileType string, name string, linkname string) error
+	CommitPublishSession(id string) (Files, error)
+	DeletePublishSession(id string) (PublishSession, error)
+
+	// AddBlobRef records one more reference to the content with the
+	// given checksum, creating the record if needed. ReleaseBlobRef
+	// drops one and returns how many are left; the record is removed
+	// when none are.
+	AddBlobRef(checksum string, size int64) error
+	ReleaseBlobRef(checksum string) (int, error)
+	GetBlobRef(checksum string) (BlobRef, error)
+	ListBlobRefs() ([]BlobRef, error)
+	DeleteBlobRef(checksum string) error
+
+	// GetDependencies filters by ns, library, version and requires.
+	// StoreDependencies replaces all dependencies of a library version.
+	GetDependencies(filter map[string]interface{}) (Dependencies, error)
+	StoreDependencies(ns string, library string, version string, deps Dependencies) error
+
+	// StoreAuditEntry appends to the audit trail. GetAuditEntries
+	// returns it oldest first, filtered by ns and/or action.
+	StoreAuditEntry(e *AuditEntry) error
+	GetAuditEntries(filter map[string]interface{}) (AuditEntries, error)
+
+	// StoreToken records a new token, which only holds the hash of its
+	// secret
+	StoreToken(t *Token) error
+	// GetToken looks a token up by the hash of its secret
+	GetToken(hash string) (Token, error)
+	GetTokens() (Tokens, error)
+	DeleteToken(tokenId int) error
+
+	// StoreNamespace creates the record of a namespace or updates its
+	// parent and lock. GetNamespaceUsage sums up the contents of every
+	// namespace with files or extra files, recorded or not.
+	StoreNamespace(n *Namespace) error
+	GetNamespace(name string) (Namespace, error)
+	GetNamespaces() (Namespaces, error)
+	DeleteNamespace(name string) error
+	GetNamespaceUsage() (map[string]NamespaceUsage, error)
+
+	// Libraries and versions are listed per namespace
+	ListLibraries(ns string) (SimpleEntries, error)
+	GetLibrary(ns string, library string) (SimpleEntry, error)
+	ListVersions(ns string, library string) (SimpleEntries, error)
+
+	// FileVersions and ExtraFileVersions list the distinct versions of
+	// the rows matching filter; a "version" in the filter is ignored.
+	// Versions are resolved by ResolveVersion.
+	FileVersions(filter map[string]interface{}) ([]string, error)
+	ExtraFileVersions(filter map[string]interface{}) ([]string, error)
+
+	Close() error
+}
+
+// BlobRef is the reference count record of one stored content
+type BlobRef struct {
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	RefCount int       `json:"refcount"`
+	Created  time.Time `json:"created"`
+}
+
+// NewMetadataStore opens the metadata store selected by cfg.Driver
+func NewMetadataStore(cfg DBConfig) (MetadataStore, error) {
+	switch cfg.Driver {
+	case "", "postgres":
+		return NewPostgresStore(cfg)
+	case "memory":
+		return NewMemoryStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("Unknown database driver: %s", cfg.Driver)
+	}
+}
+
+// copyFilter returns a shallow copy so stores can modify the filter freely
+func copyFilter(filter map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(filter))
+	for k, v := range filter {
+		m[k] = v
+	}
+	return m
+}
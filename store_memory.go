@@ -0,0 +1,1040 @@
+package depman
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a MetadataStore that keeps everything in process memory.
+// If a path is given, the full state is written there as JSON after every
+// change and read back on startup, which is enough for a small single
+// binary installation.
+type MemoryStore struct {
+	sync.RWMutex
+	path string
+	data memoryData
+	// saved is the state last written to path
+	saved []byte
+}
+
+type memoryData struct {
+	Blobs            map[string]*memoryBlob `json:"blobs"`
+	Files            []File                 `json:"files"`
+	FileLinks        []FileLink             `json:"file_links"`
+	ExtraFiles       []ExtraFile            `json:"extra_files"`
+	Audit            AuditEntries           `json:"audit"`
+	Tokens           []memoryToken          `json:"tokens"`
+	Dependencies     Dependencies           `json:"dependencies"`
+	PublishSessions  []PublishSession       `json:"publish_sessions"`
+	Namespaces       Namespaces             `json:"namespaces"`
+	LastFileId       int                    `json:"last_file_id"`
+	LastFileLinkId   int                    `json:"last_file_link_id"`
+	LastExtraFileId  int                    `json:"last_extrafile_id"`
+	LastAuditId      int                    `json:"last_audit_id"`
+	LastTokenId      int                    `json:"last_token_id"`
+	LastDependencyId int                    `json:"last_dependency_id"`
+}
+
+type memoryBlob struct {
+	Size     int64     `json:"size"`
+	RefCount int       `json:"refcount"`
+	Created  time.Time `json:"created"`
+}
+
+// memoryToken persists the hash Token leaves out of its JSON
+type memoryToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+func NewMemoryStore(path string) (*MemoryStore, error) {
+	s := &MemoryStore{path: path}
+	s.data.Blobs = make(map[string]*memoryBlob)
+
+	if path == "" {
+		log.Warn("Using in-memory metadata store without persistence")
+		return s, nil
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		log.Infof("Metadata file %s does not exist yet - starting empty", path)
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err = json.Unmarshal(blob, &s.data); err != nil {
+		return nil, fmt.Errorf("Cannot parse metadata file %s: %s", path, err)
+	}
+	if s.data.Blobs == nil {
+		s.data.Blobs = make(map[string]*memoryBlob)
+	}
+	s.saved = blob
+
+	return s, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// persist writes the current state to disk. If that fails, the state is
+// rolled back to what was last written, so a change which was reported as
+// failed does not stay visible until the next restart. Callers must hold
+// the write lock.
+func (s *MemoryStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+
+	blob, err := json.Marshal(s.data)
+	if err == nil {
+		tmpfile := s.path + ".tmp"
+		if err = ioutil.WriteFile(tmpfile, blob, 0600); err == nil {
+			err = os.Rename(tmpfile, s.path)
+		}
+	}
+	if err != nil {
+		log.Errorf("Cannot write metadata file %s - rolling back: %s", s.path, err)
+		s.rollback()
+		return err
+	}
+
+	s.saved = blob
+	return nil
+}
+
+// rollback restores the state last written to disk
+func (s *MemoryStore) rollback() {
+	data := memoryData{}
+	if s.saved != nil {
+		if err := json.Unmarshal(s.saved, &data); err != nil {
+			// Cannot happen: we wrote it ourselves
+			log.Errorf("Cannot restore metadata: %s", err)
+			return
+		}
+	}
+	if data.Blobs == nil {
+		data.Blobs = make(map[string]*memoryBlob)
+	}
+	s.data = data
+}
+
+func fileColumn(f File, col string) string {
+	switch col {
+	case "library":
+		return f.Library
+	case "version":
+		return f.Version
+	case "ns":
+		return f.NameSpace
+	case "name":
+		return f.Name
+	case "type":
+		return f.Type
+	case "platform":
+		return f.Platform
+	case "arch":
+		return f.Arch
+	case "checksum":
+		return f.Checksum
+	}
+	return ""
+}
+
+func extraFileColumn(f ExtraFile, col string) string {
+	switch col {
+	case "version":
+		return f.Version
+	case "ns":
+		return f.NameSpace
+	case "name":
+		return f.Name
+	case "checksum":
+		return f.Checksum
+	}
+	return ""
+}
+
+func dependencyColumn(d Dependency, col string) string {
+	switch col {
+	case "ns":
+		return d.NameSpace
+	case "library":
+		return d.Library
+	case "version":
+		return d.Version
+	case "requires":
+		return d.Requires
+	}
+	return ""
+}
+
+func auditColumn(e AuditEntry, col string) string {
+	switch col {
+	case "ns":
+		return e.NameSpace
+	case "action":
+		return e.Action
+	}
+	return ""
+}
+
+func matchFilter(filter map[string]interface{}, column func(string) string) bool {
+	for col, val := range filter {
+		if column(col) != fmt.Sprint(val) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemoryStore) FileVersions(filter map[string]interface{}) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	filter = copyFilter(filter)
+	delete(filter, "version")
+
+	seen := make(map[string]bool)
+	for _, f := range s.data.Files {
+		f := f
+		if matchFilter(filter, func(col string) string { return fileColumn(f, col) }) {
+			seen[f.Version] = true
+		}
+	}
+
+	return sortedKeys(seen), nil
+}
+
+func (s *MemoryStore) ExtraFileVersions(filter map[string]interface{}) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	filter = copyFilter(filter)
+	delete(filter, "version")
+
+	seen := make(map[string]bool)
+	for _, f := range s.data.ExtraFiles {
+		f := f
+		if matchFilter(filter, func(col string) string { return extraFileColumn(f, col) }) {
+			seen[f.Version] = true
+		}
+	}
+
+	return sortedKeys(seen), nil
+}
+
+func (s *MemoryStore) GetFiles(filter map[string]interface{}) (Files, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	files := Files{}
+	for _, f := range s.data.Files {
+		f := f
+		if matchFilter(filter, func(col string) string { return fileColumn(f, col) }) {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+func (s *MemoryStore) StoreFile(f *File) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, existing := range s.data.Files {
+		if existing.Id != f.Id &&
+			existing.Library == f.Library && existing.Version == f.Version &&
+			existing.NameSpace == f.NameSpace && existing.Name == f.Name &&
+			existing.Type == f.Type && existing.Platform == f.Platform && existing.Arch == f.Arch {
+			return fmt.Errorf("File %s/%s/%s already exists", f.Library, f.Version, f.ToString())
+		}
+	}
+
+	for idx, existing := range s.data.Files {
+		if f.Id != 0 && existing.Id == f.Id {
+			f.Modified = time.Now()
+			stored := *f
+			stored.Links = nil
+			s.data.Files[idx] = stored
+			return s.persist()
+		}
+	}
+
+	if f.Id != 0 {
+		return ErrNotFound
+	}
+
+	s.data.LastFileId++
+	f.Id = s.data.LastFileId
+	f.Created = time.Now()
+	f.Modified = f.Created
+	stored := *f
+	stored.Links = nil
+	s.data.Files = append(s.data.Files, stored)
+	log.Debugf("Stored as: %d", f.Id)
+
+	return s.persist()
+}
+
+func (s *MemoryStore) ReplaceFileContent(f *File, previous string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.data.Files {
+		stored := &s.data.Files[idx]
+		if stored.Id != f.Id {
+			continue
+		}
+		if stored.Checksum != previous {
+			return ErrContentChanged
+		}
+		stored.Checksum = f.Checksum
+		stored.Size = f.Size
+		stored.Modified = time.Now()
+		f.Modified = stored.Modified
+		return s.persist()
+	}
+
+	return ErrContentChanged
+}
+
+func (s *MemoryStore) DeleteFile(file_id int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx, f := range s.data.Files {
+		if f.Id != file_id {
+			continue
+		}
+		s.data.Files = append(s.data.Files[:idx], s.data.Files[idx+1:]...)
+
+		// ON DELETE CASCADE
+		links := s.data.FileLinks[:0]
+		for _, fl := range s.data.FileLinks {
+			if fl.FileId != file_id {
+				links = append(links, fl)
+			}
+		}
+		s.data.FileLinks = links
+
+		return s.persist()
+	}
+
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetFileLinks(file_id int) (FileLinks, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	links := FileLinks{}
+	for _, fl := range s.data.FileLinks {
+		if fl.FileId == file_id {
+			links = append(links, fl)
+		}
+	}
+
+	return links, nil
+}
+
+func (s *MemoryStore) StoreFileLink(fl *FileLink) error {
+	s.Lock()
+	defer s.Unlock()
+
+	found := false
+	for _, f := range s.data.Files {
+		if f.Id == fl.FileId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("File %d does not exist", fl.FileId)
+	}
+
+	for _, existing := range s.data.FileLinks {
+		if existing.Id != fl.Id && existing.FileId == fl.FileId && existing.Name == fl.Name {
+			return fmt.Errorf("Link %s already exists for file %d", fl.Name, fl.FileId)
+		}
+	}
+
+	for idx, existing := range s.data.FileLinks {
+		if fl.Id != 0 && existing.Id == fl.Id {
+			s.data.FileLinks[idx] = *fl
+			return s.persist()
+		}
+	}
+
+	if fl.Id != 0 {
+		return ErrNotFound
+	}
+
+	s.data.LastFileLinkId++
+	fl.Id = s.data.LastFileLinkId
+	fl.Created = time.Now()
+	s.data.FileLinks = append(s.data.FileLinks, *fl)
+	log.Debugf("Stored as: %d", fl.Id)
+
+	return s.persist()
+}
+
+func (s *MemoryStore) DeleteFileLink(file_link_id int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx, fl := range s.data.FileLinks {
+		if fl.Id == file_link_id {
+			s.data.FileLinks = append(s.data.FileLinks[:idx], s.data.FileLinks[idx+1:]...)
+			return s.persist()
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetExtraFile(filter map[string]interface{}) (ExtraFile, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, f := range s.data.ExtraFiles {
+		if f.Version == fmt.Sprint(filter["version"]) &&
+			f.NameSpace == fmt.Sprint(filter["ns"]) &&
+			f.Name == fmt.Sprint(filter["name"]) {
+			return f, nil
+		}
+	}
+
+	return ExtraFile{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetExtraFiles(filter map[string]interface{}) (ExtraFiles, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	files := ExtraFiles{}
+	for _, f := range s.data.ExtraFiles {
+		f := f
+		if matchFilter(filter, func(col string) string { return extraFileColumn(f, col) }) {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+func (s *MemoryStore) StoreExtraFile(f *ExtraFile) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, existing := range s.data.ExtraFiles {
+		if existing.Id != f.Id && existing.Name == f.Name && existing.NameSpace == f.NameSpace && existing.Version == f.Version {
+			return fmt.Errorf("Extra file %s already exists", f.ToString())
+		}
+	}
+
+	for idx, existing := range s.data.ExtraFiles {
+		if f.Id != 0 && existing.Id == f.Id {
+			f.Modified = time.Now()
+			s.data.ExtraFiles[idx] = *f
+			return s.persist()
+		}
+	}
+
+	if f.Id != 0 {
+		return ErrNotFound
+	}
+
+	s.data.LastExtraFileId++
+	f.Id = s.data.LastExtraFileId
+	f.Created = time.Now()
+	f.Modified = f.Created
+	s.data.ExtraFiles = append(s.data.ExtraFiles, *f)
+	log.Debugf("Stored as: %d", f.Id)
+
+	return s.persist()
+}
+
+func (s *MemoryStore) ReplaceExtraFileContent(f *ExtraFile, previous string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.data.ExtraFiles {
+		stored := &s.data.ExtraFiles[idx]
+		if stored.Id != f.Id {
+			continue
+		}
+		if stored.Checksum != previous {
+			return ErrContentChanged
+		}
+		stored.Checksum = f.Checksum
+		stored.Size = f.Size
+		stored.Modified = time.Now()
+		f.Modified = stored.Modified
+		return s.persist()
+	}
+
+	return ErrContentChanged
+}
+
+func (s *MemoryStore) DeleteExtraFile(extrafile_id int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx, f := range s.data.ExtraFiles {
+		if f.Id == extrafile_id {
+			s.data.ExtraFiles = append(s.data.ExtraFiles[:idx], s.data.ExtraFiles[idx+1:]...)
+			return s.persist()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// copyPublishSession copies the staged files and their links so callers
+// cannot change the stored session
+func copyPublishSession(session PublishSession) PublishSession {
+	files := make(Files, len(session.Files))
+	for idx, f := range session.Files {
+		f.Links = append(FileLinks{}, f.Links...)
+		files[idx] = f
+	}
+	session.Files = files
+	return session
+}
+
+func (s *MemoryStore) publishSession(id string) (int, error) {
+	for idx, session := range s.data.PublishSessions {
+		if session.Id == id {
+			return idx, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *MemoryStore) StorePublishSession(session *PublishSession) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.publishSession(session.Id); err == nil {
+		return fmt.Errorf("Publish session %s already exists", session.Id)
+	}
+
+	session.Created = time.Now()
+	s.data.PublishSessions = append(s.data.PublishSessions, copyPublishSession(*session))
+	return s.persist()
+}
+
+func (s *MemoryStore) GetPublishSession(id string) (PublishSession, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	idx, err := s.publishSession(id)
+	if err != nil {
+		return PublishSession{}, err
+	}
+	return copyPublishSession(s.data.PublishSessions[idx]), nil
+}
+
+func (s *MemoryStore) GetPublishSessions() ([]PublishSession, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	sessions := make([]PublishSession, len(s.data.PublishSessions))
+	for idx, session := range s.data.PublishSessions {
+		sessions[idx] = copyPublishSession(session)
+	}
+	return sessions, nil
+}
+
+func (s *MemoryStore) StagePublishFile(id string, f *File) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, err := s.publishSession(id)
+	if err != nil {
+		return "", err
+	}
+	session := &s.data.PublishSessions[idx]
+
+	if staged, ok := session.stagedFile(f.Type, f.Name); ok {
+		previous := staged.Checksum
+		staged.Info = f.Info
+		staged.Checksum = f.Checksum
+		staged.Size = f.Size
+		return previous, s.persist()
+	}
+
+	stored := *f
+	stored.Links = FileLinks{}
+	session.Files = append(session.Files, stored)
+	return "", s.persist()
+}
+
+func (s *MemoryStore) StagePublishLink(id string, fileType string, name string, linkname string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, err := s.publishSession(id)
+	if err != nil {
+		return err
+	}
+	staged, ok := s.data.PublishSessions[idx].stagedFile(fileType, name)
+	if !ok {
+		return ErrNotFound
+	}
+
+	for _, link := range staged.Links {
+		if link.Name == linkname {
+			return nil
+		}
+	}
+	staged.Links = append(staged.Links, FileLink{Name: linkname})
+	return s.persist()
+}
+
+func (s *MemoryStore) CommitPublishSession(id string) (Files, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, err := s.publishSession(id)
+	if err != nil {
+		return nil, err
+	}
+	session := s.data.PublishSessions[idx]
+
+	replaced := Files{}
+	now := time.Now()
+	for _, staged := range session.Files {
+		fileId := 0
+		for fidx := range s.data.Files {
+			existing := &s.data.Files[fidx]
+			if existing.Library == staged.Library && existing.Version == staged.Version &&
+				existing.NameSpace == staged.NameSpace && existing.Name == staged.Name &&
+				existing.Type == staged.Type && existing.Platform == staged.Platform && existing.Arch == staged.Arch {
+				replaced = append(replaced, *existing)
+				// Uploads do not stage any info, keep what the file had then
+				if staged.Info != "" {
+					existing.Info = staged.Info
+				}
+				existing.Checksum = staged.Checksum
+				existing.Size = staged.Size
+				existing.Modified = now
+				fileId = existing.Id
+				break
+			}
+		}
+		if fileId == 0 {
+			s.data.LastFileId++
+			fileId = s.data.LastFileId
+			f := staged
+			f.Id = fileId
+			f.Created = now
+			f.Modified = now
+			f.Links = nil
+			s.data.Files = append(s.data.Files, f)
+		}
+
+		for _, link := range staged.Links {
+			exists := false
+			for _, fl := range s.data.FileLinks {
+				if fl.FileId == fileId && fl.Name == link.Name {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				s.data.LastFileLinkId++
+				s.data.FileLinks = append(s.data.FileLinks, FileLink{
+					Id:      s.data.LastFileLinkId,
+					FileId:  fileId,
+					Name:    link.Name,
+					Created: now,
+				})
+			}
+		}
+	}
+
+	s.data.PublishSessions = append(s.data.PublishSessions[:idx], s.data.PublishSessions[idx+1:]...)
+	return replaced, s.persist()
+}
+
+func (s *MemoryStore) DeletePublishSession(id string) (PublishSession, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, err := s.publishSession(id)
+	if err != nil {
+		return PublishSession{}, err
+	}
+	session := s.data.PublishSessions[idx]
+	s.data.PublishSessions = append(s.data.PublishSessions[:idx], s.data.PublishSessions[idx+1:]...)
+	return session, s.persist()
+}
+
+func (s *MemoryStore) AddBlobRef(checksum string, size int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	blob, ok := s.data.Blobs[checksum]
+	if !ok {
+		blob = &memoryBlob{Size: size, Created: time.Now()}
+		s.data.Blobs[checksum] = blob
+	}
+	blob.RefCount++
+
+	return s.persist()
+}
+
+func (s *MemoryStore) ReleaseBlobRef(checksum string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	blob, ok := s.data.Blobs[checksum]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	blob.RefCount--
+	remaining := blob.RefCount
+	if remaining <= 0 {
+		delete(s.data.Blobs, checksum)
+		remaining = 0
+	}
+
+	return remaining, s.persist()
+}
+
+func (s *MemoryStore) GetBlobRef(checksum string) (BlobRef, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	blob, ok := s.data.Blobs[checksum]
+	if !ok {
+		return BlobRef{}, ErrNotFound
+	}
+	return BlobRef{
+		Checksum: checksum,
+		Size:     blob.Size,
+		RefCount: blob.RefCount,
+		Created:  blob.Created,
+	}, nil
+}
+
+func (s *MemoryStore) ListBlobRefs() ([]BlobRef, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	refs := []BlobRef{}
+	for checksum, blob := range s.data.Blobs {
+		refs = append(refs, BlobRef{
+			Checksum: checksum,
+			Size:     blob.Size,
+			RefCount: blob.RefCount,
+			Created:  blob.Created,
+		})
+	}
+
+	return refs, nil
+}
+
+func (s *MemoryStore) DeleteBlobRef(checksum string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.data.Blobs, checksum)
+	return s.persist()
+}
+
+func (s *MemoryStore) GetDependencies(filter map[string]interface{}) (Dependencies, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	deps := Dependencies{}
+	for _, d := range s.data.Dependencies {
+		d := d
+		if matchFilter(filter, func(col string) string { return dependencyColumn(d, col) }) {
+			deps = append(deps, d)
+		}
+	}
+
+	return deps, nil
+}
+
+func (s *MemoryStore) StoreDependencies(ns string, library string, version string, deps Dependencies) error {
+	s.Lock()
+	defer s.Unlock()
+
+	kept := s.data.Dependencies[:0]
+	for _, d := range s.data.Dependencies {
+		if d.NameSpace != ns || d.Library != library || d.Version != version {
+			kept = append(kept, d)
+		}
+	}
+	s.data.Dependencies = kept
+
+	for idx := range deps {
+		s.data.LastDependencyId++
+		deps[idx].Id = s.data.LastDependencyId
+		deps[idx].Created = time.Now()
+		s.data.Dependencies = append(s.data.Dependencies, deps[idx])
+	}
+
+	return s.persist()
+}
+
+func (s *MemoryStore) StoreAuditEntry(e *AuditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.data.LastAuditId++
+	e.Id = s.data.LastAuditId
+	e.Created = time.Now()
+	s.data.Audit = append(s.data.Audit, *e)
+
+	return s.persist()
+}
+
+func (s *MemoryStore) GetAuditEntries(filter map[string]interface{}) (AuditEntries, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	entries := AuditEntries{}
+	for _, e := range s.data.Audit {
+		e := e
+		if matchFilter(filter, func(col string) string { return auditColumn(e, col) }) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) StoreToken(t *Token) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, existing := range s.data.Tokens {
+		if existing.Hash == t.Hash {
+			return fmt.Errorf("Token %s already exists", existing.Name)
+		}
+	}
+
+	s.data.LastTokenId++
+	t.Id = s.data.LastTokenId
+	t.Created = time.Now()
+	s.data.Tokens = append(s.data.Tokens, memoryToken{Token: *t, Hash: t.Hash})
+
+	return s.persist()
+}
+
+func (s *MemoryStore) GetToken(hash string) (Token, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, t := range s.data.Tokens {
+		if t.Hash == hash {
+			token := t.Token
+			token.Hash = t.Hash
+			return token, nil
+		}
+	}
+
+	return Token{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetTokens() (Tokens, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	tokens := Tokens{}
+	for _, t := range s.data.Tokens {
+		tokens = append(tokens, t.Token)
+	}
+
+	return tokens, nil
+}
+
+func (s *MemoryStore) DeleteToken(token_id int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx, t := range s.data.Tokens {
+		if t.Id == token_id {
+			s.data.Tokens = append(s.data.Tokens[:idx], s.data.Tokens[idx+1:]...)
+			return s.persist()
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *MemoryStore) StoreNamespace(n *Namespace) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.data.Namespaces {
+		if s.data.Namespaces[idx].Name == n.Name {
+			s.data.Namespaces[idx].Parent = n.Parent
+			s.data.Namespaces[idx].Locked = n.Locked
+			n.Created = s.data.Namespaces[idx].Created
+			return s.persist()
+		}
+	}
+
+	n.Created = time.Now()
+	s.data.Namespaces = append(s.data.Namespaces, Namespace{Name: n.Name, Parent: n.Parent, Locked: n.Locked, Created: n.Created})
+
+	return s.persist()
+}
+
+func (s *MemoryStore) GetNamespace(name string) (Namespace, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, n := range s.data.Namespaces {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+
+	return Namespace{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetNamespaces() (Namespaces, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	namespaces := make(Namespaces, len(s.data.Namespaces))
+	copy(namespaces, s.data.Namespaces)
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+
+	return namespaces, nil
+}
+
+func (s *MemoryStore) DeleteNamespace(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx, n := range s.data.Namespaces {
+		if n.Name == name {
+			s.data.Namespaces = append(s.data.Namespaces[:idx], s.data.Namespaces[idx+1:]...)
+			return s.persist()
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetNamespaceUsage() (map[string]NamespaceUsage, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	usage := make(map[string]*NamespaceUsage)
+	get := func(ns string) *NamespaceUsage {
+		if _, ok := usage[ns]; !ok {
+			usage[ns] = &NamespaceUsage{}
+		}
+		return usage[ns]
+	}
+
+	libraries := make(map[string]bool)
+	versions := make(map[string]bool)
+	for _, f := range s.data.Files {
+		u := get(f.NameSpace)
+		if key := f.NameSpace + "/" + f.Library; !libraries[key] {
+			libraries[key] = true
+			u.Libraries++
+		}
+		if key := f.NameSpace + "/" + f.Library + "/" + f.Version; !versions[key] {
+			versions[key] = true
+			u.Versions++
+		}
+		u.Files++
+		u.Size += f.Size
+		u.touch(f.Created)
+		u.touch(f.Modified)
+	}
+	for _, f := range s.data.ExtraFiles {
+		u := get(f.NameSpace)
+		u.ExtraFiles++
+		u.Size += f.Size
+		u.touch(f.Created)
+		u.touch(f.Modified)
+	}
+
+	result := make(map[string]NamespaceUsage, len(usage))
+	for ns, u := range usage {
+		result[ns] = *u
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) ListLibraries(ns string) (SimpleEntries, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, f := range s.data.Files {
+		if f.NameSpace == ns {
+			seen[f.Library] = true
+		}
+	}
+
+	return sortedEntries(seen), nil
+}
+
+func (s *MemoryStore) GetLibrary(ns string, library string) (SimpleEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, f := range s.data.Files {
+		if f.NameSpace == ns && f.Library == library {
+			return SimpleEntry{Name: library}, nil
+		}
+	}
+
+	return SimpleEntry{}, ErrNotFound
+}
+
+func (s *MemoryStore) ListVersions(ns string, library string) (SimpleEntries, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, f := range s.data.Files {
+		if f.NameSpace == ns && f.Library == library {
+			seen[f.Version] = true
+		}
+	}
+
+	return sortedEntries(seen), nil
+}
+
+func sortedKeys(seen map[string]bool) []string {
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedEntries(seen map[string]bool) SimpleEntries {
+	entries := SimpleEntries{}
+	for _, name := range sortedKeys(seen) {
+		entries = append(entries, SimpleEntry{Name: name})
+	}
+	return entries
+}
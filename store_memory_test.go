@@ -0,0 +1,113 @@
+package depman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFile(name string) *File {
+	return &File{
+		Library:   "foo",
+		Version:   "1.0",
+		NameSpace: "default",
+		Name:      name,
+		Type:      "lib",
+		Platform:  "el7",
+		Arch:      "x86_64",
+		Checksum:  "abc",
+		Size:      3,
+	}
+}
+
+func TestMemoryStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+
+	s, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreFile(newTestFile("libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := reopened.GetFiles(map[string]interface{}{"library": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "libfoo.so" {
+		t.Errorf("Reopened store has %v, want libfoo.so", files)
+	}
+}
+
+func TestMemoryStoreRollsBackFailedPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+
+	s, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreFile(newTestFile("libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the temporary file makes every write fail
+	if err = os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreFile(newTestFile("libfoo.a")); err == nil {
+		t.Fatal("StoreFile succeeded although the metadata file cannot be written")
+	}
+	if err = s.AddBlobRef("abc", 3); err == nil {
+		t.Fatal("AddBlobRef succeeded although the metadata file cannot be written")
+	}
+
+	files, err := s.GetFiles(map[string]interface{}{"library": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "libfoo.so" {
+		t.Errorf("Failed change is visible: have %v, want only libfoo.so", files)
+	}
+	refs, err := s.ListBlobRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("Failed blob reference is visible: %v", refs)
+	}
+
+	// Writable again: later changes build on the rolled back state
+	if err = os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreFile(newTestFile("libfoo.a")); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err = reopened.GetFiles(map[string]interface{}{"library": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Reopened store has %d files, want 2", len(files))
+	}
+}
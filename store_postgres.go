@@ -0,0 +1,1057 @@
+package depman
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// PostgresStore is the MetadataStore backed by the schema in
+// postgres/depman-schema.sql
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(cfg DBConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", cfg.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
+
+	log.WithFields(log.Fields{
+		"host":     cfg.Host,
+		"dbname":   cfg.Name,
+		"sslmode":  cfg.SSLMode,
+		"max_open": cfg.MaxOpenConns,
+		"max_idle": cfg.MaxIdleConns,
+	}).Debug("Database configured")
+
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// whereClause turns a filter into "col = $n" clauses joined by AND,
+// numbering placeholders from 1.
+func whereClause(filter map[string]interface{}) (string, []interface{}) {
+	var i int = 0
+	var values = make([]interface{}, len(filter))
+	var where_clauses = make([]string, len(filter))
+	for col, val := range filter {
+		where_clauses[i] = fmt.Sprintf("%s = $%d", col, i+1)
+		values[i] = val
+		i++
+	}
+
+	return strings.Join(where_clauses, " AND "), values
+}
+
+func (s *PostgresStore) versions(filter map[string]interface{}, table string) ([]string, error) {
+	versions := []string{}
+
+	filter = copyFilter(filter)
+	delete(filter, "version")
+
+	where, values := whereClause(filter)
+	query := fmt.Sprintf("SELECT DISTINCT(version) FROM %s", table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	log.Debugf("Versions query: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version string
+		rows.Scan(&version)
+
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (s *PostgresStore) FileVersions(filter map[string]interface{}) ([]string, error) {
+	return s.versions(filter, "files")
+}
+
+func (s *PostgresStore) ExtraFileVersions(filter map[string]interface{}) ([]string, error) {
+	return s.versions(filter, "extrafiles")
+}
+
+func (s *PostgresStore) GetFiles(filter map[string]interface{}) (Files, error) {
+	files := Files{}
+
+	where, values := whereClause(filter)
+	query := `SELECT file_id, library, version, ns, name, type, platform, arch, info, checksum, size, created, modified
+		FROM files`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	log.Debugf("Filterquery: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return files, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file := File{}
+		rows.Scan(&file.Id, &file.Library, &file.Version, &file.NameSpace, &file.Name, &file.Type, &file.Platform, &file.Arch, &file.Info, &file.Checksum, &file.Size, &file.Created, &file.Modified)
+
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+func (s *PostgresStore) StoreFile(f *File) error {
+	if f.Id != 0 {
+		query := `UPDATE files SET library=$1, version=$2, ns=$3, name=$4, type=$5, platform=$6, arch=$7, info=$8, checksum=$9, size=$10, modified=now()
+			WHERE file_id = $11
+			RETURNING modified`
+		return s.db.QueryRow(query, f.Library, f.Version, f.NameSpace, f.Name, f.Type, f.Platform, f.Arch, f.Info, f.Checksum, f.Size, f.Id).Scan(&f.Modified)
+	}
+
+	query := `INSERT INTO files (library, version, ns, name, type, platform, arch, info, checksum, size)
+		VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING file_id, created, modified
+		`
+
+	var lastInsertId int
+	err := s.db.QueryRow(query, f.Library, f.Version, f.NameSpace, f.Name, f.Type, f.Platform, f.Arch, f.Info, f.Checksum, f.Size).Scan(&lastInsertId, &f.Created, &f.Modified)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Stored as: %d", lastInsertId)
+	f.Id = lastInsertId
+
+	return nil
+}
+
+func (s *PostgresStore) ReplaceFileContent(f *File, previous string) error {
+	query := `UPDATE files SET checksum=$1, size=$2, modified=now()
+		WHERE file_id = $3 AND checksum = $4
+		RETURNING modified`
+	err := s.db.QueryRow(query, f.Checksum, f.Size, f.Id, previous).Scan(&f.Modified)
+	if err == sql.ErrNoRows {
+		return ErrContentChanged
+	}
+	return err
+}
+
+func (s *PostgresStore) DeleteFile(file_id int) error {
+	query := `DELETE FROM files WHERE file_id = $1`
+	log.Debugf("Query: %s", query)
+
+	res, err := s.db.Exec(query, file_id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetFileLinks(file_id int) (FileLinks, error) {
+	links := FileLinks{}
+
+	query := `SELECT file_link_id, file_id, name, created
+		FROM filelinks
+		WHERE file_id = $1`
+
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query, file_id)
+	if err != nil {
+		return links, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		fl := FileLink{}
+		rows.Scan(&fl.Id, &fl.FileId, &fl.Name, &fl.Created)
+
+		links = append(links, fl)
+	}
+
+	return links, rows.Err()
+}
+
+func (s *PostgresStore) StoreFileLink(fl *FileLink) error {
+	if fl.Id != 0 {
+		query := `UPDATE filelinks SET file_id=$1, name=$2 WHERE file_link_id = $3`
+		_, err := s.db.Exec(query, fl.FileId, fl.Name, fl.Id)
+		return err
+	}
+
+	query := `INSERT INTO filelinks (file_id, name)
+		VALUES
+		($1, $2)
+		RETURNING file_link_id, created
+		`
+
+	var lastInsertId int
+	err := s.db.QueryRow(query, fl.FileId, fl.Name).Scan(&lastInsertId, &fl.Created)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Stored as: %d", lastInsertId)
+	fl.Id = lastInsertId
+
+	return nil
+}
+
+func (s *PostgresStore) DeleteFileLink(file_link_id int) error {
+	query := `DELETE FROM filelinks WHERE file_link_id = $1`
+	log.Debugf("Query: %s", query)
+
+	res, err := s.db.Exec(query, file_link_id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetExtraFile(filter map[string]interface{}) (ExtraFile, error) {
+	ef := ExtraFile{}
+
+	query := `SELECT extrafile_id, version, ns, name, info, checksum, size, created, modified
+		FROM extrafiles
+		WHERE version=$1 AND ns=$2 AND name=$3`
+
+	log.Debugf("Query: %s", query)
+	err := s.db.QueryRow(query,
+		filter["version"],
+		filter["ns"],
+		filter["name"]).
+		Scan(&ef.Id, &ef.Version, &ef.NameSpace, &ef.Name, &ef.Info, &ef.Checksum, &ef.Size, &ef.Created, &ef.Modified)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return ef, ErrNotFound
+	case err != nil:
+		log.Error(err)
+		return ef, err
+	}
+
+	return ef, err
+}
+
+func (s *PostgresStore) GetExtraFiles(filter map[string]interface{}) (ExtraFiles, error) {
+	files := ExtraFiles{}
+
+	where, values := whereClause(filter)
+	query := `SELECT extrafile_id, version, ns, name, info, checksum, size, created, modified
+		FROM extrafiles`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	log.Debugf("Filterquery: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return files, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ef := ExtraFile{}
+		rows.Scan(&ef.Id, &ef.Version, &ef.NameSpace, &ef.Name, &ef.Info, &ef.Checksum, &ef.Size, &ef.Created, &ef.Modified)
+
+		files = append(files, ef)
+	}
+
+	return files, rows.Err()
+}
+
+func (s *PostgresStore) StoreExtraFile(f *ExtraFile) error {
+	if f.Id != 0 {
+		query := `UPDATE extrafiles SET version=$1, ns=$2, name=$3, info=$4, checksum=$5, size=$6, modified=now()
+			WHERE extrafile_id = $7
+			RETURNING modified`
+		return s.db.QueryRow(query, f.Version, f.NameSpace, f.Name, f.Info, f.Checksum, f.Size, f.Id).Scan(&f.Modified)
+	}
+
+	query := `INSERT INTO extrafiles (version, ns, name, info, checksum, size)
+		VALUES
+		($1, $2, $3, $4, $5, $6)
+		RETURNING extrafile_id, created, modified
+		`
+
+	var lastInsertId int
+	err := s.db.QueryRow(query, f.Version, f.NameSpace, f.Name, f.Info, f.Checksum, f.Size).Scan(&lastInsertId, &f.Created, &f.Modified)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Stored as: %d", lastInsertId)
+	f.Id = lastInsertId
+
+	return nil
+}
+
+func (s *PostgresStore) ReplaceExtraFileContent(f *ExtraFile, previous string) error {
+	query := `UPDATE extrafiles SET checksum=$1, size=$2, modified=now()
+		WHERE extrafile_id = $3 AND checksum = $4
+		RETURNING modified`
+	err := s.db.QueryRow(query, f.Checksum, f.Size, f.Id, previous).Scan(&f.Modified)
+	if err == sql.ErrNoRows {
+		return ErrContentChanged
+	}
+	return err
+}
+
+func (s *PostgresStore) DeleteExtraFile(extrafile_id int) error {
+	query := `DELETE FROM extrafiles WHERE extrafile_id = $1`
+	log.Debugf("Query: %s", query)
+
+	res, err := s.db.Exec(query, extrafile_id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) AddBlobRef(checksum string, size int64) error {
+	query := `INSERT INTO blobs (checksum, size, refcount)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (checksum) DO UPDATE SET refcount = blobs.refcount + 1`
+	log.Debugf("Query: %s", query)
+
+	_, err := s.db.Exec(query, checksum, size)
+	return err
+}
+
+func (s *PostgresStore) ReleaseBlobRef(checksum string) (int, error) {
+	query := `UPDATE blobs SET refcount = refcount - 1 WHERE checksum = $1 RETURNING refcount`
+	log.Debugf("Query: %s", query)
+
+	var remaining int
+	err := s.db.QueryRow(query, checksum).Scan(&remaining)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, ErrNotFound
+	case err != nil:
+		return 0, err
+	}
+
+	if remaining <= 0 {
+		_, err = s.db.Exec(`DELETE FROM blobs WHERE checksum = $1 AND refcount <= 0`, checksum)
+		return 0, err
+	}
+
+	return remaining, nil
+}
+
+func (s *PostgresStore) GetBlobRef(checksum string) (BlobRef, error) {
+	ref := BlobRef{}
+
+	query := `SELECT checksum, size, refcount, created FROM blobs WHERE checksum = $1`
+	log.Debugf("Query: %s", query)
+
+	err := s.db.QueryRow(query, checksum).Scan(&ref.Checksum, &ref.Size, &ref.RefCount, &ref.Created)
+	if err == sql.ErrNoRows {
+		return ref, ErrNotFound
+	}
+	return ref, err
+}
+
+func (s *PostgresStore) ListBlobRefs() ([]BlobRef, error) {
+	refs := []BlobRef{}
+
+	query := `SELECT checksum, size, refcount, created FROM blobs`
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return refs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ref := BlobRef{}
+		rows.Scan(&ref.Checksum, &ref.Size, &ref.RefCount, &ref.Created)
+
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+func (s *PostgresStore) DeleteBlobRef(checksum string) error {
+	query := `DELETE FROM blobs WHERE checksum = $1`
+	log.Debugf("Query: %s", query)
+
+	_, err := s.db.Exec(query, checksum)
+	return err
+}
+
+func (s *PostgresStore) GetDependencies(filter map[string]interface{}) (Dependencies, error) {
+	deps := Dependencies{}
+
+	where, values := whereClause(filter)
+	query := `SELECT dependency_id, ns, library, version, requires, version_constraint, wanted, created
+		FROM dependencies`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY dependency_id"
+	log.Debugf("Filterquery: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return deps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := Dependency{}
+		rows.Scan(&d.Id, &d.NameSpace, &d.Library, &d.Version, &d.Requires, &d.Constraint, &d.Wanted, &d.Created)
+
+		deps = append(deps, d)
+	}
+
+	return deps, rows.Err()
+}
+
+func (s *PostgresStore) StoreDependencies(ns string, library string, version string, deps Dependencies) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM dependencies WHERE ns = $1 AND library = $2 AND version = $3`, ns, library, version)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO dependencies (ns, library, version, requires, version_constraint, wanted)
+		VALUES
+		($1, $2, $3, $4, $5, $6)
+		RETURNING dependency_id, created
+		`
+	for idx := range deps {
+		d := &deps[idx]
+		err = tx.QueryRow(query, ns, library, version, d.Requires, d.Constraint, d.Wanted).Scan(&d.Id, &d.Created)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) StoreAuditEntry(e *AuditEntry) error {
+	query := `INSERT INTO audit (action, ns, object, actor, detail)
+		VALUES
+		($1, $2, $3, $4, $5)
+		RETURNING audit_id, created
+		`
+
+	return s.db.QueryRow(query, e.Action, e.NameSpace, e.Object, e.Actor, e.Detail).Scan(&e.Id, &e.Created)
+}
+
+func (s *PostgresStore) GetAuditEntries(filter map[string]interface{}) (AuditEntries, error) {
+	entries := AuditEntries{}
+
+	where, values := whereClause(filter)
+	query := `SELECT audit_id, action, ns, object, actor, detail, created FROM audit`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY audit_id"
+	log.Debugf("Filterquery: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := AuditEntry{}
+		rows.Scan(&e.Id, &e.Action, &e.NameSpace, &e.Object, &e.Actor, &e.Detail, &e.Created)
+
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) StoreToken(t *Token) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO tokens (name, hash)
+		VALUES
+		($1, $2)
+		RETURNING token_id, created
+		`
+	if err = tx.QueryRow(query, t.Name, t.Hash).Scan(&t.Id, &t.Created); err != nil {
+		return err
+	}
+
+	for _, g := range t.Grants {
+		_, err = tx.Exec(`INSERT INTO token_grants (token_id, ns, level) VALUES ($1, $2, $3)`, t.Id, g.NameSpace, g.Level)
+		if err != nil {
+			return err
+		}
+	}
+	log.Debugf("Stored as: %d", t.Id)
+
+	return tx.Commit()
+}
+
+// tokenGrants loads the grants of the tokens matching where, keyed by
+// token id
+func (s *PostgresStore) tokenGrants(where string, values ...interface{}) (map[int][]Grant, error) {
+	grants := make(map[int][]Grant)
+
+	query := `SELECT token_id, ns, level FROM token_grants`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return grants, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tokenId int
+		g := Grant{}
+		rows.Scan(&tokenId, &g.NameSpace, &g.Level)
+
+		grants[tokenId] = append(grants[tokenId], g)
+	}
+
+	return grants, rows.Err()
+}
+
+func (s *PostgresStore) GetToken(hash string) (Token, error) {
+	t := Token{}
+
+	query := `SELECT token_id, name, hash, created FROM tokens WHERE hash = $1`
+	err := s.db.QueryRow(query, hash).Scan(&t.Id, &t.Name, &t.Hash, &t.Created)
+	switch {
+	case err == sql.ErrNoRows:
+		return t, ErrNotFound
+	case err != nil:
+		return t, err
+	}
+
+	grants, err := s.tokenGrants("token_id = $1", t.Id)
+	t.Grants = grants[t.Id]
+
+	return t, err
+}
+
+func (s *PostgresStore) GetTokens() (Tokens, error) {
+	tokens := Tokens{}
+
+	query := `SELECT token_id, name, created FROM tokens ORDER BY token_id`
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Token{}
+		rows.Scan(&t.Id, &t.Name, &t.Created)
+
+		tokens = append(tokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		return tokens, err
+	}
+
+	grants, err := s.tokenGrants("")
+	for idx := range tokens {
+		tokens[idx].Grants = grants[tokens[idx].Id]
+	}
+
+	return tokens, err
+}
+
+func (s *PostgresStore) DeleteToken(token_id int) error {
+	query := `DELETE FROM tokens WHERE token_id = $1`
+	log.Debugf("Query: %s", query)
+
+	res, err := s.db.Exec(query, token_id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) StoreNamespace(n *Namespace) error {
+	query := `INSERT INTO namespaces (ns, parent, locked)
+		VALUES
+		($1, $2, $3)
+		ON CONFLICT (ns) DO UPDATE SET parent = EXCLUDED.parent, locked = EXCLUDED.locked
+		RETURNING created
+		`
+	log.Debugf("Query: %s", query)
+
+	return s.db.QueryRow(query, n.Name, n.Parent, n.Locked).Scan(&n.Created)
+}
+
+func (s *PostgresStore) GetNamespace(name string) (Namespace, error) {
+	n := Namespace{}
+
+	query := `SELECT ns, parent, locked, created FROM namespaces WHERE ns = $1`
+	err := s.db.QueryRow(query, name).Scan(&n.Name, &n.Parent, &n.Locked, &n.Created)
+	if err == sql.ErrNoRows {
+		return n, ErrNotFound
+	}
+
+	return n, err
+}
+
+func (s *PostgresStore) GetNamespaces() (Namespaces, error) {
+	namespaces := Namespaces{}
+
+	query := `SELECT ns, parent, locked, created FROM namespaces ORDER BY ns`
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return namespaces, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		n := Namespace{}
+		rows.Scan(&n.Name, &n.Parent, &n.Locked, &n.Created)
+
+		namespaces = append(namespaces, n)
+	}
+
+	return namespaces, rows.Err()
+}
+
+func (s *PostgresStore) DeleteNamespace(name string) error {
+	query := `DELETE FROM namespaces WHERE ns = $1`
+	log.Debugf("Query: %s", query)
+
+	res, err := s.db.Exec(query, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetNamespaceUsage() (map[string]NamespaceUsage, error) {
+	usage := make(map[string]NamespaceUsage)
+
+	query := `SELECT ns, COUNT(DISTINCT library), COUNT(DISTINCT (library, version)), COUNT(*),
+		COALESCE(SUM(size), 0), MAX(GREATEST(created, modified))
+		FROM files
+		GROUP BY ns`
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return usage, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ns string
+		var last *time.Time
+		u := NamespaceUsage{}
+		if err = rows.Scan(&ns, &u.Libraries, &u.Versions, &u.Files, &u.Size, &last); err != nil {
+			return usage, err
+		}
+		if last != nil {
+			u.LastActivity = *last
+		}
+		usage[ns] = u
+	}
+	if err = rows.Err(); err != nil {
+		return usage, err
+	}
+	rows.Close()
+
+	query = `SELECT ns, COUNT(*), COALESCE(SUM(size), 0), MAX(GREATEST(created, modified))
+		FROM extrafiles
+		GROUP BY ns`
+	log.Debugf("Query: %s", query)
+
+	extraRows, err := s.db.Query(query)
+	if err != nil {
+		return usage, err
+	}
+	defer extraRows.Close()
+
+	for extraRows.Next() {
+		var ns string
+		var count int
+		var size int64
+		var last *time.Time
+		if err = extraRows.Scan(&ns, &count, &size, &last); err != nil {
+			return usage, err
+		}
+		u := usage[ns]
+		u.ExtraFiles = count
+		u.Size += size
+		if last != nil {
+			u.touch(*last)
+		}
+		usage[ns] = u
+	}
+
+	return usage, extraRows.Err()
+}
+
+func (s *PostgresStore) ListLibraries(ns string) (SimpleEntries, error) {
+	entries := SimpleEntries{}
+
+	query := "SELECT DISTINCT(library) FROM files WHERE ns = $1"
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query, ns)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := SimpleEntry{}
+		rows.Scan(&entry.Name)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) GetLibrary(ns string, library string) (SimpleEntry, error) {
+	entry := SimpleEntry{}
+
+	query := "SELECT library FROM files WHERE ns = $1 AND library = $2 LIMIT 1"
+	log.Debugf("Query: %s", query)
+
+	err := s.db.
+		QueryRow(query, ns, library).
+		Scan(&entry.Name)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return entry, ErrNotFound
+	case err != nil:
+		log.Error(err)
+		return entry, err
+	}
+
+	return entry, nil
+}
+
+func (s *PostgresStore) ListVersions(ns string, library string) (SimpleEntries, error) {
+	entries := SimpleEntries{}
+
+	query := "SELECT DISTINCT(version) FROM files WHERE ns = $1 AND library = $2"
+	log.Debugf("Query: %s", query)
+
+	rows, err := s.db.Query(query, ns, library)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := SimpleEntry{}
+		rows.Scan(&entry.Name)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// pgQueryer is what *sql.DB and *sql.Tx have in common
+type pgQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *PostgresStore) StorePublishSession(session *PublishSession) error {
+	query := `INSERT INTO publish_sessions (session_id, ns, library, version, platform, arch)
+		VALUES
+		($1, $2, $3, $4, $5, $6)
+		RETURNING created
+		`
+
+	return s.db.QueryRow(query, session.Id, session.NameSpace, session.Library, session.Version,
+		session.Platform, session.Arch).Scan(&session.Created)
+}
+
+// getPublishSession loads a session with its staged files. lock is
+// appended to the query, e.g. " FOR UPDATE" inside a transaction.
+func getPublishSession(q pgQueryer, id string, lock string) (PublishSession, error) {
+	session := PublishSession{}
+
+	query := `SELECT session_id, ns, library, version, platform, arch, created
+		FROM publish_sessions
+		WHERE session_id = $1` + lock
+	err := q.QueryRow(query, id).Scan(&session.Id, &session.NameSpace, &session.Library, &session.Version,
+		&session.Platform, &session.Arch, &session.Created)
+	switch {
+	case err == sql.ErrNoRows:
+		return session, ErrNotFound
+	case err != nil:
+		return session, err
+	}
+
+	return session, loadPublishFiles(q, &session)
+}
+
+// loadPublishFiles reads the staged files of a session and their links.
+// Each result is closed before the next query, transactions cannot have
+// two open at once.
+func loadPublishFiles(q pgQueryer, session *PublishSession) error {
+	session.Files = Files{}
+
+	rows, err := q.Query(`SELECT type, name, info, checksum, size FROM publish_files WHERE session_id = $1 ORDER BY type, name`, session.Id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		f := session.newFile("", "")
+		f.Links = FileLinks{}
+		rows.Scan(&f.Type, &f.Name, &f.Info, &f.Checksum, &f.Size)
+		session.Files = append(session.Files, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = q.Query(`SELECT type, name, linkname FROM publish_links WHERE session_id = $1 ORDER BY linkname`, session.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileType, name, linkname string
+		rows.Scan(&fileType, &name, &linkname)
+		if staged, ok := session.stagedFile(fileType, name); ok {
+			staged.Links = append(staged.Links, FileLink{Name: linkname})
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *PostgresStore) GetPublishSession(id string) (PublishSession, error) {
+	return getPublishSession(s.db, id, "")
+}
+
+func (s *PostgresStore) GetPublishSessions() ([]PublishSession, error) {
+	sessions := []PublishSession{}
+
+	rows, err := s.db.Query(`SELECT session_id, ns, library, version, platform, arch, created
+		FROM publish_sessions
+		ORDER BY created`)
+	if err != nil {
+		return sessions, err
+	}
+	for rows.Next() {
+		session := PublishSession{}
+		rows.Scan(&session.Id, &session.NameSpace, &session.Library, &session.Version,
+			&session.Platform, &session.Arch, &session.Created)
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return sessions, err
+	}
+
+	for idx := range sessions {
+		if err = loadPublishFiles(s.db, &sessions[idx]); err != nil {
+			return sessions, err
+		}
+	}
+	return sessions, nil
+}
+
+// lockPublishSession takes a share lock on the session, so it cannot be
+// committed or aborted until tx ends
+func lockPublishSession(tx *sql.Tx, id string) error {
+	var found string
+	err := tx.QueryRow(`SELECT session_id FROM publish_sessions WHERE session_id = $1 FOR SHARE`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) StagePublishFile(id string, f *File) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err = lockPublishSession(tx, id); err != nil {
+		return "", err
+	}
+
+	var previous string
+	err = tx.QueryRow(`SELECT checksum FROM publish_files WHERE session_id = $1 AND type = $2 AND name = $3 FOR UPDATE`,
+		id, f.Type, f.Name).Scan(&previous)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO publish_files (session_id, type, name, info, checksum, size) VALUES ($1, $2, $3, $4, $5, $6)`,
+			id, f.Type, f.Name, f.Info, f.Checksum, f.Size)
+	case err == nil:
+		_, err = tx.Exec(`UPDATE publish_files SET info = $4, checksum = $5, size = $6 WHERE session_id = $1 AND type = $2 AND name = $3`,
+			id, f.Type, f.Name, f.Info, f.Checksum, f.Size)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return previous, tx.Commit()
+}
+
+func (s *PostgresStore) StagePublishLink(id string, fileType string, name string, linkname string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockPublishSession(tx, id); err != nil {
+		return err
+	}
+
+	var found string
+	err = tx.QueryRow(`SELECT name FROM publish_files WHERE session_id = $1 AND type = $2 AND name = $3`,
+		id, fileType, name).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrNotFound
+	case err != nil:
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO publish_links (session_id, type, name, linkname) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, id, fileType, name, linkname)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CommitPublishSession(id string) (Files, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	session, err := getPublishSession(tx, id, " FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := Files{}
+	for _, staged := range session.Files {
+		old := staged
+		var fileId int
+		err = tx.QueryRow(`SELECT file_id, checksum, size, created, modified
+			FROM files
+			WHERE library = $1 AND version = $2 AND ns = $3 AND name = $4 AND type = $5 AND platform = $6 AND arch = $7
+			FOR UPDATE`,
+			staged.Library, staged.Version, staged.NameSpace, staged.Name, staged.Type, staged.Platform, staged.Arch,
+		).Scan(&old.Id, &old.Checksum, &old.Size, &old.Created, &old.Modified)
+		switch {
+		case err == sql.ErrNoRows:
+			err = tx.QueryRow(`INSERT INTO files (library, version, ns, name, type, platform, arch, info, checksum, size)
+				VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+				RETURNING file_id`,
+				staged.Library, staged.Version, staged.NameSpace, staged.Name, staged.Type, staged.Platform, staged.Arch,
+				staged.Info, staged.Checksum, staged.Size).Scan(&fileId)
+		case err == nil:
+			replaced = append(replaced, old)
+			fileId = old.Id
+			// Uploads do not stage any info, keep what the file had then
+			_, err = tx.Exec(`UPDATE files SET checksum = $1, size = $2, info = CASE WHEN $3 = '' THEN info ELSE $3 END, modified = now()
+				WHERE file_id = $4`,
+				staged.Checksum, staged.Size, staged.Info, fileId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, link := range staged.Links {
+			_, err = tx.Exec(`INSERT INTO filelinks (file_id, name) VALUES ($1, $2) ON CONFLICT DO NOTHING`, fileId, link.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err = tx.Exec(`DELETE FROM publish_sessions WHERE session_id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	return replaced, tx.Commit()
+}
+
+func (s *PostgresStore) DeletePublishSession(id string) (PublishSession, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PublishSession{}, err
+	}
+	defer tx.Rollback()
+
+	session, err := getPublishSession(tx, id, " FOR UPDATE")
+	if err != nil {
+		return session, err
+	}
+	if _, err = tx.Exec(`DELETE FROM publish_sessions WHERE session_id = $1`, id); err != nil {
+		return session, err
+	}
+
+	return session, tx.Commit()
+}
@@ -0,0 +1,87 @@
+package depman
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// TLSEnabled reports whether depman-srv serves HTTPS
+func (c TLSConfig) TLSEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// ServerConfig builds the tls.Config for the listener. The certificate
+// itself is loaded by ListenAndServeTLS.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+
+	for cn, grants := range c.Identities {
+		for _, g := range grants {
+			if _, err := ParsePermission(g.Level); err != nil {
+				return nil, fmt.Errorf("Identity %s: %s", cn, err)
+			}
+		}
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch c.ClientAuth {
+	case "", "none":
+		cfg.ClientAuth = tls.NoClientCert
+		return cfg, nil
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown TLS client auth mode: %s", c.ClientAuth)
+	}
+
+	if c.ClientCAFile == "" {
+		return nil, fmt.Errorf("TLS client auth %s needs a client CA file", c.ClientAuth)
+	}
+	pool, err := loadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+
+	return cfg, nil
+}
+
+// loadCertPool reads PEM certificates from path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read CA file %s: %s", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certIdentity maps the verified client certificate of r, if any, to
+// the identity configured for its common name.
+func (c *DepMan) certIdentity(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	grants, ok := c.Config.TLS.Identities[cn]
+	if !ok {
+		return Identity{}, false
+	}
+
+	return Identity{Name: "cert:" + cn, Grants: grants}, true
+}
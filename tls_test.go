@@ -0,0 +1,204 @@
+package depman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent or by itself
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// writePEM writes the certificate and, if keyPath is set, its key
+func (c *testCert) writePEM(t *testing.T, certPath string, keyPath string) {
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	if err := ioutil.WriteFile(certPath, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyPath == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(keyPath, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	ca := newTestCert(t, "depman test CA", nil)
+	serverCert := newTestCert(t, "depman", ca)
+	known := newTestCert(t, "ci", ca)
+	stranger := newTestCert(t, "stranger", ca)
+	otherCA := newTestCert(t, "other CA", nil)
+	forged := newTestCert(t, "ci", otherCA)
+
+	for _, mode := range []string{"optional", "require"} {
+		c, cleanup := newTestDepMan(t)
+		c.Config.Auth.Anonymous = "none"
+		c.Config.TLS = TLSConfig{
+			CertFile:     filepath.Join(c.Config.TempDir, "server.pem"),
+			KeyFile:      filepath.Join(c.Config.TempDir, "server.key"),
+			ClientCAFile: filepath.Join(c.Config.TempDir, "ca.pem"),
+			ClientAuth:   mode,
+			Identities:   map[string][]Grant{"ci": {{"team", "write"}}},
+		}
+		serverCert.writePEM(t, c.Config.TLS.CertFile, c.Config.TLS.KeyFile)
+		ca.writePEM(t, c.Config.TLS.ClientCAFile, "")
+
+		// Set up as Run does, with the certificate ListenAndServeTLS loads
+		tlsConfig, err := c.Config.TLS.ServerConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair, err := tls.LoadX509KeyPair(c.Config.TLS.CertFile, c.Config.TLS.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+		server := httptest.NewUnstartedServer(c.NewRouter())
+		server.TLS = tlsConfig
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.StartTLS()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		tests := []struct {
+			desc   string
+			client *testCert
+			path   string
+			// 0 if the handshake fails
+			code int
+		}{
+			{"known certificate", known, "/v1/team/lib", http.StatusOK},
+			{"known certificate on another namespace", known, "/v1/other/lib", http.StatusForbidden},
+			{"certificate without identity", stranger, "/v1/team/lib", http.StatusUnauthorized},
+			{"certificate of an unknown CA", forged, "/v1/team/lib", 0},
+			{"no certificate", nil, "/v1/team/lib", http.StatusUnauthorized},
+		}
+		for _, test := range tests {
+			clientConfig := &tls.Config{RootCAs: roots}
+			if test.client != nil {
+				// Sent even if its CA is not among those the server asks for
+				cert := test.client.tlsCertificate()
+				clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+			want := test.code
+			if test.client == nil && mode == "require" {
+				want = 0
+			}
+			resp, err := client.Get(server.URL + test.path)
+			switch {
+			case err != nil && want != 0:
+				t.Errorf("%s, %s: %s, want %d", mode, test.desc, err, want)
+			case err == nil && want == 0:
+				t.Errorf("%s, %s: %d, want the handshake to fail", mode, test.desc, resp.StatusCode)
+			case err == nil && resp.StatusCode != want:
+				t.Errorf("%s, %s: %d, want %d", mode, test.desc, resp.StatusCode, want)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+
+		server.Close()
+		cleanup()
+	}
+}
+
+func TestTLSServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	newTestCert(t, "depman test CA", nil).writePEM(t, ca, "")
+
+	tests := []struct {
+		cfg  TLSConfig
+		auth tls.ClientAuthType
+		ok   bool
+	}{
+		{TLSConfig{CertFile: "cert", KeyFile: "key"}, tls.NoClientCert, true},
+		{TLSConfig{CertFile: "cert"}, 0, false},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", ClientAuth: "optional", ClientCAFile: ca}, tls.VerifyClientCertIfGiven, true},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", ClientAuth: "require", ClientCAFile: ca}, tls.RequireAndVerifyClientCert, true},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", ClientAuth: "require"}, 0, false},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", ClientAuth: "require", ClientCAFile: filepath.Join(dir, "missing.pem")}, 0, false},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", ClientAuth: "sometimes", ClientCAFile: ca}, 0, false},
+		{TLSConfig{CertFile: "cert", KeyFile: "key", Identities: map[string][]Grant{"ci": {{"team", "root"}}}}, 0, false},
+	}
+	for _, test := range tests {
+		cfg, err := test.cfg.ServerConfig()
+		switch {
+		case (err == nil) != test.ok:
+			t.Errorf("%+v: error %v, want ok %t", test.cfg, err, test.ok)
+		case err == nil && cfg.ClientAuth != test.auth:
+			t.Errorf("%+v: client auth %v, want %v", test.cfg, cfg.ClientAuth, test.auth)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package depman
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Permission levels, each including the ones below it
+type Permission int
+
+const (
+	PermNone Permission = iota
+	PermRead
+	PermWrite
+	PermAdmin
+)
+
+// AllNamespaces in a Grant applies it to every namespace
+const AllNamespaces = "*"
+
+func (p Permission) String() string {
+	switch p {
+	case PermRead:
+		return "read"
+	case PermWrite:
+		return "write"
+	case PermAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func ParsePermission(s string) (Permission, error) {
+	switch s {
+	case "none", "":
+		return PermNone, nil
+	case "read":
+		return PermRead, nil
+	case "write":
+		return PermWrite, nil
+	case "admin":
+		return PermAdmin, nil
+	}
+	return PermNone, fmt.Errorf("Unknown permission level: %s", s)
+}
+
+// Grant gives a permission level on a namespace, or on all of them
+// if NameSpace is AllNamespaces
+type Grant struct {
+	NameSpace string `json:"ns"`
+	Level     string `json:"level"`
+}
+
+// Token is an API token. Only the SHA-256 of the secret is stored; the
+// secret itself is shown once when the token is created.
+type Token struct {
+	Id      int       `json:"token_id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"-"`
+	Grants  []Grant   `json:"grants"`
+	Created time.Time `json:"created"`
+}
+
+type Tokens []Token
+
+// IssuedToken is a freshly created token together with its secret
+type IssuedToken struct {
+	Token
+	Secret string `json:"secret"`
+}
+
+func (t Token) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(t)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (t Token) ToString() string {
+	grants := make([]string, len(t.Grants))
+	for i, g := range t.Grants {
+		grants[i] = fmt.Sprintf("%s:%s", g.NameSpace, g.Level)
+	}
+	return fmt.Sprintf("%d %s %s", t.Id, t.Name, strings.Join(grants, ","))
+}
+
+func (t Tokens) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(t)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (t Tokens) ToString() string {
+	lines := make([]string, len(t))
+	for i, token := range t {
+		lines[i] = token.ToString()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t IssuedToken) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(t)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (t IssuedToken) ToString() string {
+	return t.Secret
+}
+
+// HashToken returns what is stored for the token secret. Secrets are
+// random, so a plain SHA-256 is enough.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken creates a token with a random secret. Grant levels are
+// validated but nothing is stored yet.
+func NewToken(name string, grants []Grant) (IssuedToken, error) {
+	issued := IssuedToken{}
+
+	if name == "" {
+		return issued, fmt.Errorf("Token name missing")
+	}
+	for _, g := range grants {
+		if g.NameSpace == "" {
+			return issued, fmt.Errorf("Grant without namespace")
+		}
+		if _, err := ParsePermission(g.Level); err != nil {
+			return issued, err
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return issued, err
+	}
+
+	issued.Secret = "dm_" + hex.EncodeToString(buf)
+	issued.Name = name
+	issued.Hash = HashToken(issued.Secret)
+	issued.Grants = grants
+
+	return issued, nil
+}
@@ -2,6 +2,7 @@ package depman
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 )
 
@@ -12,6 +13,9 @@ type JsonAble interface {
 
 type SimpleEntry struct {
 	Name string `json:"name"`
+	// NameSpace is where a library or version was found, for listings
+	// spanning a namespace chain
+	NameSpace string `json:"ns,omitempty"`
 }
 
 func (l SimpleEntry) ToJsonString() (string, error) {
@@ -24,7 +28,10 @@ func (l SimpleEntry) ToJsonString() (string, error) {
 }
 
 func (l SimpleEntry) ToString() string {
-	return l.Name
+	if l.NameSpace == "" {
+		return l.Name
+	}
+	return fmt.Sprintf("%s (%s)", l.Name, l.NameSpace)
 }
 
 type SimpleEntries []SimpleEntry
@@ -0,0 +1,106 @@
+package depman
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// brokenBody hands out its contents and then fails like a connection
+// which broke off
+type brokenBody struct {
+	io.Reader
+}
+
+func (b brokenBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestFailedUploadLeavesNothing(t *testing.T) {
+	const file = "/v1/default/lib/foo/versions/1.0/files/el7/x86_64/lib/libfoo.a"
+
+	tests := []struct {
+		desc, path string
+		body       io.Reader
+		// Declared in the request, -1 for none
+		length   int64
+		checksum string
+	}{
+		{"broken off upload", file + "/upload", brokenBody{strings.NewReader("01234")}, 10, ""},
+		{"short upload", file + "/upload", strings.NewReader("01234"), 10, ""},
+		{"checksum mismatch", file + "/upload", strings.NewReader("0123456789"), 10, testChecksum("other")},
+		{"broken off staging", "{session}/files/lib/libfoo.a", brokenBody{strings.NewReader("01234")}, 10, ""},
+		{"short staging", "{session}/files/lib/libfoo.a", strings.NewReader("01234"), 10, ""},
+		{"checksum mismatch staging", "{session}/files/lib/libfoo.a", strings.NewReader("0123456789"), -1, testChecksum("other")},
+		{"put without contents", file, strings.NewReader("0123456789"), 10, ""},
+	}
+
+	for _, test := range tests {
+		c, cleanup := newTestDepMan(t)
+		router := c.NewRouter()
+		server := httptest.NewServer(router)
+
+		path := test.path
+		session := ""
+		if strings.HasPrefix(path, "{session}") {
+			session = strings.TrimPrefix(openTestSession(t, server.URL), server.URL)
+			path = strings.Replace(path, "{session}", session, 1)
+		}
+
+		// Served directly so the broken body reaches the handler as is
+		r := httptest.NewRequest("PUT", path, test.body)
+		r.ContentLength = test.length
+		if test.checksum != "" {
+			r.Header.Set(ChecksumHeader, test.checksum)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code < 400 {
+			t.Errorf("%s: %d %s, want it rejected", test.desc, w.Code, w.Body.String())
+		}
+
+		files, err := c.Store.GetFiles(map[string]interface{}{"library": "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("%s: left files %v", test.desc, files)
+		}
+		if session != "" {
+			// Nothing was staged to commit
+			if code, body := testRequest(t, "POST", server.URL+session+"/commit", ""); code != http.StatusBadRequest {
+				t.Errorf("%s: commit %d %s, want 400", test.desc, code, body)
+			}
+		}
+		blobs, err := c.Blobs.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blobs) != 0 {
+			t.Errorf("%s: left blobs %v", test.desc, blobs)
+		}
+		if refs := blobRefs(t, c); len(refs) != 0 {
+			t.Errorf("%s: left references %v", test.desc, refs)
+		}
+		// The blob store lives in the temp dir as well
+		entries, err := ioutil.ReadDir(c.Config.TempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "depman-upload-") {
+				t.Errorf("%s: left staged upload %s", test.desc, entry.Name())
+			}
+		}
+
+		server.Close()
+		cleanup()
+	}
+}
@@ -0,0 +1,346 @@
+package depman
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed library version. Besides semantic versions depman
+// accepts the looser schemes libraries actually use: any number of
+// numeric components ("1.2", "4.1.0.3"), a pre-release after "-"
+// ("1.2.3-rc1"), a letter suffix ("1.0.2k") and build metadata after
+// "+". Missing components count as 0, so "1.2" equals "1.2.0".
+//
+// A letter suffix marks a release after the plain number, as in the
+// OpenSSL scheme: 1.0.2 < 1.0.2a < 1.0.2k < 1.0.2za < 1.0.3.
+type Version struct {
+	Raw    string
+	Nums   []int
+	Suffix string
+	Pre    string
+	Build  string
+}
+
+func ParseVersion(s string) (Version, error) {
+	v := Version{Raw: s}
+
+	rest := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		v.Build = rest[i+1:]
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		v.Pre = rest[i+1:]
+		rest = rest[:i]
+		if v.Pre == "" {
+			return v, fmt.Errorf("Invalid version %s: empty pre-release", s)
+		}
+	}
+
+	parts := strings.Split(rest, ".")
+	for idx, part := range parts {
+		digits := 0
+		for digits < len(part) && part[digits] >= '0' && part[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 {
+			return v, fmt.Errorf("Invalid version %s", s)
+		}
+
+		num, err := strconv.Atoi(part[:digits])
+		if err != nil {
+			return v, fmt.Errorf("Invalid version %s: %s", s, err)
+		}
+		v.Nums = append(v.Nums, num)
+
+		if digits < len(part) {
+			// Letter suffix such as 1.0.2k - only on the last component
+			if idx != len(parts)-1 {
+				return v, fmt.Errorf("Invalid version %s", s)
+			}
+			v.Suffix = part[digits:]
+		}
+	}
+
+	return v, nil
+}
+
+func (v Version) num(i int) int {
+	if i < len(v.Nums) {
+		return v.Nums[i]
+	}
+	return 0
+}
+
+// Compare orders versions by semantic version precedence: numerically by
+// component, then by letter suffix (none first, then shorter ones, then
+// lexically), then pre-releases before the release. Build metadata is
+// ignored.
+func (v Version) Compare(o Version) int {
+	n := len(v.Nums)
+	if len(o.Nums) > n {
+		n = len(o.Nums)
+	}
+	for i := 0; i < n; i++ {
+		if a, b := v.num(i), o.num(i); a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	if v.Suffix != o.Suffix {
+		if len(v.Suffix) != len(o.Suffix) {
+			if len(v.Suffix) < len(o.Suffix) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(v.Suffix, o.Suffix)
+	}
+
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	}
+	return comparePreRelease(v.Pre, o.Pre)
+}
+
+// comparePreRelease compares dot separated identifiers: numbers
+// numerically and below words, words lexically, shorter lists first.
+func comparePreRelease(a string, b string) int {
+	aparts := strings.Split(a, ".")
+	bparts := strings.Split(b, ".")
+
+	for i := 0; i < len(aparts) && i < len(bparts); i++ {
+		ai, aerr := strconv.Atoi(aparts[i])
+		bi, berr := strconv.Atoi(bparts[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if ai != bi {
+				if ai < bi {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		case aparts[i] != bparts[i]:
+			return strings.Compare(aparts[i], bparts[i])
+		}
+	}
+
+	return len(aparts) - len(bparts)
+}
+
+// CompareVersions orders any two version strings. Versions which do not
+// parse sort below all others, lexically among themselves; ties are
+// broken by the raw string so the order is total.
+func CompareVersions(a string, b string) int {
+	va, aerr := ParseVersion(a)
+	vb, berr := ParseVersion(b)
+
+	switch {
+	case aerr == nil && berr == nil:
+		if c := va.Compare(vb); c != 0 {
+			return c
+		}
+	case aerr == nil:
+		return 1
+	case berr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// SortVersions sorts versions in ascending order
+func SortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) < 0
+	})
+}
+
+type versionTerm struct {
+	op  string
+	ver Version
+}
+
+func (t versionTerm) match(v Version) bool {
+	c := v.Compare(t.ver)
+	switch t.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "raw":
+		return v.Raw == t.ver.Raw
+	case "prefix":
+		for i, n := range t.ver.Nums {
+			if v.num(i) != n {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Constraint selects versions. It is a comma separated list of terms
+// which all have to match:
+//
+//	latest, *       any version
+//	1.4, 1.4.x      1.4 and every 1.4.* version (but not 1.40), including
+//	                letter suffixes such as 1.4.2k
+//	=1.4.2          exactly 1.4.2 (or 1.4.2.0)
+//	>, >=, <, <=, != comparisons
+//	~1.4            >=1.4,<1.5 (~1 is >=1,<2)
+//	^3              >=3,<4; below 1.0 the first non-zero component is
+//	                kept (^0.2.1 is >=0.2.1,<0.3)
+//
+// Pre-releases only match if a term of the constraint names one.
+// Versions which do not parse only match when given verbatim or with
+// "latest".
+type Constraint struct {
+	Raw   string
+	terms []versionTerm
+	pre   bool
+}
+
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{Raw: s}
+
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		switch raw {
+		case "", "latest", "*", "x":
+			continue
+		}
+
+		terms, err := parseTerm(raw)
+		if err != nil {
+			return c, BadRequestError(fmt.Sprintf("Invalid version constraint %s: %s", s, err))
+		}
+		for _, t := range terms {
+			if t.ver.Pre != "" {
+				c.pre = true
+			}
+		}
+		c.terms = append(c.terms, terms...)
+	}
+
+	return c, nil
+}
+
+func parseTerm(raw string) ([]versionTerm, error) {
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if !strings.HasPrefix(raw, op) {
+			continue
+		}
+		v, err := ParseVersion(strings.TrimSpace(strings.TrimPrefix(raw, op)))
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "~":
+			pos := 1
+			if len(v.Nums) == 1 {
+				pos = 0
+			}
+			return []versionTerm{{">=", v}, {"<", bumpVersion(v, pos)}}, nil
+		case "^":
+			pos := 0
+			for pos < len(v.Nums)-1 && v.Nums[pos] == 0 {
+				pos++
+			}
+			return []versionTerm{{">=", v}, {"<", bumpVersion(v, pos)}}, nil
+		}
+		return []versionTerm{{op, v}}, nil
+	}
+
+	// Bare version, optionally ending in .x or .*
+	trimmed := raw
+	for strings.HasSuffix(trimmed, ".x") || strings.HasSuffix(trimmed, ".*") {
+		trimmed = trimmed[:len(trimmed)-2]
+	}
+	v, err := ParseVersion(trimmed)
+	if err != nil {
+		// Not a version we understand, such as "trunk"
+		return []versionTerm{{"raw", Version{Raw: raw}}}, nil
+	}
+	if v.Suffix != "" || v.Pre != "" || v.Build != "" {
+		return []versionTerm{{"=", v}}, nil
+	}
+	return []versionTerm{{"prefix", v}}, nil
+}
+
+// bumpVersion returns the smallest pre-release of v with component pos
+// incremented and everything after it dropped, i.e. an exclusive upper
+// bound which keeps pre-releases of the next version out.
+func bumpVersion(v Version, pos int) Version {
+	b := Version{Nums: make([]int, pos+1), Pre: "0"}
+	copy(b.Nums, v.Nums)
+	b.Nums[pos]++
+	return b
+}
+
+// Match checks a version string against the constraint
+func (c Constraint) Match(version string) bool {
+	v, err := ParseVersion(version)
+	if err != nil {
+		v = Version{Raw: version}
+	}
+
+	if v.Pre != "" && !c.pre {
+		return false
+	}
+	for _, t := range c.terms {
+		if err != nil && t.op != "raw" {
+			// Only verbatim terms apply to versions we do not understand
+			return false
+		}
+		if !t.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveVersion returns the highest of versions matching constraint
+func ResolveVersion(versions []string, constraint string) (string, error) {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	for _, v := range versions {
+		if !c.Match(v) {
+			continue
+		}
+		if best == "" || CompareVersions(v, best) > 0 {
+			best = v
+		}
+	}
+
+	if best == "" {
+		return best, ErrNotFound
+	}
+	return best, nil
+}
@@ -0,0 +1,179 @@
+package depman
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Version
+	}{
+		{"1.2.3", Version{Nums: []int{1, 2, 3}}},
+		{"v1.2", Version{Nums: []int{1, 2}}},
+		{"4.1.0.3", Version{Nums: []int{4, 1, 0, 3}}},
+		{"1.2.3-rc1", Version{Nums: []int{1, 2, 3}, Pre: "rc1"}},
+		{"1.2.3-rc.1+build.5", Version{Nums: []int{1, 2, 3}, Pre: "rc.1", Build: "build.5"}},
+		{"1.0+b1", Version{Nums: []int{1, 0}, Build: "b1"}},
+		{"1.0.2k", Version{Nums: []int{1, 0, 2}, Suffix: "k"}},
+		{"1.0.2za-rc1", Version{Nums: []int{1, 0, 2}, Suffix: "za", Pre: "rc1"}},
+	}
+	for _, test := range tests {
+		got, err := ParseVersion(test.in)
+		if err != nil {
+			t.Errorf("ParseVersion(%q): %s", test.in, err)
+			continue
+		}
+		test.want.Raw = test.in
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"", "trunk", "1.x", "1a.2", "1.2-", "1..2", "-rc1"} {
+		if v, err := ParseVersion(in); err == nil {
+			t.Errorf("ParseVersion(%q) = %+v, want an error", in, v)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// Each version sorts strictly before the next one
+	ordered := []string{
+		"nightly",
+		"trunk",
+		"0.9",
+		"1.0-alpha",
+		"1.0-alpha.1",
+		"1.0-alpha.beta",
+		"1.0-beta.2",
+		"1.0-beta.11",
+		"1.0-rc1",
+		"1.0",
+		"1.0.1",
+		"1.0.2",
+		"1.0.2a",
+		"1.0.2k-rc1",
+		"1.0.2k",
+		"1.0.2z",
+		"1.0.2za",
+		"1.0.3",
+		"1.2",
+		"1.10",
+		"2",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := sign(CompareVersions(ordered[i], ordered[j])); got != want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	equal := [][2]string{
+		{"1.2", "1.2.0"},
+		{"1.2.0", "v1.2"},
+	}
+	for _, pair := range equal {
+		a, _ := ParseVersion(pair[0])
+		b, _ := ParseVersion(pair[1])
+		if c := a.Compare(b); c != 0 {
+			t.Errorf("%s compared to %s = %d, want 0", pair[0], pair[1], c)
+		}
+	}
+
+	versions := []string{"1.0.2k", "1.0.2", "1.0.10", "1.0.2-rc1", "1.0.2a"}
+	SortVersions(versions)
+	if want := []string{"1.0.2-rc1", "1.0.2", "1.0.2a", "1.0.2k", "1.0.10"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("SortVersions = %v, want %v", versions, want)
+	}
+}
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestConstraintMatch(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		nomatch    []string
+	}{
+		{"latest", []string{"1.0", "1.0.2k", "trunk"}, []string{"1.1-rc1"}},
+		{"*", []string{"0.1", "1.0.2k"}, []string{"2.0-beta"}},
+		{"1.4", []string{"1.4", "1.4.0", "1.4.2", "1.4.2k", "1.4.2.1"}, []string{"1.40", "1.5", "1.3.9", "1.4.3-rc1"}},
+		{"1.4.x", []string{"1.4.7"}, []string{"1.40"}},
+		{"1.0.2", []string{"1.0.2", "1.0.2k"}, []string{"1.0.20", "1.0.3"}},
+		{"1.0.2k", []string{"1.0.2k"}, []string{"1.0.2", "1.0.2m"}},
+		{"=1.4.2", []string{"1.4.2", "1.4.2.0", "1.4.2+b7"}, []string{"1.4.2.1", "1.4.2k"}},
+		{">=1.2,<2", []string{"1.2", "1.9.9", "1.2k"}, []string{"1.1", "2.0", "2.0-rc1"}},
+		{">1.0.2", []string{"1.0.2a", "1.0.3"}, []string{"1.0.2", "1.0.1"}},
+		{"!=1.3", []string{"1.2", "1.3.1"}, []string{"1.3", "1.3.0"}},
+		{"~1.4", []string{"1.4", "1.4.9", "1.4.9k"}, []string{"1.5", "1.3", "1.5-rc1"}},
+		{"~1", []string{"1.0", "1.9"}, []string{"2.0"}},
+		{"^3", []string{"3.0", "3.9.1"}, []string{"4.0", "2.9"}},
+		{"^0.2.1", []string{"0.2.1", "0.2.9"}, []string{"0.3.0", "0.2.0"}},
+		{">=2.0-rc1", []string{"2.0-rc1", "2.0-rc2", "2.0"}, []string{"2.0-beta", "1.9"}},
+		{"trunk", []string{"trunk"}, []string{"1.0", "nightly"}},
+	}
+	for _, test := range tests {
+		c, err := ParseConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("ParseConstraint(%q): %s", test.constraint, err)
+			continue
+		}
+		for _, v := range test.match {
+			if !c.Match(v) {
+				t.Errorf("%q does not match %s, but should", test.constraint, v)
+			}
+		}
+		for _, v := range test.nomatch {
+			if c.Match(v) {
+				t.Errorf("%q matches %s, but should not", test.constraint, v)
+			}
+		}
+	}
+
+	for _, raw := range []string{">=1.x", "~abc", "^"} {
+		if _, err := ParseConstraint(raw); err == nil {
+			t.Errorf("ParseConstraint(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	versions := []string{"1.0.1", "1.0.2", "1.0.2a", "1.0.2k", "1.1.0-rc1", "1.1.0-rc2", "trunk"}
+	tests := []struct {
+		constraint string
+		want       string
+		err        error
+	}{
+		{"latest", "1.0.2k", nil},
+		{"1.0", "1.0.2k", nil},
+		{"1.0.1", "1.0.1", nil},
+		{"<1.0.2k", "1.0.2a", nil},
+		{">=1.1.0-rc1", "1.1.0-rc2", nil},
+		{"trunk", "trunk", nil},
+		{"2", "", ErrNotFound},
+	}
+	for _, test := range tests {
+		got, err := ResolveVersion(versions, test.constraint)
+		if got != test.want || err != test.err {
+			t.Errorf("ResolveVersion(%q) = %q, %v; want %q, %v", test.constraint, got, err, test.want, test.err)
+		}
+	}
+}